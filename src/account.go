@@ -32,7 +32,7 @@ func HandleSignup(c *gin.Context) {
 		Email:                   body_data.Email,
 		Role:                    body_data.Role,
 		PhotoURL:                "",
-		FavoriteStationIDs:      []string{},
+		FavoriteStationIDs:      []primitive.ObjectID{},
 		SecurityQuestionAnswers: body_data.SecurityQuestionAnswers,
 	}
 	user_id, err := CreateOne(USER_COLL, new_user)
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const AMENITY_CATEGORY_FACILITY = "facility"
+const AMENITY_CATEGORY_ACCESSIBILITY = "accessibility"
+
+// catalog entries every deployment starts with. admins add more through the
+// admin routes.
+var default_amenities = []Amenity{
+	{Key: "restrooms", Name: "Restrooms", Category: AMENITY_CATEGORY_FACILITY},
+	{Key: "covered_parking", Name: "Covered parking", Category: AMENITY_CATEGORY_FACILITY},
+	{Key: "lighting_24h", Name: "24h lighting", Category: AMENITY_CATEGORY_FACILITY},
+	{Key: "food_nearby", Name: "Food nearby", Category: AMENITY_CATEGORY_FACILITY},
+	{Key: "wifi", Name: "Wi-Fi", Category: AMENITY_CATEGORY_FACILITY},
+	{Key: "wheelchair_access", Name: "Wheelchair access", Category: AMENITY_CATEGORY_ACCESSIBILITY},
+	{Key: "accessible_parking", Name: "Accessible parking space", Category: AMENITY_CATEGORY_ACCESSIBILITY},
+	{Key: "step_free_route", Name: "Step-free route to chargers", Category: AMENITY_CATEGORY_ACCESSIBILITY},
+}
+
+var amenity_key_regex = regexp.MustCompile(`^[a-z0-9_]{2,40}$`)
+
+// Adds any missing default amenities, leaving admin edits alone.
+func SeedAmenities() {
+	coll := mongoClient.Database("GoCharge").Collection(AMENITY_COLL)
+	for _, amenity := range default_amenities {
+		_, err := coll.UpdateOne(
+			context.TODO(),
+			bson.D{{"key", amenity.Key}},
+			bson.D{{"$setOnInsert", bson.D{
+				{"_id", primitive.NewObjectID()},
+				{"name", amenity.Name},
+				{"category", amenity.Category},
+				{"is_active", true},
+				{"created_at", time.Now()},
+			}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			log.Printf("failed to seed amenity %s: %s", amenity.Key, err)
+		}
+	}
+}
+
+// Dedupes amenity keys and checks them against the active catalog. Keys in
+// existing were already set on the station and may stay even if retired.
+func ValidateAmenities(keys []string, existing []string) ([]string, error) {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	if len(unique) == 0 {
+		return unique, nil
+	}
+
+	amenities, err := GetAll[Amenity](AMENITY_COLL, bson.D{
+		{"key", bson.D{{"$in", unique}}},
+		{"is_active", true},
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, key := range existing {
+		known[key] = true
+	}
+	for _, amenity := range amenities {
+		known[amenity.Key] = true
+	}
+	for _, key := range unique {
+		if !known[key] {
+			return nil, errors.New("Unknown amenity: " + key)
+		}
+	}
+	return unique, nil
+}
+
+// Get the active amenity catalog, for station forms and search filters.
+func HandleGetAmenities(c *gin.Context) {
+	amenities, err := GetAll[Amenity](AMENITY_COLL, bson.D{{"is_active", true}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, amenities)
+}
+
+// Get the whole catalog, including retired amenities.
+func HandleGetAllAmenities(c *gin.Context) {
+	amenities, err := GetAll[Amenity](AMENITY_COLL, bson.D{}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, amenities)
+}
+
+func HandleAddAmenity(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[AmenityInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if !amenity_key_regex.MatchString(body_data.Key) {
+		c.JSON(http.StatusBadRequest, "Key must be 2-40 lowercase letters, digits or underscores")
+		return
+	}
+	if body_data.Name == "" {
+		c.JSON(http.StatusBadRequest, "Name is required")
+		return
+	}
+	if body_data.Category != AMENITY_CATEGORY_FACILITY && body_data.Category != AMENITY_CATEGORY_ACCESSIBILITY {
+		c.JSON(http.StatusBadRequest, "Category must be 'facility' or 'accessibility'")
+		return
+	}
+
+	amenity := Amenity{
+		ID:        primitive.NewObjectID(),
+		Key:       body_data.Key,
+		Name:      body_data.Name,
+		Category:  body_data.Category,
+		IsActive:  true,
+		CreatedAt: time.Now(),
+	}
+	_, err = CreateOne(AMENITY_COLL, amenity)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, "An amenity with this key already exists")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, amenity)
+}
+
+// Rename, recategorize or retire an amenity. Keys never change since stations
+// store them. Retired amenities stay on stations but can't be newly set.
+func HandleEditAmenity(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[AmenityInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Name == "" {
+		c.JSON(http.StatusBadRequest, "Name is required")
+		return
+	}
+	if body_data.Category != AMENITY_CATEGORY_FACILITY && body_data.Category != AMENITY_CATEGORY_ACCESSIBILITY {
+		c.JSON(http.StatusBadRequest, "Category must be 'facility' or 'accessibility'")
+		return
+	}
+
+	update := bson.D{
+		{"name", body_data.Name},
+		{"category", body_data.Category},
+	}
+	if body_data.IsActive != nil {
+		update = append(update, bson.E{"is_active", *body_data.IsActive})
+	}
+	err = UpdateOne(AMENITY_COLL, bson.D{{"key", body_data.Key}}, bson.D{{"$set", update}})
+	// saving an amenity as it is changes nothing.
+	if err != nil && err != ErrNoRecordsModified {
+		c.JSON(http.StatusNotFound, "No amenity with this key found")
+		return
+	}
+
+	amenity, err := GetOne[Amenity](AMENITY_COLL, bson.D{{"key", body_data.Key}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, amenity)
+}
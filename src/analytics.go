@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DEFAULT_ROLLUP_INTERVAL_MINUTES = 60
+const ROLLUP_CHUNK_DAYS = 7
+const DEFAULT_ANALYTICS_DAYS = 30
+const MAX_ANALYTICS_DAYS = 366
+const ANALYTICS_DATE_FORMAT = "2006-01-02"
+const SECONDS_PER_DAY = 24 * 60 * 60
+
+// a finished session along with the station of its charger.
+type RolledSession struct {
+	ChargerID      primitive.ObjectID `bson:"charger_id"`
+	StationID      primitive.ObjectID `bson:"station_id"`
+	StartTimestamp int64              `bson:"start_timestamp"`
+	EndTimestamp   int64              `bson:"end_timestamp"`
+	PaymentAmount  float64            `bson:"payment_amount"`
+	PowerUsed      float64            `bson:"power_used"`
+}
+
+func StartOfDayUTC(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Recomputes the daily rollups of every day in [from_day, to_day]. Session
+// counts, revenue and kWh land on the day a session ended, while busy time is
+// split over the days and hours the session covered.
+func ComputeDailyRollups(from_day time.Time, to_day time.Time) error {
+	window_start := from_day.Unix()
+	window_end := to_day.AddDate(0, 0, 1).Unix()
+
+	sessions, err := Aggregate[RolledSession](SESSION_COLL, bson.A{
+		bson.D{
+			{"$match", bson.D{
+				{"end_timestamp", bson.D{{"$gte", window_start}}},
+				{"start_timestamp", bson.D{{"$lt", window_end}}},
+			}},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Chargers"},
+				{"localField", "charger_id"},
+				{"foreignField", "_id"},
+				{"as", "charger"},
+			}},
+		},
+		bson.D{
+			{"$unwind", "$charger"},
+		},
+		bson.D{
+			{"$set", bson.D{{"station_id", "$charger.station_id"}}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	type rollup_key struct {
+		charger_id primitive.ObjectID
+		day        int64
+	}
+	rollups := map[rollup_key]*ChargerDailyStats{}
+	rollup_for := func(session RolledSession, timestamp int64) *ChargerDailyStats {
+		day := timestamp - timestamp%SECONDS_PER_DAY
+		key := rollup_key{session.ChargerID, day}
+		if rollups[key] == nil {
+			rollups[key] = &ChargerDailyStats{
+				ChargerID: session.ChargerID,
+				StationID: session.StationID,
+				Day:       time.Unix(day, 0).UTC(),
+			}
+		}
+		return rollups[key]
+	}
+
+	for _, session := range sessions {
+		if session.EndTimestamp < window_end {
+			rollup := rollup_for(session, session.EndTimestamp)
+			rollup.SessionCount++
+			rollup.PowerUsed += session.PowerUsed
+			rollup.Revenue += session.PaymentAmount
+			rollup.DurationSeconds += session.EndTimestamp - session.StartTimestamp
+		}
+
+		// walk the part of the session inside the window an hour at a time.
+		start := max(session.StartTimestamp, window_start)
+		end := min(session.EndTimestamp, window_end)
+		for start < end {
+			hour_end := min(start-start%3600+3600, end)
+			rollup := rollup_for(session, start)
+			rollup.BusySeconds += hour_end - start
+			rollup.HourlyBusySeconds[(start%SECONDS_PER_DAY)/3600] += hour_end - start
+			start = hour_end
+		}
+	}
+
+	coll := mongoClient.Database("GoCharge").Collection(CHARGER_DAILY_STATS_COLL)
+	for _, rollup := range rollups {
+		_, err := coll.ReplaceOne(
+			context.TODO(),
+			bson.D{
+				{"charger_id", rollup.ChargerID},
+				{"day", rollup.Day},
+			},
+			rollup,
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rolls up every day touched by sessions that ended since the last rolled
+// day, including the earlier days of long sessions.
+func RollUpRecentDays() error {
+	today := StartOfDayUTC(time.Now())
+	from_day := today
+
+	var latest ChargerDailyStats
+	err := mongoClient.Database("GoCharge").Collection(CHARGER_DAILY_STATS_COLL).FindOne(
+		context.TODO(),
+		bson.D{},
+		options.FindOne().SetSort(bson.D{{"day", -1}}),
+	).Decode(&latest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		from_day = StartOfDayUTC(latest.Day)
+	}
+
+	// backfill from the first session on the first run, and reach back to the
+	// start of any long session that ended since.
+	var earliest Session
+	filter := bson.D{{"end_timestamp", bson.D{{"$gt", 0}}}}
+	if err == nil {
+		filter = bson.D{{"end_timestamp", bson.D{{"$gte", from_day.Unix()}}}}
+	}
+	err = mongoClient.Database("GoCharge").Collection(SESSION_COLL).FindOne(
+		context.TODO(),
+		filter,
+		options.FindOne().SetSort(bson.D{{"start_timestamp", 1}}),
+	).Decode(&earliest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		from_day = StartOfDayUTC(time.Unix(min(earliest.StartTimestamp, from_day.Unix()), 0))
+	}
+
+	for chunk_start := from_day; !chunk_start.After(today); chunk_start = chunk_start.AddDate(0, 0, ROLLUP_CHUNK_DAYS) {
+		chunk_end := chunk_start.AddDate(0, 0, ROLLUP_CHUNK_DAYS-1)
+		if chunk_end.After(today) {
+			chunk_end = today
+		}
+		err := ComputeDailyRollups(chunk_start, chunk_end)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RunAnalyticsRollupJob() {
+	interval := time.Duration(ReadEnvInt64("ANALYTICS_ROLLUP_INTERVAL_MINUTES", DEFAULT_ROLLUP_INTERVAL_MINUTES)) * time.Minute
+	for {
+		err := RollUpRecentDays()
+		if err != nil {
+			log.Printf("analytics rollup failed: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Parses an inclusive date range, defaulting to the last 30 days.
+func ParseAnalyticsRange(from string, to string) (time.Time, time.Time, error) {
+	to_day := StartOfDayUTC(time.Now())
+	if to != "" {
+		parsed, err := time.Parse(ANALYTICS_DATE_FORMAT, to)
+		if err != nil {
+			return to_day, to_day, errors.New("to must be a YYYY-MM-DD date")
+		}
+		to_day = parsed
+	}
+	from_day := to_day.AddDate(0, 0, -(DEFAULT_ANALYTICS_DAYS - 1))
+	if from != "" {
+		parsed, err := time.Parse(ANALYTICS_DATE_FORMAT, from)
+		if err != nil {
+			return from_day, to_day, errors.New("from must be a YYYY-MM-DD date")
+		}
+		from_day = parsed
+	}
+
+	if from_day.After(to_day) {
+		return from_day, to_day, errors.New("from must not be after to")
+	}
+	if to_day.Sub(from_day) >= MAX_ANALYTICS_DAYS*SECONDS_PER_DAY*time.Second {
+		return from_day, to_day, errors.New("Date range can span at most 366 days")
+	}
+	return from_day, to_day, nil
+}
+
+// Adds up rollups over a range. charger_count is how many chargers the busy
+// time is shared between.
+func SummarizeRollups(rollups []ChargerDailyStats, from_day time.Time, to_day time.Time, charger_count int) AnalyticsSummary {
+	summary := AnalyticsSummary{}
+	busy_seconds := int64(0)
+	duration_seconds := int64(0)
+	heatmap_busy := [7][24]int64{}
+	for _, rollup := range rollups {
+		summary.SessionCount += rollup.SessionCount
+		summary.PowerUsed += rollup.PowerUsed
+		summary.Revenue += rollup.Revenue
+		duration_seconds += rollup.DurationSeconds
+		busy_seconds += rollup.BusySeconds
+		for hour, seconds := range rollup.HourlyBusySeconds {
+			heatmap_busy[rollup.Day.Weekday()][hour] += seconds
+		}
+	}
+
+	if summary.SessionCount > 0 {
+		summary.AvgDurationSeconds = float64(duration_seconds) / float64(summary.SessionCount)
+	}
+	if charger_count == 0 {
+		return summary
+	}
+
+	days := int(to_day.Sub(from_day).Hours()/24) + 1
+	summary.UtilizationPercent = 100 * float64(busy_seconds) / float64(int64(days)*SECONDS_PER_DAY*int64(charger_count))
+
+	weekday_counts := [7]int{}
+	for day := from_day; !day.After(to_day); day = day.AddDate(0, 0, 1) {
+		weekday_counts[day.Weekday()]++
+	}
+	for weekday := range heatmap_busy {
+		if weekday_counts[weekday] == 0 {
+			continue
+		}
+		for hour, seconds := range heatmap_busy[weekday] {
+			summary.Heatmap[weekday][hour] = 100 * float64(seconds) / float64(weekday_counts[weekday]*3600*charger_count)
+		}
+	}
+	return summary
+}
+
+// Get utilization, sessions, kWh, revenue and an hour-of-week heatmap for a
+// station and each of its chargers, from the daily rollups.
+func HandleStationAnalytics(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationAnalyticsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from_day, to_day, err := ParseAnalyticsRange(body_data.From, body_data.To)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{{"station_id", body_data.StationID}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rollups, err := GetAll[ChargerDailyStats](CHARGER_DAILY_STATS_COLL, bson.D{
+		{"station_id", body_data.StationID},
+		{"day", bson.D{
+			{"$gte", from_day},
+			{"$lte", to_day},
+		}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	by_charger := map[primitive.ObjectID][]ChargerDailyStats{}
+	for _, rollup := range rollups {
+		by_charger[rollup.ChargerID] = append(by_charger[rollup.ChargerID], rollup)
+	}
+
+	output := StationAnalyticsOutput{
+		StationID: body_data.StationID,
+		From:      from_day.Format(ANALYTICS_DATE_FORMAT),
+		To:        to_day.Format(ANALYTICS_DATE_FORMAT),
+		Summary:   SummarizeRollups(rollups, from_day, to_day, len(chargers)),
+		Chargers:  []ChargerAnalytics{},
+	}
+	for _, charger := range chargers {
+		output.Chargers = append(output.Chargers, ChargerAnalytics{
+			ChargerID: charger.ID,
+			Name:      charger.Name,
+			Summary:   SummarizeRollups(by_charger[charger.ID], from_day, to_day, 1),
+		})
+	}
+
+	c.JSON(http.StatusOK, output)
+}
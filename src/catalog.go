@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CATALOG_KIND_CONNECTOR = "connector"
+const CATALOG_KIND_POWER = "power"
+
+const CURRENT_AC = "AC"
+const CURRENT_DC = "DC"
+const CURRENT_AC_DC = "AC/DC"
+
+// connector ids stored in Charger.ChargerTypesId.
+const CONNECTOR_J1772 = "j1772"
+const CONNECTOR_CCS1 = "ccs1"
+const CONNECTOR_CCS2 = "ccs2"
+const CONNECTOR_CHADEMO = "chademo"
+const CONNECTOR_NACS = "nacs"
+const CONNECTOR_TYPE2 = "type2"
+const CONNECTOR_OTHER = "other"
+
+// power tiers stored in Charger.KWhTypesId.
+const POWER_LEVEL1 = "level1"
+const POWER_LEVEL2 = "level2"
+const POWER_DCFC = "dcfc"
+
+// catalog entries every deployment starts with. aliases are the spellings
+// owners have used, compared with CatalogToken.
+var default_catalog = []ChargerCatalogEntry{
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_J1772, Name: "J1772 (Type 1)", CurrentType: CURRENT_AC, MaxKW: 19.2,
+		Aliases: []string{"j-1772", "sae j1772", "type 1", "type1", "t1"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_CCS1, Name: "CCS1 (Combo 1)", CurrentType: CURRENT_DC, MaxKW: 350,
+		Aliases: []string{"ccs 1", "combo 1", "ccs combo 1", "sae combo"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_CCS2, Name: "CCS2 (Combo 2)", CurrentType: CURRENT_DC, MaxKW: 350,
+		Aliases: []string{"ccs 2", "combo 2", "ccs combo 2"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_CHADEMO, Name: "CHAdeMO", CurrentType: CURRENT_DC, MaxKW: 100,
+		Aliases: []string{"cha de mo"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_NACS, Name: "NACS (SAE J3400)", CurrentType: CURRENT_AC_DC, MaxKW: 250,
+		Aliases: []string{"j3400", "sae j3400"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_TYPE2, Name: "Type 2 (Mennekes)", CurrentType: CURRENT_AC, MaxKW: 43,
+		Aliases: []string{"mennekes", "t2", "iec 62196-2"}},
+	{Kind: CATALOG_KIND_CONNECTOR, Key: CONNECTOR_OTHER, Name: "Other", CurrentType: CURRENT_AC_DC, MaxKW: 0,
+		Aliases: []string{}},
+	{Kind: CATALOG_KIND_POWER, Key: POWER_LEVEL1, Name: "Level 1", CurrentType: CURRENT_AC, MaxKW: 2,
+		Aliases: []string{"l1", "lvl1", "120v"}},
+	{Kind: CATALOG_KIND_POWER, Key: POWER_LEVEL2, Name: "Level 2", CurrentType: CURRENT_AC, MaxKW: 22,
+		Aliases: []string{"l2", "lvl2", "240v", "ac"}},
+	{Kind: CATALOG_KIND_POWER, Key: POWER_DCFC, Name: "DC fast", CurrentType: CURRENT_DC, MaxKW: 350,
+		Aliases: []string{"dc", "dc fast", "fast", "level 3", "l3", "rapid"}},
+}
+
+// spellings that name more than one connector depending on the region, like
+// CCS1 or CCS2 and NACS or Type 2 for Tesla. they are never guessed, even
+// when an older catalog still lists them as aliases.
+var ambiguous_catalog_tokens = map[string]map[string]bool{
+	CATALOG_KIND_CONNECTOR: {"ccs": true, "combo": true, "ccscombo": true, "tesla": true, "supercharger": true},
+}
+
+var catalog_key_regex = regexp.MustCompile(`^[a-z0-9_]{2,40}$`)
+var catalog_token_regex = regexp.MustCompile(`[^a-z0-9]+`)
+var catalog_kw_regex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)kw$`)
+
+var ErrUnknownConnector = errors.New("Unknown connector type")
+var ErrUnknownPowerLevel = errors.New("Unknown power level")
+
+// Lowercases and drops everything but letters and digits, so "CCS-1",
+// "ccs 1" and "ccs1" compare equal.
+func CatalogToken(value string) string {
+	return catalog_token_regex.ReplaceAllString(strings.ToLower(value), "")
+}
+
+// Adds any missing default entries, leaving admin edits alone.
+func SeedChargerCatalog() {
+	coll := mongoClient.Database("GoCharge").Collection(CHARGER_CATALOG_COLL)
+	for _, entry := range default_catalog {
+		_, err := coll.UpdateOne(
+			context.TODO(),
+			bson.D{{"kind", entry.Kind}, {"key", entry.Key}},
+			bson.D{{"$setOnInsert", bson.D{
+				{"_id", primitive.NewObjectID()},
+				{"name", entry.Name},
+				{"current_type", entry.CurrentType},
+				{"max_kw", entry.MaxKW},
+				{"aliases", entry.Aliases},
+				{"is_active", true},
+				{"created_at", time.Now()},
+			}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			log.Printf("failed to seed catalog entry %s: %s", entry.Key, err)
+		}
+	}
+}
+
+// the catalog indexed for lookups, retired entries included.
+type ChargerCatalog struct {
+	entries map[string]map[string]ChargerCatalogEntry // kind, then key
+	tokens  map[string]map[string]string              // kind, then key or alias token, to key
+}
+
+func LoadChargerCatalog() (ChargerCatalog, error) {
+	entries, err := GetAll[ChargerCatalogEntry](CHARGER_CATALOG_COLL, bson.D{}, 0)
+	if err != nil {
+		return NewChargerCatalog(nil), err
+	}
+	return NewChargerCatalog(entries), nil
+}
+
+func NewChargerCatalog(entries []ChargerCatalogEntry) ChargerCatalog {
+	catalog := ChargerCatalog{
+		entries: map[string]map[string]ChargerCatalogEntry{
+			CATALOG_KIND_CONNECTOR: {},
+			CATALOG_KIND_POWER:     {},
+		},
+		tokens: map[string]map[string]string{
+			CATALOG_KIND_CONNECTOR: {},
+			CATALOG_KIND_POWER:     {},
+		},
+	}
+	for _, entry := range entries {
+		if catalog.entries[entry.Kind] == nil {
+			continue
+		}
+		catalog.entries[entry.Kind][entry.Key] = entry
+		for _, alias := range entry.Aliases {
+			catalog.tokens[entry.Kind][CatalogToken(alias)] = entry.Key
+		}
+	}
+	// keys win over aliases.
+	for kind, entries := range catalog.entries {
+		for key := range entries {
+			catalog.tokens[kind][CatalogToken(key)] = key
+		}
+	}
+	return catalog
+}
+
+// Resolves a value to a catalog key, retired or not. Power levels may also
+// be given in kW, like "7.2kW" or "50".
+func (catalog ChargerCatalog) Resolve(kind string, value string) (ChargerCatalogEntry, bool) {
+	token := CatalogToken(value)
+	key, ok := catalog.tokens[kind][token]
+	if !ok && kind == CATALOG_KIND_POWER {
+		// the token drops the decimal point, so kW are read from the value.
+		kw_value := strings.Join(strings.Fields(strings.ToLower(value)), "")
+		match := catalog_kw_regex.FindStringSubmatch(kw_value)
+		if match == nil {
+			match = catalog_kw_regex.FindStringSubmatch(kw_value + "kw")
+		}
+		if match != nil {
+			kw, err := strconv.ParseFloat(match[1], 64)
+			if err == nil && kw > 0 {
+				key, ok = PowerTier(kw, false), true
+			}
+		}
+	}
+	if !ok {
+		return ChargerCatalogEntry{}, false
+	}
+	entry, ok := catalog.entries[kind][key]
+	return entry, ok
+}
+
+// Normalizes a charger's connector and power level against the catalog.
+// Retired entries are only accepted when current already has them.
+func (catalog ChargerCatalog) NormalizeChargerTypes(connector string, power string, current *Charger) (string, string, error) {
+	connector_entry, ok := catalog.Resolve(CATALOG_KIND_CONNECTOR, connector)
+	if !ok || (!connector_entry.IsActive && (current == nil || current.ChargerTypesId != connector_entry.Key)) {
+		return "", "", ErrUnknownConnector
+	}
+	power_entry, ok := catalog.Resolve(CATALOG_KIND_POWER, power)
+	if !ok || (!power_entry.IsActive && (current == nil || current.KWhTypesId != power_entry.Key)) {
+		return "", "", ErrUnknownPowerLevel
+	}
+	return connector_entry.Key, power_entry.Key, nil
+}
+
+// Loads the catalog and normalizes one charger's types with it.
+func NormalizeChargerTypes(connector string, power string, current *Charger) (string, string, error) {
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		return "", "", err
+	}
+	return catalog.NormalizeChargerTypes(connector, power, current)
+}
+
+// Maps search filter values onto catalog keys, keeping values it can't
+// resolve so the filter still narrows rather than widens.
+func NormalizeCatalogFilter(kind string, values []string) []string {
+	if len(values) == 0 {
+		return values
+	}
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		return values
+	}
+	normalized := []string{}
+	for _, value := range values {
+		entry, ok := catalog.Resolve(kind, value)
+		if ok {
+			value = entry.Key
+		}
+		normalized = append(normalized, value)
+	}
+	return normalized
+}
+
+// Rewrites charger types that resolve to a different catalog key, like "CCS 1"
+// to "ccs1". Values that don't resolve or are ambiguous are logged and left
+// for owners to fix.
+func MigrateChargerTypes() {
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		log.Printf("failed to migrate charger types: %s", err)
+		return
+	}
+
+	coll := mongoClient.Database("GoCharge").Collection(CHARGER_COLL)
+	fields := []struct {
+		kind  string
+		field string
+	}{
+		{CATALOG_KIND_CONNECTOR, "charger_types_id"},
+		{CATALOG_KIND_POWER, "kWh_types_id"},
+	}
+	for _, field := range fields {
+		values, err := coll.Distinct(context.TODO(), field.field, bson.D{})
+		if err != nil {
+			log.Printf("failed to migrate charger types: %s", err)
+			return
+		}
+		for _, raw := range values {
+			value, _ := raw.(string)
+			if ambiguous_catalog_tokens[field.kind][CatalogToken(value)] {
+				log.Printf("charger %s %q is ambiguous, owners need to pick one", field.kind, value)
+				continue
+			}
+			entry, ok := catalog.Resolve(field.kind, value)
+			if !ok {
+				log.Printf("charger %s %q is not in the catalog", field.kind, value)
+				continue
+			}
+			if entry.Key == value {
+				continue
+			}
+			result, err := coll.UpdateMany(
+				context.TODO(),
+				bson.D{{field.field, raw}},
+				bson.D{{"$set", bson.D{{field.field, entry.Key}}}},
+			)
+			if err != nil {
+				log.Printf("failed to migrate charger types: %s", err)
+				return
+			}
+			log.Printf("normalized %d chargers from %s %q to %q", result.ModifiedCount, field.kind, value, entry.Key)
+		}
+	}
+}
+
+// Get the active catalog, for charger forms and search filters.
+func HandleGetChargerCatalog(c *gin.Context) {
+	entries, err := GetAll[ChargerCatalogEntry](CHARGER_CATALOG_COLL, bson.D{{"is_active", true}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	output := ChargerCatalogOutput{
+		Connectors:  []ChargerCatalogEntry{},
+		PowerLevels: []ChargerCatalogEntry{},
+	}
+	for _, entry := range entries {
+		if entry.Kind == CATALOG_KIND_CONNECTOR {
+			output.Connectors = append(output.Connectors, entry)
+		} else {
+			output.PowerLevels = append(output.PowerLevels, entry)
+		}
+	}
+
+	c.JSON(http.StatusOK, output)
+}
+
+// Get the whole catalog, including retired entries.
+func HandleGetAllChargerCatalog(c *gin.Context) {
+	entries, err := GetAll[ChargerCatalogEntry](CHARGER_CATALOG_COLL, bson.D{}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+func ValidateCatalogInput(body_data ChargerCatalogInput) error {
+	if body_data.Kind != CATALOG_KIND_CONNECTOR && body_data.Kind != CATALOG_KIND_POWER {
+		return errors.New("Kind must be 'connector' or 'power'")
+	}
+	if body_data.Name == "" {
+		return errors.New("Name is required")
+	}
+	if body_data.CurrentType != CURRENT_AC && body_data.CurrentType != CURRENT_DC && body_data.CurrentType != CURRENT_AC_DC {
+		return errors.New("Current type must be 'AC', 'DC' or 'AC/DC'")
+	}
+	if body_data.MaxKW < 0 {
+		return errors.New("Max kW can't be negative")
+	}
+	return nil
+}
+
+func HandleAddChargerCatalogEntry(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[ChargerCatalogInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if !catalog_key_regex.MatchString(body_data.Key) {
+		c.JSON(http.StatusBadRequest, "Key must be 2-40 lowercase letters, digits or underscores")
+		return
+	}
+	err = ValidateCatalogInput(body_data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Aliases == nil {
+		body_data.Aliases = []string{}
+	}
+
+	entry := ChargerCatalogEntry{
+		ID:          primitive.NewObjectID(),
+		Kind:        body_data.Kind,
+		Key:         body_data.Key,
+		Name:        body_data.Name,
+		CurrentType: body_data.CurrentType,
+		MaxKW:       body_data.MaxKW,
+		Aliases:     body_data.Aliases,
+		IsActive:    true,
+		CreatedAt:   time.Now(),
+	}
+	_, err = CreateOne(CHARGER_CATALOG_COLL, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, "An entry with this key already exists")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// Rename, re-rate or retire a catalog entry. Keys never change since chargers
+// store them. Retired entries stay on chargers but can't be newly set.
+func HandleEditChargerCatalogEntry(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[ChargerCatalogInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = ValidateCatalogInput(body_data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Aliases == nil {
+		body_data.Aliases = []string{}
+	}
+
+	update := bson.D{
+		{"name", body_data.Name},
+		{"current_type", body_data.CurrentType},
+		{"max_kw", body_data.MaxKW},
+		{"aliases", body_data.Aliases},
+	}
+	if body_data.IsActive != nil {
+		update = append(update, bson.E{"is_active", *body_data.IsActive})
+	}
+
+	filter := bson.D{{"kind", body_data.Kind}, {"key", body_data.Key}}
+	err = UpdateOne(CHARGER_CATALOG_COLL, filter, bson.D{{"$set", update}})
+	// saving an entry as it is changes nothing.
+	if err != nil && err != ErrNoRecordsModified {
+		c.JSON(http.StatusNotFound, "No catalog entry with this key found")
+		return
+	}
+
+	entry, err := GetOne[ChargerCatalogEntry](CHARGER_CATALOG_COLL, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
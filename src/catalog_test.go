@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestResolvePowerInKW(t *testing.T) {
+	catalog := NewChargerCatalog(default_catalog)
+	expected := map[string]string{
+		"7.2kW":   POWER_LEVEL2,
+		"7.2 kW":  POWER_LEVEL2,
+		"7.2":     POWER_LEVEL2,
+		"3.7":     POWER_LEVEL2,
+		"1.4 kw":  POWER_LEVEL1,
+		"50":      POWER_DCFC,
+		"50kW":    POWER_DCFC,
+		"Level 2": POWER_LEVEL2,
+	}
+	for value, key := range expected {
+		entry, ok := catalog.Resolve(CATALOG_KIND_POWER, value)
+		if !ok || entry.Key != key {
+			t.Errorf("%q resolved to %q, expected %q", value, entry.Key, key)
+		}
+	}
+
+	for _, value := range []string{"0", "fast-ish", "7..2"} {
+		if entry, ok := catalog.Resolve(CATALOG_KIND_POWER, value); ok {
+			t.Errorf("%q resolved to %q", value, entry.Key)
+		}
+	}
+}
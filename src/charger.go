@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -23,13 +25,20 @@ func HandleAddCharger(c *gin.Context) {
 		return
 	}
 
-	// ensure owner is authorized.
-	_, err = GetStation(bson.D{
-		{"_id", body_data.StationID},
-		{"owner_id", user_id},
-	})
+	// ensure user may work on the station's chargers.
+	station, err := AuthorizeStation(user_id, body_data.StationID, PERM_EDIT_CHARGERS)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, "Owner does not own a station of this id")
+		RespondStationAuthError(c, err)
+		return
+	}
+	if station.IsArchived {
+		c.JSON(http.StatusConflict, "Station is archived")
+		return
+	}
+
+	connector, power, err := NormalizeChargerTypes(body_data.ChargerTypesId, body_data.KWhTypesId, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -39,15 +48,15 @@ func HandleAddCharger(c *gin.Context) {
 		StationID:      body_data.StationID,
 		Name:           body_data.Name,
 		Description:    body_data.Description,
-		KWhTypesId:     body_data.KWhTypesId,
-		ChargerTypesId: body_data.ChargerTypesId,
-		Status:         "working",
+		KWhTypesId:     power,
+		ChargerTypesId: connector,
+		Status:         CHARGER_AVAILABLE,
 		Price:          body_data.Price,
 		TotalPayments:  0,
 	}
 	charger_id, err := CreateCharger(new_charger)
 	if mongo.IsDuplicateKeyError(err) {
-		c.JSON(http.StatusConflict, "A station with this location already exists")
+		c.JSON(http.StatusConflict, "A charger with this name already exists at this station")
 		return
 	}
 	if err != nil {
@@ -79,34 +88,62 @@ func HandleEditCharger(c *gin.Context) {
 		return
 	}
 
-	// ensure owner is authorized.
-	_, err = GetStation(bson.D{
-		{"_id", body_data.StationID},
-		{"owner_id", user_id},
+	// ensure user may work on the station's chargers.
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	current_charger, err := GetCharger(bson.D{
+		{"_id", body_data.ID},
+		{"station_id", body_data.StationID},
 	})
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, "Owner does not own a station of this id")
+		c.JSON(http.StatusNotFound, "No such charger found")
 		return
 	}
+	if current_charger.IsDecommissioned {
+		c.JSON(http.StatusConflict, "Charger is decommissioned")
+		return
+	}
+	connector, power, err := NormalizeChargerTypes(body_data.ChargerTypesId, body_data.KWhTypesId, &current_charger)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Status != "" {
+		_, err = SetChargerStatusByOwner(current_charger, body_data.Status, user_id)
+		if err == ErrInvalidTransition {
+			c.JSON(http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
 	// edit charger
 	err = UpdateOne(
 		CHARGER_COLL,
 		bson.D{
 			{"_id", body_data.ID},
+			{"station_id", body_data.StationID},
 		},
 		bson.D{
 			{"$set", bson.D{
 				{"name", body_data.Name},
 				{"description", body_data.Description},
-				{"kWh_types_id", body_data.KWhTypesId},
-				{"charger_types_id", body_data.ChargerTypesId},
+				{"kWh_types_id", power},
+				{"charger_types_id", connector},
 				{"price", body_data.Price},
-				{"status", body_data.Status},
 			}},
+			{"$unset", bson.D{{"price_unknown", ""}}},
 		},
 	)
-	if err != nil {
+	// a status-only edit leaves the other fields as they were.
+	if err != nil && err != ErrNoRecordsModified {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -120,3 +157,135 @@ func HandleEditCharger(c *gin.Context) {
 
 	c.JSON(http.StatusOK, charger)
 }
+
+// Take a charger out of service for good. It stays on record for its
+// sessions and stats, but drivers no longer see it and its name is free for
+// a replacement.
+func HandleDecommissionCharger(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+	if charger.IsDecommissioned {
+		c.JSON(http.StatusConflict, "Charger is already decommissioned")
+		return
+	}
+
+	charger, err = SetChargerStatusByOwner(charger, CHARGER_DECOMMISSIONED, user_id)
+	if err == ErrInvalidTransition {
+		c.JSON(http.StatusConflict, "Charger must be available, out of order or in maintenance to be decommissioned")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, charger)
+}
+
+// Remove a charger entirely. Only chargers that never had a session can go,
+// so session history always points at a charger.
+func HandleDeleteCharger(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	// the charger is flagged first, since archived chargers can't be taken,
+	// and then checked, so a session can't start in between.
+	coll := mongoClient.Database("GoCharge").Collection(CHARGER_COLL)
+	not_in_use := bson.D{
+		{"_id", charger.ID},
+		{"status", bson.D{{"$ne", CHARGER_IN_USE}}},
+	}
+	result, err := coll.UpdateOne(context.TODO(), not_in_use, bson.D{{"$set", bson.D{{"is_archived", true}}}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, "Charger is in use")
+		return
+	}
+	restore := func() {
+		err := UpdateOne(CHARGER_COLL, bson.D{{"_id", charger.ID}}, bson.D{{"$set", bson.D{{"is_archived", charger.IsArchived}}}})
+		if err != nil && err != ErrNoRecordsModified {
+			log.Printf("Error restoring charger %s: %v", charger.ID.Hex(), err)
+		}
+	}
+
+	_, err = GetOne[Session](SESSION_COLL, bson.D{{"charger_id", charger.ID}})
+	if err == nil {
+		restore()
+		c.JSON(http.StatusConflict, "Charger has sessions, decommission it instead")
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		restore()
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	deleted, err := coll.DeleteOne(context.TODO(), not_in_use)
+	if err != nil {
+		restore()
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if deleted.DeletedCount == 0 {
+		restore()
+		c.JSON(http.StatusConflict, "Charger is in use")
+		return
+	}
+	err = DeleteMany(CHARGER_STATUS_HISTORY_COLL, bson.D{{"charger_id", charger.ID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	charge_point := GetChargePoint(charger.ID)
+	if charge_point != nil {
+		charge_point.Close()
+	}
+
+	c.JSON(http.StatusOK, "")
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
@@ -20,6 +21,19 @@ const STATION_COLL = "Stations"
 const USER_COLL = "Users"
 const CHARGER_COLL = "Chargers"
 const REVIEW_COLL = "Reviews"
+const GEOCODE_CACHE_COLL = "GeocodeCache"
+const STATION_REVISION_COLL = "StationRevisions"
+const STATION_GRANT_COLL = "StationGrants"
+const AMENITY_COLL = "Amenities"
+const CHARGER_DAILY_STATS_COLL = "ChargerDailyStats"
+const STATION_GUEST_COLL = "StationGuests"
+const CHARGER_STATUS_HISTORY_COLL = "ChargerStatusHistory"
+const COUNTER_COLL = "Counters"
+const CHARGER_CATALOG_COLL = "ChargerCatalog"
+const MAINTENANCE_WINDOW_COLL = "MaintenanceWindows"
+const FAULT_REPORT_COLL = "FaultReports"
+const SESSION_METER_COLL = "SessionMeterValues"
+const OCPP_ID_TAG_COLL = "OCPPIdTags"
 
 // STATION WRAPPER FUNCTIONS
 
@@ -37,8 +51,21 @@ func GetStations(filter bson.D, max_results int64) ([]Station, error) {
 
 // STATION WRAPPER FUNCTIONS
 
+// Inserts a charger with a fresh short code, retrying on the rare code
+// collision.
 func CreateCharger(new_charger Charger) (primitive.ObjectID, error) {
-	return CreateOne(CHARGER_COLL, new_charger)
+	for attempt := 0; ; attempt++ {
+		code, err := GenShortCode()
+		if err != nil {
+			return primitive.ObjectID{}, err
+		}
+		new_charger.ShortCode = code
+		charger_id, err := CreateOne(CHARGER_COLL, new_charger)
+		if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "short_code") && attempt < SHORT_CODE_ATTEMPTS {
+			continue
+		}
+		return charger_id, err
+	}
 }
 
 func GetCharger(filter bson.D) (Charger, error) {
@@ -98,6 +125,26 @@ func CreateOne(collection string, document interface{}) (primitive.ObjectID, err
 	return result.InsertedID.(primitive.ObjectID), nil
 }
 
+// Increments and returns a named counter, starting at 1.
+func NextSequence(name string) (int64, error) {
+	var counter struct {
+		Value int64 `bson:"value"`
+	}
+	err := mongoClient.
+		Database("GoCharge").
+		Collection(COUNTER_COLL).
+		FindOneAndUpdate(
+			context.TODO(),
+			bson.D{{"_id", name}},
+			bson.D{{"$inc", bson.D{{"value", 1}}}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).
+		Decode(&counter)
+	return counter.Value, err
+}
+
+var ErrNoRecordsModified = errors.New("No records modified")
+
 func UpdateOne(collection string, filter interface{}, update interface{}) error {
 	res, err := mongoClient.
 		Database("GoCharge").
@@ -110,11 +157,20 @@ func UpdateOne(collection string, filter interface{}, update interface{}) error
 		return errors.New("No record found to update")
 	}
 	if res.ModifiedCount == 0 {
-		return errors.New("No records modified")
+		return ErrNoRecordsModified
 	}
 	return err
 }
 
+// like UpdateOne, but matching no documents is not an error.
+func UpdateMany(collection string, filter interface{}, update interface{}) error {
+	_, err := mongoClient.
+		Database("GoCharge").
+		Collection(collection).
+		UpdateMany(context.TODO(), filter, update)
+	return err
+}
+
 func Aggregate[T interface{}](collection string, pipeline bson.A) ([]T, error) {
 	results := []T{}
 
@@ -138,6 +194,14 @@ func DeleteOne(collection string, filter interface{}) error {
 	return err
 }
 
+func DeleteMany(collection string, filter interface{}) error {
+	_, err := mongoClient.
+		Database("GoCharge").
+		Collection(collection).
+		DeleteMany(context.TODO(), filter)
+	return err
+}
+
 func InitIndices() {
 	userIndexes := mongoClient.Database("GoCharge").
 		Collection(USER_COLL).
@@ -154,13 +218,39 @@ func InitIndices() {
 	stationIndexes := mongoClient.Database("GoCharge").
 		Collection(STATION_COLL).
 		Indexes()
+	// the coordinates index used to be unique, which blocked co-located
+	// stations. duplicates are now flagged by FindPossibleDuplicates instead.
+	station_index_specs, err := stationIndexes.ListSpecifications(context.TODO())
+	if err == nil {
+		for _, spec := range station_index_specs {
+			if spec.Name == "coordinates_2dsphere" && spec.Unique != nil && *spec.Unique {
+				stationIndexes.DropOne(context.TODO(), spec.Name)
+			}
+		}
+	}
 	stationIndexes.CreateOne(context.TODO(), mongo.IndexModel{
-		Keys:    bson.D{{"coordinates", "2dsphere"}},
-		Options: options.Index().SetUnique(true),
+		Keys: bson.D{{"coordinates", "2dsphere"}},
 	})
 	stationIndexes.CreateOne(context.TODO(), mongo.IndexModel{
 		Keys: bson.D{{"owner_id", 1}},
 	})
+	stationIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"name", "text"}, {"address", "text"}, {"description", "text"}},
+		Options: options.Index().SetWeights(bson.D{
+			{"name", 10},
+			{"address", 5},
+			{"description", 1},
+		}),
+	})
+	stationIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"search_tokens", 1}},
+	})
+	stationIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"external_source", 1}, {"external_id", 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"external_id", bson.D{{"$exists", true}}}}),
+	})
 
 	chargerIndexes := mongoClient.Database("GoCharge").
 		Collection(CHARGER_COLL).
@@ -168,9 +258,27 @@ func InitIndices() {
 	chargerIndexes.CreateOne(context.TODO(), mongo.IndexModel{
 		Keys: bson.D{{"station_id", 1}},
 	})
+	// names only need to be unique among chargers in service, so a
+	// replacement can take over a decommissioned charger's name.
+	chargerIndexes.DropOne(context.TODO(), "station_id_1_name_1")
 	chargerIndexes.CreateOne(context.TODO(), mongo.IndexModel{
-		Keys:    bson.D{{"station_id", 1}, {"name", 1}},
-		Options: options.Index().SetUnique(true),
+		Keys: bson.D{{"station_id", 1}, {"name", 1}},
+		Options: options.Index().
+			SetName("station_id_1_name_1_in_service").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"is_decommissioned", false}}),
+	})
+	chargerIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"short_code", 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"short_code", bson.D{{"$type", "string"}}}}),
+	})
+	chargerIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"external_id", 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"external_id", bson.D{{"$exists", true}}}}),
 	})
 
 	sessionIndexes := mongoClient.Database("GoCharge").
@@ -185,6 +293,142 @@ func InitIndices() {
 	sessionIndexes.CreateOne(context.TODO(), mongo.IndexModel{
 		Keys: bson.D{{"end_timestamp", 1}},
 	})
+	sessionIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"start_timestamp", 1}},
+	})
+
+	revisionIndexes := mongoClient.Database("GoCharge").
+		Collection(STATION_REVISION_COLL).
+		Indexes()
+	revisionIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"status", 1}},
+	})
+	revisionIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"status", 1}, {"created_at", 1}},
+	})
+
+	geocodeCacheIndexes := mongoClient.Database("GoCharge").
+		Collection(GEOCODE_CACHE_COLL).
+		Indexes()
+	geocodeCacheIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"kind", 1}, {"key", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	geocodeCacheIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"created_at", 1}},
+		Options: options.Index().SetExpireAfterSeconds(30 * 24 * 60 * 60), // re-geocode monthly
+	})
+
+	grantIndexes := mongoClient.Database("GoCharge").
+		Collection(STATION_GRANT_COLL).
+		Indexes()
+	grantIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"token", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	grantIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"user_id", 1}, {"status", 1}},
+	})
+	grantIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"user_id", 1}, {"status", 1}},
+	})
+
+	amenityIndexes := mongoClient.Database("GoCharge").
+		Collection(AMENITY_COLL).
+		Indexes()
+	amenityIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"key", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	catalogIndexes := mongoClient.Database("GoCharge").
+		Collection(CHARGER_CATALOG_COLL).
+		Indexes()
+	catalogIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"kind", 1}, {"key", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	dailyStatsIndexes := mongoClient.Database("GoCharge").
+		Collection(CHARGER_DAILY_STATS_COLL).
+		Indexes()
+	dailyStatsIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"charger_id", 1}, {"day", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	dailyStatsIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"day", 1}},
+	})
+	dailyStatsIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"day", -1}},
+	})
+
+	guestIndexes := mongoClient.Database("GoCharge").
+		Collection(STATION_GUEST_COLL).
+		Indexes()
+	guestIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"station_id", 1}, {"user_id", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	guestIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"user_id", 1}, {"status", 1}},
+	})
+
+	statusHistoryIndexes := mongoClient.Database("GoCharge").
+		Collection(CHARGER_STATUS_HISTORY_COLL).
+		Indexes()
+	statusHistoryIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"charger_id", 1}, {"changed_at", -1}},
+	})
+
+	maintenanceIndexes := mongoClient.Database("GoCharge").
+		Collection(MAINTENANCE_WINDOW_COLL).
+		Indexes()
+	maintenanceIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"charger_id", 1}, {"status", 1}, {"starts_at", 1}},
+	})
+	maintenanceIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"status", 1}, {"starts_at", 1}},
+	})
+	maintenanceIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"starts_at", 1}},
+	})
+
+	faultIndexes := mongoClient.Database("GoCharge").
+		Collection(FAULT_REPORT_COLL).
+		Indexes()
+	faultIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"charger_id", 1}, {"status", 1}, {"created_at", -1}},
+	})
+	faultIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"station_id", 1}, {"created_at", -1}},
+	})
+	faultIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"user_id", 1}, {"created_at", -1}},
+	})
+
+	CreateMeterValueCollection()
+	meterIndexes := mongoClient.Database("GoCharge").
+		Collection(SESSION_METER_COLL).
+		Indexes()
+	meterIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"meta.session_id", 1}, {"recorded_at", 1}},
+	})
+
+	idTagIndexes := mongoClient.Database("GoCharge").
+		Collection(OCPP_ID_TAG_COLL).
+		Indexes()
+	idTagIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"tag", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	// one tag in use per user.
+	idTagIndexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"user_id", 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{"is_revoked", false}}),
+	})
 }
 
 func InitMongoDb() {
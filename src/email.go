@@ -21,9 +21,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"strings"
 
@@ -137,7 +140,28 @@ func FormMessageBody(name string, otp string, action string, title string) strin
 	return final_msg
 }
 
+// A plain notice, for emails that don't carry a code.
+func FormNoticeBody(name string, message string) string {
+	return "<p>Hello " + html.EscapeString(name) + "!</p><p>" + html.EscapeString(message) + "</p>"
+}
+
+// Checks a single bare email address, so it can't smuggle extra headers into
+// a message.
+func ParseEmailAddress(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != strings.TrimSpace(email) {
+		return "", errors.New("Invalid email address")
+	}
+	return address.Address, nil
+}
+
 func SendEmail(to_email string, msg_body string, msg_subject string) error {
+	to_email, err := ParseEmailAddress(to_email)
+	if err != nil {
+		return err
+	}
+	msg_subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg_subject)
+
 	from := "From: " + "gocharge.group@gmail.com" + "\r\n"
 	to := "To: " + to_email + "\r\n"
 	subject := "Subject: " + msg_subject + "\r\n"
@@ -152,6 +176,6 @@ func SendEmail(to_email string, msg_body string, msg_subject string) error {
 		Raw: base64.URLEncoding.EncodeToString([]byte(msg)),
 	}
 
-	_, err := gmail_service.Users.Messages.Send("me", &message).Do()
+	_, err = gmail_service.Users.Messages.Send("me", &message).Do()
 	return err
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const FAULT_NO_POWER = "no_power"
+const FAULT_DAMAGED_CABLE = "damaged_cable"
+const FAULT_BLOCKED_BAY = "blocked_bay"
+const FAULT_PAYMENT_FAILURE = "payment_failure"
+
+// a blocked bay says nothing about the charger itself, so it never counts
+// towards marking one out of order.
+var fault_categories = map[string]bool{
+	FAULT_NO_POWER:        true,
+	FAULT_DAMAGED_CABLE:   true,
+	FAULT_BLOCKED_BAY:     false,
+	FAULT_PAYMENT_FAILURE: true,
+}
+
+const FAULT_OPEN = "open"
+const FAULT_ACKNOWLEDGED = "acknowledged"
+const FAULT_IN_PROGRESS = "in_progress"
+const FAULT_RESOLVED = "resolved"
+
+// the triage states a report can move to from each state. resolved is final.
+var fault_transitions = map[string][]string{
+	FAULT_OPEN:         {FAULT_ACKNOWLEDGED, FAULT_IN_PROGRESS, FAULT_RESOLVED},
+	FAULT_ACKNOWLEDGED: {FAULT_IN_PROGRESS, FAULT_RESOLVED},
+	FAULT_IN_PROGRESS:  {FAULT_RESOLVED},
+	FAULT_RESOLVED:     {},
+}
+
+const MAX_FAULT_DESCRIPTION = 1000
+const MAX_FAULT_PHOTOS = 5
+const MAX_FAULT_REPORTS = 200
+
+const DEFAULT_FAULT_REPORT_THRESHOLD = 3
+const DEFAULT_FAULT_REPORT_WINDOW_HOURS = 24
+const DEFAULT_FAULT_REPORTER_SESSION_DAYS = 7
+
+// distinct drivers reporting a charger within the window that take it out of
+// order. only drivers who started a session at the station within the
+// reporter session period count, so any few accounts can't take it down.
+var fault_report_threshold int64 = DEFAULT_FAULT_REPORT_THRESHOLD
+var fault_report_window = time.Duration(DEFAULT_FAULT_REPORT_WINDOW_HOURS) * time.Hour
+var fault_reporter_session_period = time.Duration(DEFAULT_FAULT_REPORTER_SESSION_DAYS) * 24 * time.Hour
+
+func InitFaultConfig() {
+	fault_report_threshold = ReadEnvInt64("FAULT_REPORT_THRESHOLD", DEFAULT_FAULT_REPORT_THRESHOLD)
+	fault_report_window = time.Duration(ReadEnvInt64("FAULT_REPORT_WINDOW_HOURS", DEFAULT_FAULT_REPORT_WINDOW_HOURS)) * time.Hour
+	fault_reporter_session_period = time.Duration(ReadEnvInt64("FAULT_REPORTER_SESSION_DAYS", DEFAULT_FAULT_REPORTER_SESSION_DAYS)) * 24 * time.Hour
+}
+
+// Checks whether the driver started a session on any charger of the station
+// within the reporter session period.
+func HasRecentStationSession(user_id primitive.ObjectID, station_id primitive.ObjectID) (bool, error) {
+	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{{"station_id", station_id}}, 0)
+	if err != nil {
+		return false, err
+	}
+	charger_ids := []primitive.ObjectID{}
+	for _, charger := range chargers {
+		charger_ids = append(charger_ids, charger.ID)
+	}
+
+	_, err = GetOne[Session](SESSION_COLL, bson.D{
+		{"user_id", user_id},
+		{"charger_id", bson.D{{"$in", charger_ids}}},
+		{"start_timestamp", bson.D{{"$gte", time.Now().Add(-fault_reporter_session_period).Unix()}}},
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func ValidateFaultReport(body_data FaultReportInput) error {
+	if _, ok := fault_categories[body_data.Category]; !ok {
+		return errors.New("Category must be 'no_power', 'damaged_cable', 'blocked_bay' or 'payment_failure'")
+	}
+	if len(body_data.Description) > MAX_FAULT_DESCRIPTION {
+		return errors.New("Description can be at most 1000 characters")
+	}
+	if len(body_data.PhotoURLs) > MAX_FAULT_PHOTOS {
+		return errors.New("At most 5 photos can be attached")
+	}
+	for _, photo_url := range body_data.PhotoURLs {
+		parsed, err := url.Parse(photo_url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("Photos must be http(s) URLs")
+		}
+	}
+	return nil
+}
+
+// Marks the charger out of order once enough drivers who charged at the
+// station reported it broken recently, and tells the station owner.
+// Chargers in use are left alone, since someone is charging on them.
+func CheckFaultThreshold(charger Charger) error {
+	broken := []string{}
+	for category, counts := range fault_categories {
+		if counts {
+			broken = append(broken, category)
+		}
+	}
+	reporters, err := mongoClient.Database("GoCharge").Collection(FAULT_REPORT_COLL).Distinct(
+		context.TODO(),
+		"user_id",
+		bson.D{
+			{"charger_id", charger.ID},
+			{"has_session", true},
+			{"category", bson.D{{"$in", broken}}},
+			{"status", bson.D{{"$ne", FAULT_RESOLVED}}},
+			{"created_at", bson.D{{"$gte", time.Now().Add(-fault_report_window)}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if int64(len(reporters)) < fault_report_threshold {
+		return nil
+	}
+
+	_, err = TransitionChargerStatus(charger.ID, []string{CHARGER_AVAILABLE, CHARGER_RESERVED, CHARGER_MAINTENANCE}, CHARGER_OUT_OF_ORDER, STATUS_REASON_FAULT_REPORTS, nil)
+	if err == ErrInvalidTransition {
+		return nil // already out of order, or in use.
+	}
+	if err != nil {
+		return err
+	}
+
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		return err
+	}
+	owner, err := GetUser(bson.D{{"_id", station.OwnerID}})
+	if err != nil {
+		return err
+	}
+	subject := "Charger out of order at " + station.Name
+	message := fmt.Sprintf("Charger %s at %s was marked out of order after %d drivers reported a fault with it. Check your fault report inbox for details.",
+		charger.Name, station.Name, len(reporters))
+	return SendEmail(owner.Email, FormNoticeBody(owner.Username, message), subject)
+}
+
+// Report a problem with a charger.
+func HandleReportFault(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[FaultReportInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = ValidateFaultReport(body_data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{
+		{"_id", body_data.ChargerID},
+		{"is_archived", bson.D{{"$ne", true}}},
+		{"is_decommissioned", bson.D{{"$ne", true}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	can_access, err := CanAccessStation(station, user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !can_access {
+		c.JSON(http.StatusForbidden, "This charger is only available to approved guests")
+		return
+	}
+
+	// one open report per driver and charger, so a single driver can't take
+	// a charger down.
+	_, err = GetOne[FaultReport](FAULT_REPORT_COLL, bson.D{
+		{"charger_id", charger.ID},
+		{"user_id", user_id},
+		{"status", bson.D{{"$ne", FAULT_RESOLVED}}},
+	})
+	if err == nil {
+		c.JSON(http.StatusConflict, "You already reported a fault with this charger")
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	has_session, err := HasRecentStationSession(user_id, charger.StationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if body_data.PhotoURLs == nil {
+		body_data.PhotoURLs = []string{}
+	}
+	now := time.Now()
+	report := FaultReport{
+		ID:          primitive.NewObjectID(),
+		ChargerID:   charger.ID,
+		StationID:   charger.StationID,
+		UserID:      user_id,
+		Category:    body_data.Category,
+		Description: body_data.Description,
+		PhotoURLs:   body_data.PhotoURLs,
+		Status:      FAULT_OPEN,
+		HasSession:  has_session,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	_, err = CreateOne(FAULT_REPORT_COLL, report)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the report stands even if the follow up fails.
+	err = CheckFaultThreshold(charger)
+	if err != nil {
+		log.Printf("failed to check fault reports of charger %s: %s", charger.ID.Hex(), err)
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// Get the caller's fault reports, newest first.
+func HandleGetMyFaultReports(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	reports, err := Aggregate[FaultReport](FAULT_REPORT_COLL, bson.A{
+		bson.D{{"$match", bson.D{{"user_id", user_id}}}},
+		bson.D{{"$sort", bson.D{{"created_at", -1}}}},
+		bson.D{{"$limit", MAX_FAULT_REPORTS}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, reports)
+}
+
+// Get a station's fault reports for triage, unresolved ones first and
+// newest first within each state.
+func HandleGetFaultReports(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[FaultReportsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	match := bson.D{{"station_id", body_data.StationID}}
+	if len(body_data.Statuses) > 0 {
+		match = append(match, bson.E{"status", bson.D{{"$in", body_data.Statuses}}})
+	}
+	reports, err := Aggregate[FaultReport](FAULT_REPORT_COLL, bson.A{
+		bson.D{{"$match", match}},
+		bson.D{{"$addFields", bson.D{
+			{"is_resolved", bson.D{{"$eq", bson.A{"$status", FAULT_RESOLVED}}}},
+		}}},
+		bson.D{{"$sort", bson.D{{"is_resolved", 1}, {"created_at", -1}}}},
+		bson.D{{"$limit", MAX_FAULT_REPORTS}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, reports)
+}
+
+// Move a fault report along in triage.
+func HandleUpdateFaultReport(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[UpdateFaultReportInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := GetOne[FaultReport](FAULT_REPORT_COLL, bson.D{{"_id", body_data.ReportID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such fault report found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, report.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	is_allowed := false
+	for _, status := range fault_transitions[report.Status] {
+		is_allowed = is_allowed || status == body_data.Status
+	}
+	if !is_allowed {
+		c.JSON(http.StatusConflict, "Fault report can't move to this state from its current one")
+		return
+	}
+
+	now := time.Now()
+	update := bson.D{
+		{"status", body_data.Status},
+		{"owner_note", body_data.OwnerNote},
+		{"updated_at", now},
+		{"updated_by", user_id},
+	}
+	if body_data.Status == FAULT_RESOLVED {
+		update = append(update, bson.E{"resolved_at", now})
+	}
+	// the state in the filter keeps two triagers from both moving it.
+	err = UpdateOne(
+		FAULT_REPORT_COLL,
+		bson.D{
+			{"_id", report.ID},
+			{"status", report.Status},
+		},
+		bson.D{{"$set", update}},
+	)
+	if err != nil {
+		c.JSON(http.StatusConflict, "Fault report changed in the meantime")
+		return
+	}
+
+	report, err = GetOne[FaultReport](FAULT_REPORT_COLL, bson.D{{"_id", report.ID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
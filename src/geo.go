@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const EARTH_RADIUS_METERS = 6371008.8
+
+// 2dsphere polygons have geodesic edges, so wide boxes are split into slices
+// and their east-west edges densified to follow the parallels.
+const MAX_BOX_SLICE_DEGREES = 90.0
+const BOX_EDGE_STEP_DEGREES = 1.0
+
+// polar latitudes are clamped, since a box edge along a pole is degenerate.
+const MAX_BOX_LATITUDE = 85.0
+
+// Builds a $geoWithin filter on coordinates matching everything inside a
+// [[west, south], [east, north]] box. A box with west > east crosses the
+// antimeridian.
+func BoundingBoxFilter(bounds [2][2]float64) bson.D {
+	west, south := bounds[0][0], bounds[0][1]
+	east, north := bounds[1][0], bounds[1][1]
+	south = max(south, -MAX_BOX_LATITUDE)
+	north = min(north, MAX_BOX_LATITUDE)
+
+	lng_ranges := [][2]float64{{west, east}}
+	if west > east {
+		lng_ranges = [][2]float64{{west, 180}, {-180, east}}
+	}
+
+	slices := bson.A{}
+	for _, lng_range := range lng_ranges {
+		slice_count := int(math.Max(1, math.Ceil((lng_range[1]-lng_range[0])/MAX_BOX_SLICE_DEGREES)))
+		slice_width := (lng_range[1] - lng_range[0]) / float64(slice_count)
+		for i := 0; i < slice_count; i++ {
+			slice_west := lng_range[0] + slice_width*float64(i)
+			slice_east := slice_west + slice_width
+			slices = append(slices, bson.D{
+				{"coordinates", bson.D{
+					{"$geoWithin", bson.D{
+						{"$geometry", bson.D{
+							{"type", "Polygon"},
+							{"coordinates", bson.A{BoxRing(slice_west, south, slice_east, north)}},
+						}},
+					}},
+				}},
+			})
+		}
+	}
+
+	if len(slices) == 1 {
+		return slices[0].(bson.D)
+	}
+	return bson.D{{"$or", slices}}
+}
+
+// closed, counter-clockwise ring around a box.
+func BoxRing(west float64, south float64, east float64, north float64) [][2]float64 {
+	steps := int(math.Max(1, math.Ceil((east-west)/BOX_EDGE_STEP_DEGREES)))
+	step := (east - west) / float64(steps)
+
+	ring := [][2]float64{}
+	for i := 0; i <= steps; i++ {
+		ring = append(ring, [2]float64{west + step*float64(i), south})
+	}
+	for i := steps; i >= 0; i-- {
+		ring = append(ring, [2]float64{west + step*float64(i), north})
+	}
+	return append(ring, ring[0])
+}
+
+// great-circle distance in meters between two [lng, lat] points.
+func HaversineDistance(a [2]float64, b [2]float64) float64 {
+	lat1 := a[1] * math.Pi / 180
+	lat2 := b[1] * math.Pi / 180
+	d_lat := lat2 - lat1
+	d_lng := (b[0] - a[0]) * math.Pi / 180
+
+	h := math.Pow(math.Sin(d_lat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(d_lng/2), 2)
+	return 2 * EARTH_RADIUS_METERS * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Decodes a Google encoded polyline (precision 5) into [lng, lat] points.
+func DecodePolyline(encoded string) ([][2]float64, error) {
+	points := [][2]float64{}
+	lat, lng := 0, 0
+
+	for i := 0; i < len(encoded); {
+		deltas := [2]int{}
+		for j := range deltas {
+			result, shift := 0, 0
+			for {
+				if i >= len(encoded) {
+					return nil, errors.New("truncated polyline")
+				}
+				b := int(encoded[i]) - 63
+				i++
+				if b < 0 || b > 63 {
+					return nil, errors.New("invalid polyline character")
+				}
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				deltas[j] = ^(result >> 1)
+			} else {
+				deltas[j] = result >> 1
+			}
+		}
+		lat += deltas[0]
+		lng += deltas[1]
+		points = append(points, [2]float64{float64(lng) / 1e5, float64(lat) / 1e5})
+	}
+
+	return points, nil
+}
+
+// Projects a [lng, lat] point to meters on a plane tangent at origin. Good
+// enough for the few kilometers a route corridor spans around a point.
+func ProjectMeters(point [2]float64, origin [2]float64) [2]float64 {
+	lat_rad := origin[1] * math.Pi / 180
+	return [2]float64{
+		(point[0] - origin[0]) * math.Pi / 180 * EARTH_RADIUS_METERS * math.Cos(lat_rad),
+		(point[1] - origin[1]) * math.Pi / 180 * EARTH_RADIUS_METERS,
+	}
+}
+
+// distance in meters from p to the segment a-b, and how far along the segment
+// (0 to 1) the closest point lies.
+func PointSegmentDistance(p [2]float64, a [2]float64, b [2]float64) (float64, float64) {
+	pa := ProjectMeters(a, p)
+	pb := ProjectMeters(b, p)
+	d := [2]float64{pb[0] - pa[0], pb[1] - pa[1]}
+
+	t := 0.0
+	length_sq := d[0]*d[0] + d[1]*d[1]
+	if length_sq > 0 {
+		t = math.Max(0, math.Min(1, -(pa[0]*d[0]+pa[1]*d[1])/length_sq))
+	}
+	closest := [2]float64{pa[0] + t*d[0], pa[1] + t*d[1]}
+	return math.Hypot(closest[0], closest[1]), t
+}
+
+// Douglas-Peucker simplification with a tolerance in meters. The first and
+// last points are always kept.
+func SimplifyPolyline(points [][2]float64, tolerance float64) [][2]float64 {
+	if len(points) < 3 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		max_distance, max_index := 0.0, -1
+		for i := span[0] + 1; i < span[1]; i++ {
+			distance, _ := PointSegmentDistance(points[i], points[span[0]], points[span[1]])
+			if distance > max_distance {
+				max_distance, max_index = distance, i
+			}
+		}
+		if max_index != -1 && max_distance > tolerance {
+			keep[max_index] = true
+			stack = append(stack, [2]int{span[0], max_index}, [2]int{max_index, span[1]})
+		}
+	}
+
+	simplified := [][2]float64{}
+	for i, point := range points {
+		if keep[i] {
+			simplified = append(simplified, point)
+		}
+	}
+	return simplified
+}
+
+// [[west, south], [east, north]] box around points, grown by margin meters.
+func ExpandedBounds(points [][2]float64, margin float64) [2][2]float64 {
+	bounds := [2][2]float64{points[0], points[0]}
+	for _, point := range points[1:] {
+		bounds[0][0] = min(bounds[0][0], point[0])
+		bounds[0][1] = min(bounds[0][1], point[1])
+		bounds[1][0] = max(bounds[1][0], point[0])
+		bounds[1][1] = max(bounds[1][1], point[1])
+	}
+
+	lat_margin := margin / EARTH_RADIUS_METERS * 180 / math.Pi
+	widest_lat := max(math.Abs(bounds[0][1]), math.Abs(bounds[1][1])) + lat_margin
+	lng_margin := lat_margin / math.Max(math.Cos(math.Min(widest_lat, MAX_BOX_LATITUDE)*math.Pi/180), 0.01)
+
+	bounds[0][0] = max(bounds[0][0]-lng_margin, -180)
+	bounds[0][1] = bounds[0][1] - lat_margin
+	bounds[1][0] = min(bounds[1][0]+lng_margin, 180)
+	bounds[1][1] = bounds[1][1] + lat_margin
+	return bounds
+}
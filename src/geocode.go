@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type GeocodeResult struct {
+	Address     string     `json:"address" bson:"address"`
+	Coordinates [2]float64 `json:"coordinates" bson:"coordinates"` // [lng, lat]
+}
+
+type Geocoder interface {
+	Geocode(address string) (GeocodeResult, error)
+	ReverseGeocode(coordinates [2]float64) (GeocodeResult, error)
+}
+
+var ErrGeocodeNotFound = errors.New("no geocoding result found")
+
+// nil when geocoding is turned off, in which case station locations are taken
+// as the owner typed them.
+var geocoder Geocoder
+
+const DEFAULT_GEOCODER_FILE = "../geocode_fixtures.json"
+const DEFAULT_GEOCODE_MISMATCH_METERS = 500
+
+// an address and coordinates further apart than this are flagged for admins.
+// configurable through GEOCODE_MISMATCH_METERS.
+var geocode_mismatch_meters float64 = DEFAULT_GEOCODE_MISMATCH_METERS
+
+// Picks a geocoder through GEOCODER: "file" reads GEOCODER_FILE, "http" calls
+// the Nominatim-compatible API at GEOCODER_URL. Results are cached in Mongo.
+func InitGeocoder() {
+	geocode_mismatch_meters = float64(ReadEnvInt64("GEOCODE_MISMATCH_METERS", DEFAULT_GEOCODE_MISMATCH_METERS))
+
+	var provider Geocoder
+	switch os.Getenv("GEOCODER") {
+	case "":
+		return
+	case "file":
+		path := os.Getenv("GEOCODER_FILE")
+		if path == "" {
+			path = DEFAULT_GEOCODER_FILE
+		}
+		file_geocoder, err := NewFileGeocoder(path)
+		if err != nil {
+			log.Fatalf("Unable to load geocoder file: %v", err)
+		}
+		provider = file_geocoder
+	case "http":
+		base_url := os.Getenv("GEOCODER_URL")
+		if base_url == "" {
+			log.Fatal("Set your 'GEOCODER_URL' environment variable. ")
+		}
+		provider = NewHTTPGeocoder(base_url, os.Getenv("GEOCODER_API_KEY"))
+	default:
+		log.Fatalf("Unknown GEOCODER %q, expected 'file' or 'http'", os.Getenv("GEOCODER"))
+	}
+
+	geocoder = CachedGeocoder{provider}
+}
+
+// FILE GEOCODER
+
+// reverse lookups further than this from every known address find nothing.
+const FILE_GEOCODER_MAX_REVERSE_METERS = 1000
+
+// Offline geocoder backed by a JSON array of GeocodeResult, for development.
+type FileGeocoder struct {
+	entries []GeocodeResult
+}
+
+func NewFileGeocoder(path string) (FileGeocoder, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return FileGeocoder{}, err
+	}
+
+	entries := []GeocodeResult{}
+	err = json.Unmarshal(bytes, &entries)
+	return FileGeocoder{entries}, err
+}
+
+func (g FileGeocoder) Geocode(address string) (GeocodeResult, error) {
+	key := NormalizeAddress(address)
+	for _, entry := range g.entries {
+		if NormalizeAddress(entry.Address) == key {
+			return entry, nil
+		}
+	}
+	return GeocodeResult{}, ErrGeocodeNotFound
+}
+
+func (g FileGeocoder) ReverseGeocode(coordinates [2]float64) (GeocodeResult, error) {
+	closest, closest_distance := GeocodeResult{}, math.MaxFloat64
+	for _, entry := range g.entries {
+		distance := HaversineDistance(coordinates, entry.Coordinates)
+		if distance < closest_distance {
+			closest, closest_distance = entry, distance
+		}
+	}
+	if closest_distance > FILE_GEOCODER_MAX_REVERSE_METERS {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	return closest, nil
+}
+
+// HTTP GEOCODER
+
+// Adapter for Nominatim-style /search and /reverse APIs, which most hosted
+// geocoding providers also offer.
+type HTTPGeocoder struct {
+	base_url string
+	api_key  string
+	client   *http.Client
+}
+
+type nominatimPlace struct {
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	DisplayName string `json:"display_name"`
+}
+
+func NewHTTPGeocoder(base_url string, api_key string) HTTPGeocoder {
+	return HTTPGeocoder{
+		base_url: strings.TrimSuffix(base_url, "/"),
+		api_key:  api_key,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (g HTTPGeocoder) Geocode(address string) (GeocodeResult, error) {
+	places := []nominatimPlace{}
+	err := g.get("/search", url.Values{"q": {address}, "limit": {"1"}}, &places)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	if len(places) == 0 {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	return places[0].toResult()
+}
+
+func (g HTTPGeocoder) ReverseGeocode(coordinates [2]float64) (GeocodeResult, error) {
+	place := nominatimPlace{}
+	err := g.get("/reverse", url.Values{
+		"lon": {strconv.FormatFloat(coordinates[0], 'f', -1, 64)},
+		"lat": {strconv.FormatFloat(coordinates[1], 'f', -1, 64)},
+	}, &place)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	if place.DisplayName == "" {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	return place.toResult()
+}
+
+func (g HTTPGeocoder) get(path string, params url.Values, out any) error {
+	params.Set("format", "jsonv2")
+	if g.api_key != "" {
+		params.Set("key", g.api_key)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, g.base_url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "GoCharge/1.0 (gocharge.group@gmail.com)")
+
+	response, err := g.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("geocoder responded with status %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+func (p nominatimPlace) toResult() (GeocodeResult, error) {
+	lat, err := strconv.ParseFloat(p.Lat, 64)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	lng, err := strconv.ParseFloat(p.Lon, 64)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	return GeocodeResult{p.DisplayName, [2]float64{lng, lat}}, nil
+}
+
+// CACHED GEOCODER
+
+const GEOCODE_FORWARD = "forward"
+const GEOCODE_REVERSE = "reverse"
+
+type GeocodeCacheEntry struct {
+	Kind      string        `bson:"kind"`
+	Key       string        `bson:"key"`
+	Result    GeocodeResult `bson:"result"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+// Caches successful lookups of another geocoder in GEOCODE_CACHE_COLL.
+type CachedGeocoder struct {
+	provider Geocoder
+}
+
+func (g CachedGeocoder) Geocode(address string) (GeocodeResult, error) {
+	return g.cached(GEOCODE_FORWARD, NormalizeAddress(address), func() (GeocodeResult, error) {
+		return g.provider.Geocode(address)
+	})
+}
+
+func (g CachedGeocoder) ReverseGeocode(coordinates [2]float64) (GeocodeResult, error) {
+	// ~1m precision, so nearby lookups share an entry.
+	key := fmt.Sprintf("%.5f,%.5f", coordinates[0], coordinates[1])
+	return g.cached(GEOCODE_REVERSE, key, func() (GeocodeResult, error) {
+		return g.provider.ReverseGeocode(coordinates)
+	})
+}
+
+func (g CachedGeocoder) cached(kind string, key string, lookup func() (GeocodeResult, error)) (GeocodeResult, error) {
+	entry, err := GetOne[GeocodeCacheEntry](GEOCODE_CACHE_COLL, bson.D{{"kind", kind}, {"key", key}})
+	if err == nil {
+		return entry.Result, nil
+	}
+
+	result, err := lookup()
+	if err != nil {
+		return result, err
+	}
+
+	_, err = mongoClient.
+		Database("GoCharge").
+		Collection(GEOCODE_CACHE_COLL).
+		UpdateOne(
+			context.TODO(),
+			bson.D{{"kind", kind}, {"key", key}},
+			bson.D{{"$set", GeocodeCacheEntry{kind, key, result, time.Now()}}},
+			options.Update().SetUpsert(true),
+		)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Error caching geocoding result: %v", err)
+	}
+	return result, nil
+}
+
+// STATION LOCATIONS
+
+func NormalizeAddress(address string) string {
+	return strings.Join(Tokenize(address), " ")
+}
+
+type LocationCheck struct {
+	Address        string
+	Coordinates    [2]float64
+	IsMismatch     bool
+	MismatchMeters float64
+}
+
+// Fills in whichever of address and coordinates an owner left out, and checks
+// that the two agree when both are given. A disagreement is only flagged, so
+// an admin can decide during approval.
+func CheckStationLocation(address string, coordinates [2]float64) (LocationCheck, error) {
+	check := LocationCheck{Address: address, Coordinates: coordinates}
+	has_address := strings.TrimSpace(address) != ""
+	has_coordinates := coordinates != [2]float64{}
+
+	if !has_address && !has_coordinates {
+		return check, errors.New("A station needs an address or coordinates")
+	}
+	if geocoder == nil {
+		// without a geocoder, an address alone would leave the station at [0,0].
+		if !has_coordinates {
+			return check, errors.New("Coordinates are required")
+		}
+		return check, nil
+	}
+
+	if !has_coordinates {
+		result, err := geocoder.Geocode(address)
+		if err != nil {
+			return check, fmt.Errorf("Unable to find coordinates for this address: %w", err)
+		}
+		check.Coordinates = result.Coordinates
+		return check, nil
+	}
+
+	if !has_address {
+		result, err := geocoder.ReverseGeocode(coordinates)
+		if err != nil {
+			return check, fmt.Errorf("Unable to find an address for these coordinates: %w", err)
+		}
+		check.Address = result.Address
+		return check, nil
+	}
+
+	result, err := geocoder.Geocode(address)
+	if err != nil {
+		// can't verify, but that shouldn't block the owner.
+		log.Printf("Unable to verify station address %q: %v", address, err)
+		return check, nil
+	}
+	check.MismatchMeters = HaversineDistance(result.Coordinates, coordinates)
+	check.IsMismatch = check.MismatchMeters > geocode_mismatch_meters
+	return check, nil
+}
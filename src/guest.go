@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// who can find a station. stations without a visibility are public. unlisted
+// stations are left out of search but open to anyone with their link, and
+// guests-only stations are open to approved guests alone.
+const VISIBILITY_PUBLIC = "public"
+const VISIBILITY_UNLISTED = "unlisted"
+const VISIBILITY_GUESTS_ONLY = "guests_only"
+
+const GUEST_PENDING = "pending"
+const GUEST_APPROVED = "approved"
+const GUEST_DECLINED = "declined"
+
+func ValidateVisibility(visibility string) (string, error) {
+	switch visibility {
+	case "":
+		return VISIBILITY_PUBLIC, nil
+	case VISIBILITY_PUBLIC, VISIBILITY_UNLISTED, VISIBILITY_GUESTS_ONLY:
+		return visibility, nil
+	}
+	return "", errors.New("Visibility must be 'public', 'unlisted' or 'guests_only'")
+}
+
+func ApprovedGuestStationIDs(user_id primitive.ObjectID) ([]primitive.ObjectID, error) {
+	guests, err := GetAll[StationGuest](STATION_GUEST_COLL, bson.D{
+		{"user_id", user_id},
+		{"status", GUEST_APPROVED},
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	station_ids := []primitive.ObjectID{}
+	for _, guest := range guests {
+		station_ids = append(station_ids, guest.StationID)
+	}
+	return station_ids, nil
+}
+
+// stations the user was granted a role at.
+func GrantedStationIDs(user_id primitive.ObjectID) ([]primitive.ObjectID, error) {
+	grants, err := GetAll[StationGrant](STATION_GRANT_COLL, bson.D{
+		{"user_id", user_id},
+		{"status", GRANT_ACCEPTED},
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	station_ids := []primitive.ObjectID{}
+	for _, grant := range grants {
+		station_ids = append(station_ids, grant.StationID)
+	}
+	return station_ids, nil
+}
+
+// matches stations a driver may see: those VisibleStationMatch lists, plus
+// those they own, manage or are an approved guest of. with include_unlisted,
+// unlisted stations match too, for drivers who already know of them.
+func StationAccessMatch(user_id primitive.ObjectID, include_unlisted bool) (bson.D, error) {
+	guest_station_ids, err := ApprovedGuestStationIDs(user_id)
+	if err != nil {
+		return nil, err
+	}
+	granted_station_ids, err := GrantedStationIDs(user_id)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := bson.A{VISIBILITY_GUESTS_ONLY}
+	if !include_unlisted {
+		hidden = append(hidden, VISIBILITY_UNLISTED)
+	}
+	return append(PublishedStationMatch(),
+		bson.E{"$and", bson.A{
+			bson.D{{"$or", bson.A{
+				bson.D{{"visibility", bson.D{{"$nin", hidden}}}},
+				bson.D{{"owner_id", user_id}},
+				bson.D{{"_id", bson.D{{"$in", guest_station_ids}}}},
+				bson.D{{"_id", bson.D{{"$in", granted_station_ids}}}},
+			}}},
+		}},
+	), nil
+}
+
+// StationAccessMatch for the calling user. Answers the request itself and
+// returns false when it fails.
+func RequestStationAccessMatch(c *gin.Context, include_unlisted bool) (bson.D, bool) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	visible, err := StationAccessMatch(user_id, include_unlisted)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return visible, true
+}
+
+// Checks whether a driver may see a station and use its chargers. has_link
+// says whether they reached it through its share link. the owner and staff
+// always may.
+func CanAccessStation(station Station, user_id primitive.ObjectID, has_link bool) (bool, error) {
+	if station.OwnerID == user_id {
+		return true, nil
+	}
+	switch station.Visibility {
+	case "", VISIBILITY_PUBLIC:
+		return true, nil
+	case VISIBILITY_UNLISTED:
+		if has_link {
+			return true, nil
+		}
+	}
+
+	_, err := GetOne[StationGrant](STATION_GRANT_COLL, bson.D{
+		{"station_id", station.ID},
+		{"user_id", user_id},
+		{"status", GRANT_ACCEPTED},
+	})
+	if err == nil {
+		return true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	_, err = GetOne[StationGuest](STATION_GUEST_COLL, bson.D{
+		{"station_id", station.ID},
+		{"user_id", user_id},
+		{"status", GUEST_APPROVED},
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returns the station's share link token, creating one for stations made
+// before links existed.
+func EnsureShareToken(station Station) (string, error) {
+	if station.ShareToken != "" {
+		return station.ShareToken, nil
+	}
+
+	token, err := GenInviteToken()
+	if err != nil {
+		return "", err
+	}
+	err = UpdateOne(
+		STATION_COLL,
+		bson.D{
+			{"_id", station.ID},
+			{"share_token", bson.D{{"$in", bson.A{"", nil}}}},
+		},
+		bson.D{{"$set", bson.D{{"share_token", token}}}},
+	)
+	if err != nil {
+		// someone else made one first.
+		station, err = GetStation(bson.D{{"_id", station.ID}})
+		return station.ShareToken, err
+	}
+	return token, nil
+}
+
+func HandleGetStationShareLink(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	station, err := AuthorizeStation(user_id, body_data.StationID, PERM_EDIT_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	token, err := EnsureShareToken(station)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, StationShareLinkOutput{station.ID, token})
+}
+
+// Ask a host for access to an unlisted or guests-only station, found through
+// its share link.
+func HandleRequestStationAccess(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationAccessRequestInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	station, err := GetStation(append(PublishedStationMatch(), bson.E{"_id", body_data.StationID}))
+	if err != nil || body_data.ShareToken == "" || body_data.ShareToken != station.ShareToken {
+		c.JSON(http.StatusNotFound, "No such station found")
+		return
+	}
+	if station.Visibility == "" || station.Visibility == VISIBILITY_PUBLIC || station.OwnerID == user_id {
+		c.JSON(http.StatusBadRequest, "You already have access to this station")
+		return
+	}
+
+	// asking again after a decline reopens the request.
+	_, err = mongoClient.Database("GoCharge").Collection(STATION_GUEST_COLL).UpdateOne(
+		context.TODO(),
+		bson.D{
+			{"station_id", station.ID},
+			{"user_id", user_id},
+			{"status", bson.D{{"$ne", GUEST_APPROVED}}},
+		},
+		bson.D{
+			{"$set", bson.D{
+				{"status", GUEST_PENDING},
+				{"message", body_data.Message},
+				{"requested_at", time.Now()},
+				{"decided_at", nil},
+			}},
+			{"$setOnInsert", bson.D{
+				{"_id", primitive.NewObjectID()},
+				{"username", user_claim.Username},
+			}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, "You already have access to this station")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	guest, err := GetOne[StationGuest](STATION_GUEST_COLL, bson.D{
+		{"station_id", station.ID},
+		{"user_id", user_id},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, guest)
+}
+
+// Get the driver's access requests and approvals.
+func HandleGetMyStationAccess(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	guests, err := GetAll[StationGuest](STATION_GUEST_COLL, bson.D{{"user_id", user_id}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, guests)
+}
+
+func HandleGetStationAccessRequests(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_EDIT_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	guests, err := GetAll[StationGuest](STATION_GUEST_COLL, bson.D{{"station_id", body_data.StationID}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, guests)
+}
+
+// Approve or decline a guest. Declining an approved guest takes their access
+// away.
+func HandleDecideStationAccess(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[DecideStationAccessInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	guest, err := GetOne[StationGuest](STATION_GUEST_COLL, bson.D{{"_id", body_data.RequestID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such access request found")
+		return
+	}
+
+	_, err = AuthorizeStation(user_id, guest.StationID, PERM_EDIT_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	status := GUEST_DECLINED
+	if body_data.Approve {
+		status = GUEST_APPROVED
+	}
+	if guest.Status == status {
+		c.JSON(http.StatusOK, guest)
+		return
+	}
+
+	now := time.Now()
+	err = UpdateOne(
+		STATION_GUEST_COLL,
+		bson.D{{"_id", guest.ID}},
+		bson.D{{"$set", bson.D{
+			{"status", status},
+			{"decided_at", now},
+		}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	guest.Status = status
+	guest.DecidedAt = &now
+	c.JSON(http.StatusOK, guest)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const IMPORT_SOURCE_OCM = "ocm"
+const IMPORT_SOURCE_OCPI = "ocpi"
+
+var ErrImportDuplicate = errors.New("duplicate of an existing station")
+
+// Open Charge Map ConnectionTypeID values.
+var ocm_connector_types = map[int]string{
+	1:    CONNECTOR_J1772,
+	2:    CONNECTOR_CHADEMO,
+	25:   CONNECTOR_TYPE2,
+	1036: CONNECTOR_TYPE2,
+	32:   CONNECTOR_CCS1,
+	33:   CONNECTOR_CCS2,
+	27:   CONNECTOR_NACS,
+	30:   CONNECTOR_NACS,
+}
+
+// OCPI ConnectorType values.
+var ocpi_connector_types = map[string]string{
+	"SAE_J1772":          CONNECTOR_J1772,
+	"IEC_62196_T1":       CONNECTOR_J1772,
+	"IEC_62196_T1_COMBO": CONNECTOR_CCS1,
+	"IEC_62196_T2":       CONNECTOR_TYPE2,
+	"IEC_62196_T2_COMBO": CONNECTOR_CCS2,
+	"CHADEMO":            CONNECTOR_CHADEMO,
+	"TESLA_S":            CONNECTOR_NACS,
+	"TESLA_R":            CONNECTOR_NACS,
+	"SAE_J3400":          CONNECTOR_NACS,
+}
+
+type OCMConnection struct {
+	ID               int     `json:"ID"`
+	ConnectionTypeID int     `json:"ConnectionTypeID"`
+	LevelID          int     `json:"LevelID"`
+	CurrentTypeID    int     `json:"CurrentTypeID"` // 10 AC single phase, 20 AC three phase, 30 DC
+	PowerKW          float64 `json:"PowerKW"`
+	Quantity         int     `json:"Quantity"`
+}
+
+type OCMPointOfInterest struct {
+	ID          int `json:"ID"`
+	AddressInfo struct {
+		Title           string  `json:"Title"`
+		AddressLine1    string  `json:"AddressLine1"`
+		Town            string  `json:"Town"`
+		StateOrProvince string  `json:"StateOrProvince"`
+		Postcode        string  `json:"Postcode"`
+		Latitude        float64 `json:"Latitude"`
+		Longitude       float64 `json:"Longitude"`
+	} `json:"AddressInfo"`
+	Connections     []OCMConnection `json:"Connections"`
+	GeneralComments string          `json:"GeneralComments"`
+}
+
+type OCPIConnector struct {
+	ID               string  `json:"id"`
+	Standard         string  `json:"standard"`
+	PowerType        string  `json:"power_type"`         // AC_1_PHASE, AC_3_PHASE or DC
+	MaxElectricPower float64 `json:"max_electric_power"` // watts
+	MaxVoltage       float64 `json:"max_voltage"`
+	MaxAmperage      float64 `json:"max_amperage"`
+}
+
+type OCPILocation struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	City        string `json:"city"`
+	PostalCode  string `json:"postal_code"`
+	Coordinates struct {
+		Latitude  string `json:"latitude"`
+		Longitude string `json:"longitude"`
+	} `json:"coordinates"`
+	EVSEs []struct {
+		UID        string          `json:"uid"`
+		EVSEID     string          `json:"evse_id"`
+		Connectors []OCPIConnector `json:"connectors"`
+	} `json:"evses"`
+}
+
+// a station from either source, in our terms.
+type ImportedStation struct {
+	ExternalID  string
+	Name        string
+	Description string
+	Address     string
+	Coordinates [2]float64
+	Chargers    []ImportedCharger
+}
+
+type ImportedCharger struct {
+	ExternalID     string
+	Name           string
+	ChargerTypesId string
+	KWhTypesId     string
+}
+
+type ImportSummary struct {
+	Created    int
+	Updated    int
+	Duplicates int
+	Invalid    int
+}
+
+func PowerTier(kw float64, is_dc bool) string {
+	if is_dc || kw > 22 {
+		return POWER_DCFC
+	}
+	if kw > 0 && kw <= 2 {
+		return POWER_LEVEL1
+	}
+	return POWER_LEVEL2
+}
+
+func JoinAddress(parts ...string) string {
+	kept := []string{}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+func ParseOCM(data []byte) ([]ImportedStation, error) {
+	pois := []OCMPointOfInterest{}
+	err := json.Unmarshal(data, &pois)
+	if err != nil {
+		return nil, err
+	}
+
+	stations := []ImportedStation{}
+	for _, poi := range pois {
+		info := poi.AddressInfo
+		station := ImportedStation{
+			ExternalID:  strconv.Itoa(poi.ID),
+			Name:        info.Title,
+			Description: poi.GeneralComments,
+			Address:     JoinAddress(info.AddressLine1, info.Town, info.StateOrProvince, info.Postcode),
+			Coordinates: [2]float64{info.Longitude, info.Latitude},
+			Chargers:    []ImportedCharger{},
+		}
+		for _, conn := range poi.Connections {
+			connector, ok := ocm_connector_types[conn.ConnectionTypeID]
+			if !ok {
+				connector = CONNECTOR_OTHER
+			}
+			tier := PowerTier(conn.PowerKW, conn.CurrentTypeID == 30 || conn.LevelID == 3)
+			if conn.LevelID == 1 {
+				tier = POWER_LEVEL1
+			}
+
+			// a connection row stands for Quantity identical ports.
+			quantity := max(conn.Quantity, 1)
+			for i := 1; i <= quantity; i++ {
+				station.Chargers = append(station.Chargers, ImportedCharger{
+					ExternalID:     fmt.Sprintf("%d-%d", conn.ID, i),
+					Name:           fmt.Sprintf("%s %d-%d", strings.ToUpper(connector), conn.ID, i),
+					ChargerTypesId: connector,
+					KWhTypesId:     tier,
+				})
+			}
+		}
+		stations = append(stations, station)
+	}
+	return stations, nil
+}
+
+func ParseOCPI(data []byte) ([]ImportedStation, error) {
+	// accept a bare list of locations or a full OCPI response envelope.
+	locations := []OCPILocation{}
+	err := json.Unmarshal(data, &locations)
+	if err != nil {
+		envelope := struct {
+			Data []OCPILocation `json:"data"`
+		}{}
+		err = json.Unmarshal(data, &envelope)
+		if err != nil {
+			return nil, err
+		}
+		locations = envelope.Data
+	}
+
+	stations := []ImportedStation{}
+	for _, location := range locations {
+		lat, lat_err := strconv.ParseFloat(location.Coordinates.Latitude, 64)
+		lng, lng_err := strconv.ParseFloat(location.Coordinates.Longitude, 64)
+		if lat_err != nil || lng_err != nil {
+			lat, lng = 0, 0
+		}
+		station := ImportedStation{
+			ExternalID:  location.ID,
+			Name:        location.Name,
+			Address:     JoinAddress(location.Address, location.City, location.PostalCode),
+			Coordinates: [2]float64{lng, lat},
+			Chargers:    []ImportedCharger{},
+		}
+		for _, evse := range location.EVSEs {
+			for _, connector := range evse.Connectors {
+				connector_type, ok := ocpi_connector_types[connector.Standard]
+				if !ok {
+					connector_type = CONNECTOR_OTHER
+				}
+				kw := connector.MaxElectricPower / 1000
+				if kw == 0 {
+					kw = connector.MaxVoltage * connector.MaxAmperage / 1000
+				}
+				name := evse.EVSEID
+				if name == "" {
+					name = evse.UID
+				}
+				station.Chargers = append(station.Chargers, ImportedCharger{
+					ExternalID:     evse.UID + "/" + connector.ID,
+					Name:           name + " " + connector.ID,
+					ChargerTypesId: connector_type,
+					KWhTypesId:     PowerTier(kw, connector.PowerType == "DC"),
+				})
+			}
+		}
+		stations = append(stations, station)
+	}
+	return stations, nil
+}
+
+func ValidateImportedStation(station ImportedStation) error {
+	if station.ExternalID == "" {
+		return errors.New("missing id")
+	}
+	if station.Name == "" {
+		return errors.New("missing name")
+	}
+	lng, lat := station.Coordinates[0], station.Coordinates[1]
+	if (lng == 0 && lat == 0) || lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return errors.New("missing or invalid coordinates")
+	}
+	return nil
+}
+
+// Creates or refreshes one imported station and its chargers. Returns whether
+// the station was new, or ErrImportDuplicate when it looks like a station
+// someone already added by hand.
+func ImportStation(source string, station ImportedStation, owner_id primitive.ObjectID, publish bool) (bool, error) {
+	existing, err := GetStation(bson.D{
+		{"external_source", source},
+		{"external_id", station.ExternalID},
+	})
+	is_new := err == mongo.ErrNoDocuments
+	if err != nil && !is_new {
+		return false, err
+	}
+
+	station_id := existing.ID
+	if is_new {
+		station_id = primitive.NewObjectID()
+		duplicate_ids, err := FindPossibleDuplicates(station_id, station.Coordinates, station.Address, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(duplicate_ids) > 0 {
+			return false, ErrImportDuplicate
+		}
+
+		_, err = CreateStation(Station{
+			ID:             station_id,
+			OwnerID:        owner_id,
+			PictureURLs:    []string{},
+			Name:           station.Name,
+			Description:    station.Description,
+			Coordinates:    station.Coordinates,
+			Address:        station.Address,
+			IsPublic:       publish,
+			SearchTokens:   StationSearchTokens(station.Name, station.Address),
+			CoLocatedIDs:   []primitive.ObjectID{},
+			DuplicateIDs:   []primitive.ObjectID{},
+			Amenities:      []string{},
+			ExternalSource: source,
+			ExternalID:     station.ExternalID,
+		})
+		if err != nil {
+			return false, err
+		}
+	} else {
+		// the source owns the location data, owners keep everything else.
+		_, err = mongoClient.Database("GoCharge").Collection(STATION_COLL).UpdateOne(
+			context.TODO(),
+			bson.D{{"_id", station_id}},
+			bson.D{{"$set", bson.D{
+				{"name", station.Name},
+				{"address", station.Address},
+				{"coordinates", station.Coordinates},
+				{"search_tokens", StationSearchTokens(station.Name, station.Address)},
+			}}},
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, charger := range station.Chargers {
+		short_code, err := GenShortCode()
+		if err != nil {
+			return false, err
+		}
+		_, err = mongoClient.Database("GoCharge").Collection(CHARGER_COLL).UpdateOne(
+			context.TODO(),
+			bson.D{
+				{"station_id", station_id},
+				{"external_id", charger.ExternalID},
+			},
+			bson.D{
+				{"$set", bson.D{
+					{"name", charger.Name},
+					{"kWh_types_id", charger.KWhTypesId},
+					{"charger_types_id", charger.ChargerTypesId},
+				}},
+				{"$setOnInsert", bson.D{
+					{"_id", primitive.NewObjectID()},
+					{"description", ""},
+					{"status", CHARGER_AVAILABLE},
+					{"price_unknown", true}, // neither export carries prices
+					{"total_payments", 0.0},
+					{"is_archived", false},
+					{"is_decommissioned", false},
+					{"short_code", short_code},
+				}},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return is_new, nil
+}
+
+// Usage: hello import -format ocm|ocpi -file export.json -owner owner@example.com [-publish]
+func RunImportCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", IMPORT_SOURCE_OCM, "export format, 'ocm' or 'ocpi'")
+	file := flags.String("file", "", "path to the export file")
+	owner_email := flags.String("owner", os.Getenv("IMPORT_OWNER_EMAIL"), "email of the owner account that holds imported stations")
+	publish := flags.Bool("publish", false, "make newly imported stations visible without admin approval")
+	flags.Parse(args)
+
+	if *file == "" || *owner_email == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	owner, err := GetUser(bson.D{
+		{"email", *owner_email},
+		{"role", OWNER_ROLE},
+	})
+	if err != nil {
+		log.Fatalf("no owner account with email %s: %s", *owner_email, err)
+	}
+	owner_id, err := primitive.ObjectIDFromHex(owner.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var stations []ImportedStation
+	switch *format {
+	case IMPORT_SOURCE_OCM:
+		stations, err = ParseOCM(data)
+	case IMPORT_SOURCE_OCPI:
+		stations, err = ParseOCPI(data)
+	default:
+		log.Fatalf("unknown format %s", *format)
+	}
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *file, err)
+	}
+
+	summary := ImportSummary{}
+	for _, station := range stations {
+		err := ValidateImportedStation(station)
+		if err != nil {
+			log.Printf("skipping %s station %q: %s", *format, station.ExternalID, err)
+			summary.Invalid++
+			continue
+		}
+
+		is_new, err := ImportStation(*format, station, owner_id, *publish)
+		if err == ErrImportDuplicate {
+			log.Printf("skipping %s station %q: %s", *format, station.ExternalID, err)
+			summary.Duplicates++
+			continue
+		}
+		if err != nil {
+			log.Fatalf("failed to import %s station %q: %s", *format, station.ExternalID, err)
+		}
+		if is_new {
+			summary.Created++
+		} else {
+			summary.Updated++
+		}
+	}
+
+	log.Printf(
+		"import done: %d created, %d updated, %d duplicates skipped, %d invalid",
+		summary.Created, summary.Updated, summary.Duplicates, summary.Invalid,
+	)
+}
@@ -24,11 +24,29 @@ func InitUserRouter(router *gin.Engine) {
 	user_router.POST("/closest-stations", HandleClosestStations)
 	user_router.POST("/favorite-station", HandleFavoriteStation)
 	user_router.POST("/unfavorite-station", HandleUnfavoriteStation)
+	user_router.POST("/favorite-stations", HandleGetFavoriteStations)
 	user_router.POST("/station-and-chargers", HandleGetStationAndChargers)
+	user_router.POST("/stations-in-view", HandleViewportStations)
+	user_router.POST("/stations-along-route", HandleRouteStations)
+	user_router.POST("/search-stations", HandleTextSearchStations)
+	user_router.POST("/autocomplete-stations", HandleAutocompleteStations)
+	user_router.POST("/request-station-access", HandleRequestStationAccess)
+	user_router.GET("/my-station-access", HandleGetMyStationAccess)
 
 	// session routes
 	user_router.POST("/start-session", HandleStartSession)
+	user_router.POST("/charger-by-code", HandleGetChargerByCode)
 	user_router.POST("/end-session", HandleEndSession)
+	user_router.POST("/session-meter-values", HandleIngestMeterValues)
+	user_router.POST("/session-telemetry", HandleGetSessionTelemetry)
+	user_router.POST("/remote-start-session", HandleRemoteStartSession)
+	user_router.POST("/remote-stop-session", HandleRemoteStopSession)
+	user_router.GET("/ocpp-id-tag", HandleGetOCPPIdTag)
+	user_router.POST("/rotate-ocpp-id-tag", HandleRotateOCPPIdTag)
+
+	// fault report routes
+	user_router.POST("/report-fault", HandleReportFault)
+	user_router.GET("/my-fault-reports", HandleGetMyFaultReports)
 
 	// review routes
 	user_router.POST("/review-station", HandleReviewStation)
@@ -51,12 +69,44 @@ func InitOwnerRouter(router *gin.Engine) {
 	// station routes
 	owner_router.POST("/request-station", HandleStationRequest)
 	owner_router.GET("/get-user-chargers", HandleGetUserChargers)
+	owner_router.POST("/portfolio", HandleGetPortfolio)
 	owner_router.POST("/station-and-chargers", HandleGetStationAndChargers)
 	owner_router.POST("/edit-station", HandleEditStation)
+	owner_router.POST("/archive-station", HandleArchiveStation)
+	owner_router.POST("/delete-station", HandleDeleteStation)
+	owner_router.POST("/station-share-link", HandleGetStationShareLink)
+	owner_router.POST("/station-access-requests", HandleGetStationAccessRequests)
+	owner_router.POST("/decide-station-access", HandleDecideStationAccess)
+	owner_router.POST("/import-stations", HandleImportStations)
+	owner_router.GET("/export-stations", HandleExportStations)
 
 	// charger routes
 	owner_router.POST("/add-charger", HandleAddCharger)
 	owner_router.POST("/edit-charger", HandleEditCharger)
+	owner_router.POST("/decommission-charger", HandleDecommissionCharger)
+	owner_router.POST("/delete-charger", HandleDeleteCharger)
+	owner_router.POST("/set-charger-status", HandleSetChargerStatus)
+	owner_router.POST("/charger-status-history", HandleGetChargerStatusHistory)
+	owner_router.POST("/charger-ocpp-key", HandleRotateOCPPKey)
+	owner_router.POST("/schedule-maintenance", HandleScheduleMaintenance)
+	owner_router.POST("/cancel-maintenance", HandleCancelMaintenance)
+	owner_router.POST("/maintenance-windows", HandleGetMaintenanceWindows)
+	owner_router.GET("/charger-qr-code", HandleGetChargerQRCode)
+	owner_router.POST("/regenerate-charger-code", HandleRegenerateChargerCode)
+	owner_router.POST("/fault-reports", HandleGetFaultReports)
+	owner_router.POST("/update-fault-report", HandleUpdateFaultReport)
+
+	// co-manager routes
+	owner_router.POST("/invite-station-manager", HandleInviteStationManager)
+	owner_router.POST("/accept-station-invite", HandleAcceptStationInvite)
+	owner_router.POST("/station-grants", HandleGetStationGrants)
+	owner_router.POST("/revoke-station-grant", HandleRevokeStationGrant)
+	owner_router.GET("/managed-stations", HandleGetManagedStations)
+	owner_router.POST("/station-sessions", HandleGetStationSessions)
+	owner_router.POST("/session-telemetry", HandleGetSessionTelemetry)
+	owner_router.POST("/station-analytics", HandleStationAnalytics)
+	owner_router.POST("/transfer-station", HandleTransferStation)
+	owner_router.POST("/accept-station-transfer", HandleAcceptStationTransfer)
 }
 
 func InitAdminRouter(router *gin.Engine) {
@@ -69,6 +119,19 @@ func InitAdminRouter(router *gin.Engine) {
 	// station routes
 	admin_router.POST("/approve-station", HandleStationRequestApproval)
 	admin_router.POST("/unapproved-stations", HandleUnapprovedStations)
+	admin_router.POST("/station-revisions", HandlePendingStationRevisions)
+	admin_router.POST("/approve-station-revision", HandleStationRevisionApproval)
+	admin_router.POST("/restore-station", HandleRestoreStation)
+
+	// amenity catalog routes
+	admin_router.GET("/amenities", HandleGetAllAmenities)
+	admin_router.POST("/add-amenity", HandleAddAmenity)
+	admin_router.POST("/edit-amenity", HandleEditAmenity)
+
+	// charger catalog routes
+	admin_router.GET("/charger-catalog", HandleGetAllChargerCatalog)
+	admin_router.POST("/add-charger-catalog-entry", HandleAddChargerCatalogEntry)
+	admin_router.POST("/edit-charger-catalog-entry", HandleEditChargerCatalogEntry)
 }
 
 var wg sync.WaitGroup
@@ -81,6 +144,9 @@ func RunPublicVersion() {
 	router.GET("/login", HandleLogin)
 	router.POST("/password-reset-request", HandlePasswordResetRequest)
 	router.POST("/password-reset", HandlePasswordReset)
+	router.GET("/amenities", HandleGetAmenities)
+	router.GET("/charger-catalog", HandleGetChargerCatalog)
+	router.GET("/ocpp/:charger_id", HandleOCPPConnection)
 
 	InitUserRouter(router)
 	InitOwnerRouter(router)
@@ -110,14 +176,40 @@ func RunPrivateVersion() {
 }
 
 func main() {
+	// the simulator is a client, so it needs none of the server setup.
+	if len(os.Args) > 1 && os.Args[1] == "simulate-charge-point" {
+		RunChargePointSimulator(os.Args[2:])
+		return
+	}
+
 	InitPasswordResetTemplate()
 	InitGmailService()
 	InitMongoDb()
+	InitSearchConfig()
+	InitGeocoder()
+	InitDuplicateConfig()
+	InitOCPPConfig()
+	InitMaintenanceConfig()
+	InitFaultConfig()
+	InitShortCodeConfig()
+	SeedAmenities()
+	SeedChargerCatalog()
+	MigrateChargerStatuses()
+	MigrateChargerTypes()
+	BackfillChargerShortCodes()
+	BackfillStationSearchTokens()
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		RunImportCommand(os.Args[2:])
+		return
+	}
 
 	run_public_version := len(os.Args) < 2 || os.Args[1] == "public"
 	if run_public_version {
 		wg.Add(1)
 		go RunPublicVersion()
+		go RunAnalyticsRollupJob()
+		go RunMaintenanceJob()
 	}
 
 	run_private_version := len(os.Args) < 2 || os.Args[1] == "private"
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const MAINTENANCE_SCHEDULED = "scheduled"
+const MAINTENANCE_ACTIVE = "active"
+const MAINTENANCE_COMPLETED = "completed"
+const MAINTENANCE_CANCELLED = "cancelled"
+
+const MAX_MAINTENANCE_WINDOW = 14 * 24 * time.Hour
+const MAINTENANCE_TIME_FORMAT = "Mon Jan 2, 15:04 MST"
+
+const DEFAULT_MAINTENANCE_CHECK_INTERVAL_MINUTES = 1
+const DEFAULT_MAINTENANCE_NOTICE_HOURS = 24
+const DEFAULT_MAINTENANCE_SESSION_BUFFER_MINUTES = 60
+
+// how long before a window favoriting drivers hear about it, and how close to
+// a window a session may still start.
+var maintenance_notice = time.Duration(DEFAULT_MAINTENANCE_NOTICE_HOURS) * time.Hour
+var maintenance_session_buffer = time.Duration(DEFAULT_MAINTENANCE_SESSION_BUFFER_MINUTES) * time.Minute
+
+func InitMaintenanceConfig() {
+	maintenance_notice = time.Duration(ReadEnvInt64("MAINTENANCE_NOTICE_HOURS", DEFAULT_MAINTENANCE_NOTICE_HOURS)) * time.Hour
+	maintenance_session_buffer = time.Duration(ReadEnvInt64("MAINTENANCE_SESSION_BUFFER_MINUTES", DEFAULT_MAINTENANCE_SESSION_BUFFER_MINUTES)) * time.Minute
+}
+
+// matches windows that still take the charger offline.
+func OpenMaintenanceMatch() bson.E {
+	return bson.E{"status", bson.D{{"$in", bson.A{MAINTENANCE_SCHEDULED, MAINTENANCE_ACTIVE}}}}
+}
+
+// Finds an open maintenance window of the charger overlapping [from, to).
+func MaintenanceConflict(charger_id primitive.ObjectID, from time.Time, to time.Time) (*MaintenanceWindow, error) {
+	window, err := GetOne[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.D{
+		{"charger_id", charger_id},
+		OpenMaintenanceMatch(),
+		{"starts_at", bson.D{{"$lt", to}}},
+		{"ends_at", bson.D{{"$gt", from}}},
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &window, nil
+}
+
+// Checks that a session starting now won't run into maintenance. Sessions
+// have no planned end, so it looks ahead by the session buffer.
+func SessionMaintenanceConflict(charger_id primitive.ObjectID) (*MaintenanceWindow, error) {
+	now := time.Now()
+	return MaintenanceConflict(charger_id, now, now.Add(maintenance_session_buffer))
+}
+
+func MaintenanceConflictMessage(window *MaintenanceWindow) string {
+	return fmt.Sprintf("This charger is under maintenance from %s to %s",
+		window.StartsAt.UTC().Format(MAINTENANCE_TIME_FORMAT),
+		window.EndsAt.UTC().Format(MAINTENANCE_TIME_FORMAT))
+}
+
+// Emails every driver with the station in their favorites.
+func NotifyFavoritingDrivers(station_id primitive.ObjectID, subject string, message string) error {
+	users, err := GetAll[User](USER_COLL, bson.D{
+		{"favorite_station_ids", station_id},
+		{"role", USER_ROLE},
+	}, 0)
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for _, user := range users {
+		err = SendEmail(user.Email, FormNoticeBody(user.Username, message), subject)
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+func NotifyMaintenance(window MaintenanceWindow, is_cancelled bool) error {
+	station, err := GetStation(bson.D{{"_id", window.StationID}})
+	if err != nil {
+		return err
+	}
+	charger, err := GetCharger(bson.D{{"_id", window.ChargerID}})
+	if err != nil {
+		return err
+	}
+
+	period := fmt.Sprintf("%s to %s",
+		window.StartsAt.UTC().Format(MAINTENANCE_TIME_FORMAT),
+		window.EndsAt.UTC().Format(MAINTENANCE_TIME_FORMAT))
+	subject := "Planned maintenance at " + station.Name
+	message := fmt.Sprintf("Charger %s at %s, one of your favorite stations, will be offline for maintenance from %s. Reason: %s",
+		charger.Name, station.Name, period, window.Reason)
+	if is_cancelled {
+		subject = "Maintenance cancelled at " + station.Name
+		message = fmt.Sprintf("The maintenance of charger %s at %s planned from %s has been cancelled.",
+			charger.Name, station.Name, period)
+	}
+	return NotifyFavoritingDrivers(station.ID, subject, message)
+}
+
+// matches scheduled windows drivers haven't been told about yet that start
+// within the notice period.
+func UpcomingMaintenanceMatch(now time.Time) bson.D {
+	return bson.D{
+		{"status", MAINTENANCE_SCHEDULED},
+		{"notified_at", nil},
+		{"starts_at", bson.D{{"$lte", now.Add(maintenance_notice)}}},
+		{"ends_at", bson.D{{"$gt", now}}},
+	}
+}
+
+// Tells drivers about a window starting within the notice period. The window
+// is claimed by setting notified_at before any email goes out, so the job and
+// a handler can't both send it, and drivers are told at most once even if
+// some emails fail.
+func NotifyUpcomingMaintenance(window_id primitive.ObjectID, now time.Time) error {
+	var window MaintenanceWindow
+	err := mongoClient.Database("GoCharge").Collection(MAINTENANCE_WINDOW_COLL).FindOneAndUpdate(
+		context.TODO(),
+		append(bson.D{{"_id", window_id}}, UpcomingMaintenanceMatch(now)...),
+		bson.D{{"$set", bson.D{{"notified_at", now}}}},
+	).Decode(&window)
+	if err == mongo.ErrNoDocuments {
+		return nil // not due yet, or already claimed.
+	}
+	if err != nil {
+		return err
+	}
+
+	err = NotifyMaintenance(window, false)
+	if err != nil {
+		log.Printf("failed to notify drivers of maintenance %s: %s", window.ID.Hex(), err)
+	}
+	return nil
+}
+
+// Notifies drivers of upcoming windows, and starts and ends windows as they
+// come due. Chargers in use go into maintenance once their session ends.
+func ApplyMaintenanceWindows() error {
+	now := time.Now()
+
+	upcoming, err := GetAll[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, UpcomingMaintenanceMatch(now), 0)
+	if err != nil {
+		return err
+	}
+	for _, window := range upcoming {
+		err = NotifyUpcomingMaintenance(window.ID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	due, err := GetAll[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.D{
+		{"status", MAINTENANCE_SCHEDULED},
+		{"starts_at", bson.D{{"$lte", now}}},
+		{"ends_at", bson.D{{"$gt", now}}},
+	}, 0)
+	if err != nil {
+		return err
+	}
+	for _, window := range due {
+		err = StartMaintenanceWindow(window)
+		if err != nil {
+			return err
+		}
+	}
+
+	over, err := GetAll[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.D{
+		OpenMaintenanceMatch(),
+		{"ends_at", bson.D{{"$lte", now}}},
+	}, 0)
+	if err != nil {
+		return err
+	}
+	for _, window := range over {
+		err = EndMaintenanceWindow(window, MAINTENANCE_COMPLETED)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func StartMaintenanceWindow(window MaintenanceWindow) error {
+	charger, err := GetCharger(bson.D{{"_id", window.ChargerID}})
+	if err != nil {
+		return err
+	}
+
+	status := MAINTENANCE_ACTIVE
+	switch charger.Status {
+	case CHARGER_IN_USE:
+		return nil // try again once the session is over.
+	case CHARGER_DECOMMISSIONED:
+		status = MAINTENANCE_CANCELLED
+	case CHARGER_MAINTENANCE:
+		// already down, the owner brings it back.
+	default:
+		_, err = TransitionChargerStatus(charger.ID, []string{charger.Status}, CHARGER_MAINTENANCE, STATUS_REASON_MAINTENANCE, nil)
+		if err == ErrInvalidTransition {
+			return nil // the status just changed, try again next time.
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return UpdateMany(
+		MAINTENANCE_WINDOW_COLL,
+		bson.D{
+			{"_id", window.ID},
+			{"status", MAINTENANCE_SCHEDULED},
+		},
+		bson.D{{"$set", bson.D{
+			{"status", status},
+			{"previous_status", charger.Status},
+		}}},
+	)
+}
+
+// Closes a window, bringing the charger back if the window took it down. A
+// charger that was out of order before stays that way.
+func EndMaintenanceWindow(window MaintenanceWindow, status string) error {
+	if window.Status == MAINTENANCE_ACTIVE && window.PreviousStatus != CHARGER_MAINTENANCE {
+		to := CHARGER_AVAILABLE
+		if window.PreviousStatus == CHARGER_OUT_OF_ORDER {
+			to = CHARGER_OUT_OF_ORDER
+		}
+		// owners may have moved the charger on already.
+		_, err := TransitionChargerStatus(window.ChargerID, []string{CHARGER_MAINTENANCE}, to, STATUS_REASON_MAINTENANCE, nil)
+		if err != nil && err != ErrInvalidTransition {
+			return err
+		}
+	}
+
+	return UpdateMany(
+		MAINTENANCE_WINDOW_COLL,
+		bson.D{
+			{"_id", window.ID},
+			OpenMaintenanceMatch(),
+		},
+		bson.D{{"$set", bson.D{{"status", status}}}},
+	)
+}
+
+func RunMaintenanceJob() {
+	interval := time.Duration(ReadEnvInt64("MAINTENANCE_CHECK_INTERVAL_MINUTES", DEFAULT_MAINTENANCE_CHECK_INTERVAL_MINUTES)) * time.Minute
+	for {
+		err := ApplyMaintenanceWindows()
+		if err != nil {
+			log.Printf("maintenance job failed: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func ValidateMaintenanceWindow(body_data MaintenanceWindowInput) error {
+	if body_data.Reason == "" {
+		return errors.New("Reason is required")
+	}
+	if !body_data.EndsAt.After(body_data.StartsAt) {
+		return errors.New("Window must end after it starts")
+	}
+	if !body_data.EndsAt.After(time.Now()) {
+		return errors.New("Window is already over")
+	}
+	if body_data.EndsAt.Sub(body_data.StartsAt) > MAX_MAINTENANCE_WINDOW {
+		return errors.New("Window can be at most 14 days long")
+	}
+	return nil
+}
+
+// Announce that a charger will be offline for a while.
+func HandleScheduleMaintenance(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[MaintenanceWindowInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = ValidateMaintenanceWindow(body_data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+	if charger.IsDecommissioned {
+		c.JSON(http.StatusConflict, "Charger is decommissioned")
+		return
+	}
+
+	conflict, err := MaintenanceConflict(charger.ID, body_data.StartsAt, body_data.EndsAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if conflict != nil {
+		c.JSON(http.StatusConflict, "Window overlaps maintenance already scheduled for this charger")
+		return
+	}
+
+	window := MaintenanceWindow{
+		ID:        primitive.NewObjectID(),
+		ChargerID: charger.ID,
+		StationID: charger.StationID,
+		StartsAt:  body_data.StartsAt,
+		EndsAt:    body_data.EndsAt,
+		Reason:    body_data.Reason,
+		Status:    MAINTENANCE_SCHEDULED,
+		CreatedBy: user_id,
+		CreatedAt: time.Now(),
+	}
+	_, err = CreateOne(MAINTENANCE_WINDOW_COLL, window)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// windows starting soon shouldn't wait for the next job run. only this
+	// window is applied, the job takes care of the others.
+	now := time.Now()
+	err = NotifyUpcomingMaintenance(window.ID, now)
+	if err != nil {
+		log.Printf("failed to notify drivers of maintenance %s: %s", window.ID.Hex(), err)
+	}
+	if !window.StartsAt.After(now) {
+		err = StartMaintenanceWindow(window)
+		if err != nil {
+			log.Printf("failed to start maintenance %s: %s", window.ID.Hex(), err)
+		}
+	}
+
+	window, err = GetOne[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.D{{"_id", window.ID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, window)
+}
+
+// Call off a window, ending it early if it already started.
+func HandleCancelMaintenance(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[MaintenanceWindowIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	window, err := GetOne[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.D{
+		{"_id", body_data.WindowID},
+		OpenMaintenanceMatch(),
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No open maintenance window found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, window.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	err = EndMaintenanceWindow(window, MAINTENANCE_CANCELLED)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// drivers who were told about it hear that it's off.
+	if window.NotifiedAt != nil {
+		err = NotifyMaintenance(window, true)
+		if err != nil {
+			log.Printf("failed to notify drivers of cancelled maintenance %s: %s", window.ID.Hex(), err)
+		}
+	}
+
+	c.JSON(http.StatusOK, "")
+}
+
+// Get a station's maintenance windows that aren't over yet, soonest first.
+func HandleGetMaintenanceWindows(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	windows, err := Aggregate[MaintenanceWindow](MAINTENANCE_WINDOW_COLL, bson.A{
+		bson.D{{"$match", bson.D{
+			{"station_id", body_data.StationID},
+			OpenMaintenanceMatch(),
+		}}},
+		bson.D{{"$sort", bson.D{{"starts_at", 1}, {"_id", 1}}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, windows)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const METER_SOURCE_APP = "app"
+const METER_SOURCE_OCPP = "ocpp"
+
+// bounds beyond which a reading can't be real.
+const MAX_PLAUSIBLE_KW = 400.0
+const MAX_PLAUSIBLE_VOLTAGE = 1000.0
+const MAX_PLAUSIBLE_CURRENT = 600.0
+const METER_POWER_TOLERANCE = 1.1 // chargers may briefly exceed their rating
+const METER_CLOCK_SKEW = time.Minute
+
+const MAX_METER_READINGS_PER_REQUEST = 500
+const MAX_TELEMETRY_POINTS = 500
+
+var ErrMeterConflict = errors.New("Session received other readings in the meantime, retry")
+
+// readings of a batch that lost a race are deleted by _id, which time-series
+// collections only allow from MongoDB 7.0.
+const MIN_METER_MONGO_VERSION = 7
+
+// The time-series collection can't be made with a plain insert, so it's set
+// up before its indexes.
+func CreateMeterValueCollection() {
+	var build_info struct {
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	err := mongoClient.Database("admin").
+		RunCommand(context.TODO(), bson.D{{"buildInfo", 1}}).
+		Decode(&build_info)
+	if err != nil {
+		panic(err)
+	}
+	if len(build_info.VersionArray) == 0 || build_info.VersionArray[0] < MIN_METER_MONGO_VERSION {
+		panic(fmt.Sprintf("MongoDB %d.0 or newer is needed for meter readings, got %v",
+			MIN_METER_MONGO_VERSION, build_info.VersionArray))
+	}
+
+	err = mongoClient.Database("GoCharge").CreateCollection(
+		context.TODO(),
+		SESSION_METER_COLL,
+		options.CreateCollection().SetTimeSeriesOptions(
+			options.TimeSeries().
+				SetTimeField("recorded_at").
+				SetMetaField("meta").
+				SetGranularity("seconds"),
+		),
+	)
+	// the collection exists after the first run.
+	var command_err mongo.CommandError
+	if err != nil && !(errors.As(err, &command_err) && command_err.Name == "NamespaceExists") {
+		panic(err)
+	}
+}
+
+// The most a charger can plausibly deliver, going by its power level.
+func ChargerMaxKW(charger Charger) float64 {
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		return MAX_PLAUSIBLE_KW
+	}
+	entry, ok := catalog.Resolve(CATALOG_KIND_POWER, charger.KWhTypesId)
+	if !ok || entry.MaxKW <= 0 {
+		return MAX_PLAUSIBLE_KW
+	}
+	return math.Min(entry.MaxKW, MAX_PLAUSIBLE_KW)
+}
+
+// Checks one reading against the last accepted one. Energy is counted from
+// the session's meter start, which is 0 unless a charge point reported one.
+func CheckMeterReading(reading MeterReadingInput, session Session, last_at time.Time, last_wh float64, max_kw float64) error {
+	now := time.Now()
+	started_at := time.Unix(session.StartTimestamp, 0)
+	limit_kw := max_kw * METER_POWER_TOLERANCE
+
+	if reading.RecordedAt.IsZero() {
+		return errors.New("recorded_at is required")
+	}
+	if reading.RecordedAt.Before(started_at.Add(-METER_CLOCK_SKEW)) {
+		return errors.New("Recorded before the session started")
+	}
+	if reading.RecordedAt.After(now.Add(METER_CLOCK_SKEW)) {
+		return errors.New("Recorded in the future")
+	}
+	if !reading.RecordedAt.After(last_at) {
+		return errors.New("Not newer than the last reading")
+	}
+	if reading.EnergyWh < session.MeterStart {
+		return errors.New("Energy is below the session's meter start")
+	}
+	if reading.EnergyWh < last_wh {
+		return errors.New("Energy went backwards")
+	}
+	hours := reading.RecordedAt.Sub(last_at).Hours()
+	if hours > 0 && (reading.EnergyWh-last_wh)/1000/hours > limit_kw {
+		return errors.New("Energy rose faster than the charger can deliver")
+	}
+	if reading.PowerKW != nil && (*reading.PowerKW < 0 || *reading.PowerKW > limit_kw) {
+		return fmt.Errorf("Power must be between 0 and %.1f kW", limit_kw)
+	}
+	if reading.Voltage != nil && (*reading.Voltage < 0 || *reading.Voltage > MAX_PLAUSIBLE_VOLTAGE) {
+		return errors.New("Voltage must be between 0 and 1000 V")
+	}
+	if reading.Current != nil && (*reading.Current < 0 || *reading.Current > MAX_PLAUSIBLE_CURRENT) {
+		return errors.New("Current must be between 0 and 600 A")
+	}
+	if reading.StateOfCharge != nil && (*reading.StateOfCharge < 0 || *reading.StateOfCharge > 100) {
+		return errors.New("State of charge must be between 0 and 100")
+	}
+	return nil
+}
+
+// Stores the plausible readings of an open session and moves its running
+// totals along. Readings are checked in time order, each against the last
+// one accepted.
+func IngestMeterReadings(session Session, charger Charger, readings []MeterReadingInput, source string) (Session, []RejectedReading, error) {
+	rejected := []RejectedReading{}
+	order := make([]int, len(readings))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a int, b int) bool {
+		return readings[order[a]].RecordedAt.Before(readings[order[b]].RecordedAt)
+	})
+
+	last_at := time.Unix(session.StartTimestamp, 0).Add(-METER_CLOCK_SKEW)
+	last_wh := session.MeterStart
+	if session.MeterLastAt != nil {
+		last_at = *session.MeterLastAt
+		last_wh = session.MeterLastWh
+	}
+	max_kw := ChargerMaxKW(charger)
+
+	now := time.Now()
+	accepted := []interface{}{}
+	accepted_ids := []primitive.ObjectID{}
+	var latest MeterReadingInput
+	peak_kw := session.PeakPowerKW
+	state_of_charge := session.StateOfCharge
+	for _, i := range order {
+		reading := readings[i]
+		err := CheckMeterReading(reading, session, last_at, last_wh, max_kw)
+		if err != nil {
+			rejected = append(rejected, RejectedReading{Index: i, Reason: err.Error()})
+			continue
+		}
+
+		id := primitive.NewObjectID()
+		accepted_ids = append(accepted_ids, id)
+		accepted = append(accepted, MeterReading{
+			ID:            id,
+			Meta:          MeterReadingMeta{SessionID: session.ID, ChargerID: charger.ID},
+			RecordedAt:    reading.RecordedAt,
+			EnergyWh:      reading.EnergyWh,
+			PowerKW:       reading.PowerKW,
+			Voltage:       reading.Voltage,
+			Current:       reading.Current,
+			StateOfCharge: reading.StateOfCharge,
+			Source:        source,
+			ReceivedAt:    now,
+		})
+		latest = reading
+		last_at = reading.RecordedAt
+		last_wh = reading.EnergyWh
+		if reading.PowerKW != nil {
+			peak_kw = math.Max(peak_kw, *reading.PowerKW)
+		}
+		if reading.StateOfCharge != nil {
+			state_of_charge = reading.StateOfCharge
+		}
+	}
+	if len(accepted) == 0 {
+		return session, rejected, nil
+	}
+
+	// the readings go in before the running totals, so the totals never count
+	// readings that aren't stored.
+	meter_coll := mongoClient.Database("GoCharge").Collection(SESSION_METER_COLL)
+	_, err := meter_coll.InsertMany(context.TODO(), accepted)
+	if err != nil {
+		return session, rejected, err
+	}
+	// readings of a batch that lost to another one are taken back out.
+	discard := func() {
+		_, err := meter_coll.DeleteMany(context.TODO(), bson.D{
+			{"meta.session_id", session.ID},
+			{"_id", bson.D{{"$in", accepted_ids}}},
+		})
+		if err != nil {
+			log.Printf("Error discarding meter readings of session %s: %v", session.ID.Hex(), err)
+		}
+	}
+
+	// matching on the last reading time keeps two batches from both being
+	// checked against the same state.
+	power_used := (last_wh - session.MeterStart) / 1000
+	update := bson.D{
+		{"meter_last_at", last_at},
+		{"meter_last_wh", last_wh},
+		{"power_used", power_used},
+		{"power_kw", latest.PowerKW},
+		{"peak_power_kw", peak_kw},
+		{"state_of_charge", state_of_charge},
+	}
+	res, err := mongoClient.Database("GoCharge").Collection(SESSION_COLL).UpdateOne(
+		context.TODO(),
+		bson.D{
+			{"_id", session.ID},
+			{"end_timestamp", 0},
+			{"meter_last_at", session.MeterLastAt},
+		},
+		bson.D{
+			{"$set", update},
+			{"$inc", bson.D{{"meter_reading_count", len(accepted)}}},
+		},
+	)
+	if err != nil {
+		discard()
+		return session, rejected, err
+	}
+	if res.MatchedCount == 0 {
+		discard()
+		return session, rejected, ErrMeterConflict
+	}
+
+	session.MeterLastAt = &last_at
+	session.MeterLastWh = last_wh
+	session.PowerUsed = power_used
+	session.PowerKW = latest.PowerKW
+	session.PeakPowerKW = peak_kw
+	session.StateOfCharge = state_of_charge
+	session.MeterReadingCount += int64(len(accepted))
+	return session, rejected, nil
+}
+
+// Send meter readings for one of the caller's running sessions.
+func HandleIngestMeterValues(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[SessionMeterValuesInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body_data.Readings) == 0 {
+		c.JSON(http.StatusBadRequest, "No readings provided")
+		return
+	}
+	if len(body_data.Readings) > MAX_METER_READINGS_PER_REQUEST {
+		c.JSON(http.StatusRequestEntityTooLarge, "At most 500 readings can be sent at once")
+		return
+	}
+
+	session, err := GetOne[Session](SESSION_COLL, bson.D{
+		{"_id", body_data.SessionID},
+		{"user_id", user_id},
+		{"end_timestamp", 0},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such open session found")
+		return
+	}
+	// a charge point meters its own sessions.
+	if session.TransactionID != 0 {
+		c.JSON(http.StatusConflict, "This session is metered by its charger")
+		return
+	}
+	charger, err := GetCharger(bson.D{{"_id", session.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	session, rejected, err := IngestMeterReadings(session, charger, body_data.Readings, METER_SOURCE_APP)
+	if err == ErrMeterConflict {
+		c.JSON(http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	output := MeterValuesOutput{
+		Accepted: len(body_data.Readings) - len(rejected),
+		Rejected: rejected,
+		Session:  session,
+	}
+	if output.Accepted == 0 {
+		c.JSON(http.StatusUnprocessableEntity, output)
+		return
+	}
+	c.JSON(http.StatusOK, output)
+}
+
+// Get a session's readings averaged into time buckets. Buckets widen as
+// needed to stay under MAX_TELEMETRY_POINTS. Drivers see their own sessions,
+// hosts and staff those at their stations.
+func HandleGetSessionTelemetry(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[SessionTelemetryInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.BucketSeconds < 0 {
+		c.JSON(http.StatusBadRequest, "bucket_seconds can't be negative")
+		return
+	}
+
+	session, err := GetOne[Session](SESSION_COLL, bson.D{{"_id", body_data.SessionID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such session found")
+		return
+	}
+	if session.UserID != user_id {
+		charger, err := GetCharger(bson.D{{"_id", session.ChargerID}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		_, err = AuthorizeStation(user_id, charger.StationID, PERM_VIEW_STATION)
+		if err != nil {
+			RespondStationAuthError(c, err)
+			return
+		}
+	}
+
+	end := time.Now().Unix()
+	if session.EndTimestamp != 0 {
+		end = session.EndTimestamp
+	}
+	span := max(end-session.StartTimestamp, 1)
+	bucket_seconds := max(body_data.BucketSeconds, (span+MAX_TELEMETRY_POINTS-1)/MAX_TELEMETRY_POINTS, 1)
+
+	points, err := Aggregate[TelemetryPoint](SESSION_METER_COLL, bson.A{
+		bson.D{{"$match", bson.D{{"meta.session_id", session.ID}}}},
+		bson.D{{"$sort", bson.D{{"recorded_at", 1}}}},
+		bson.D{{"$group", bson.D{
+			{"_id", bson.D{{"$dateTrunc", bson.D{
+				{"date", "$recorded_at"},
+				{"unit", "second"},
+				{"binSize", bucket_seconds},
+			}}}},
+			{"energy_wh", bson.D{{"$last", "$energy_wh"}}},
+			{"power_kw", bson.D{{"$avg", "$power_kw"}}},
+			{"max_power_kw", bson.D{{"$max", "$power_kw"}}},
+			{"voltage", bson.D{{"$avg", "$voltage"}}},
+			{"current", bson.D{{"$avg", "$current"}}},
+			{"state_of_charge", bson.D{{"$max", "$state_of_charge"}}},
+			{"readings", bson.D{{"$sum", 1}}},
+		}}},
+		bson.D{{"$sort", bson.D{{"_id", 1}}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, SessionTelemetryOutput{
+		Session:       session,
+		BucketSeconds: bucket_seconds,
+		Points:        points,
+	})
+}
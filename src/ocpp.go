@@ -0,0 +1,623 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Each charger is one OCPP charge point, connecting to /ocpp/<charger id> with
+// HTTP basic auth: the charger id as username and its OCPP key as password.
+// Connector ids are accepted but not told apart. Id tags are issued per user
+// (see ocpp_idtag.go), which is also what RemoteStartTransaction sends.
+
+const DEFAULT_OCPP_HEARTBEAT_SECONDS = 300
+const OCPP_TRANSACTION_COUNTER = "ocpp_transaction_id"
+const OCPP_ENERGY_MEASURAND = "Energy.Active.Import.Register"
+const OCPP_POWER_MEASURAND = "Power.Active.Import"
+const OCPP_VOLTAGE_MEASURAND = "Voltage"
+const OCPP_CURRENT_MEASURAND = "Current.Import"
+const OCPP_SOC_MEASURAND = "SoC"
+
+var ocpp_heartbeat_seconds int64 = DEFAULT_OCPP_HEARTBEAT_SECONDS
+
+func InitOCPPConfig() {
+	ocpp_heartbeat_seconds = ReadEnvInt64("OCPP_HEARTBEAT_SECONDS", DEFAULT_OCPP_HEARTBEAT_SECONDS)
+}
+
+// OCPP connector statuses mapped onto charger statuses. Preparing is left
+// out, since the charger only becomes in use once the transaction starts, and
+// Unavailable, since maintenance is the owner's to set.
+var ocpp_charger_statuses = map[string]string{
+	"Available":     CHARGER_AVAILABLE,
+	"Charging":      CHARGER_IN_USE,
+	"SuspendedEV":   CHARGER_IN_USE,
+	"SuspendedEVSE": CHARGER_IN_USE,
+	"Finishing":     CHARGER_IN_USE,
+	"Reserved":      CHARGER_RESERVED,
+	"Faulted":       CHARGER_OUT_OF_ORDER,
+}
+
+// statuses a charge point may move a charger out of. out of order and
+// maintenance come from owners, fault reports and maintenance windows, so a
+// charge point announcing Available on every reconnect can't undo them.
+var ocpp_managed_statuses = map[string]bool{
+	CHARGER_AVAILABLE: true,
+	CHARGER_IN_USE:    true,
+	CHARGER_RESERVED:  true,
+}
+
+// statuses a charge point may move a charger to the given status from.
+func OCPPStatusesLeadingTo(to string) []string {
+	from := []string{}
+	for _, status := range StatusesLeadingTo(to) {
+		if ocpp_managed_statuses[status] {
+			from = append(from, status)
+		}
+	}
+	return from
+}
+
+var ocpp_upgrader = websocket.Upgrader{
+	Subprotocols: []string{OCPP_SUBPROTOCOL},
+	CheckOrigin: func(r *http.Request) bool {
+		return true // charge points aren't browsers.
+	},
+}
+
+type ChargePoint struct {
+	*OCPPPeer
+	ChargerID primitive.ObjectID
+	Store     ChargePointStore
+}
+
+// connected charge points by charger id.
+var charge_points = map[primitive.ObjectID]*ChargePoint{}
+var charge_points_mu sync.Mutex
+
+func GetChargePoint(charger_id primitive.ObjectID) *ChargePoint {
+	charge_points_mu.Lock()
+	defer charge_points_mu.Unlock()
+	return charge_points[charger_id]
+}
+
+func HandleOCPPConnection(c *gin.Context) {
+	charger_id, err := primitive.ObjectIDFromHex(c.Param("charger_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+
+	charger, err := GetCharger(bson.D{
+		{"_id", charger_id},
+		{"is_archived", bson.D{{"$ne", true}}},
+		{"is_decommissioned", bson.D{{"$ne", true}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, key, ok := c.Request.BasicAuth()
+	if !ok || charger.OCPPKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(charger.OCPPKey)) != 1 {
+		c.JSON(http.StatusUnauthorized, "Invalid charge point credentials")
+		return
+	}
+
+	conn, err := ocpp_upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // the upgrader already answered.
+	}
+	if conn.Subprotocol() != OCPP_SUBPROTOCOL {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "ocpp1.6 subprotocol required"))
+		conn.Close()
+		return
+	}
+
+	charge_point := &ChargePoint{ChargerID: charger_id, Store: MongoChargePointStore{}}
+	charge_point.OCPPPeer = NewOCPPPeer(conn, charge_point.HandleCall)
+
+	// a reconnecting charge point replaces its old connection.
+	charge_points_mu.Lock()
+	old := charge_points[charger_id]
+	charge_points[charger_id] = charge_point
+	charge_points_mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	err = charge_point.Run()
+	log.Printf("charge point %s disconnected: %s", charger_id.Hex(), err)
+
+	charge_points_mu.Lock()
+	if charge_points[charger_id] == charge_point {
+		delete(charge_points, charger_id)
+	}
+	charge_points_mu.Unlock()
+	charge_point.Close()
+}
+
+// actions a charge point may call on the central system.
+var ocpp_central_actions = map[string]bool{
+	"BootNotification":   true,
+	"Heartbeat":          true,
+	"StatusNotification": true,
+	"Authorize":          true,
+	"StartTransaction":   true,
+	"StopTransaction":    true,
+	"MeterValues":        true,
+}
+
+func (charge_point *ChargePoint) HandleCall(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+	if !ocpp_central_actions[action] {
+		return nil, &OCPPError{OCPP_NOT_IMPLEMENTED, "Unsupported action " + action}
+	}
+	charge_point.MarkSeen(nil)
+
+	switch action {
+	case "BootNotification":
+		return HandleOCPPCall(payload, charge_point.BootNotification)
+	case "Heartbeat":
+		return OCPPHeartbeatConf{OCPPTimestamp(time.Now())}, nil
+	case "StatusNotification":
+		return HandleOCPPCall(payload, charge_point.StatusNotification)
+	case "Authorize":
+		return HandleOCPPCall(payload, charge_point.Authorize)
+	case "StartTransaction":
+		return HandleOCPPCall(payload, charge_point.StartTransaction)
+	case "StopTransaction":
+		return HandleOCPPCall(payload, charge_point.StopTransaction)
+	case "MeterValues":
+		return HandleOCPPCall(payload, charge_point.MeterValues)
+	}
+	return nil, &OCPPError{OCPP_NOT_IMPLEMENTED, "Unsupported action " + action}
+}
+
+// Decodes a call payload and passes it to handler. Database errors come back
+// as InternalError, so the charge point retries.
+func HandleOCPPCall[T any](payload json.RawMessage, handler func(T) (interface{}, error)) (interface{}, *OCPPError) {
+	var request T
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, &OCPPError{OCPP_FORMATION_VIOLATION, err.Error()}
+	}
+	response, err := handler(request)
+	if err != nil {
+		log.Printf("ocpp call failed: %s", err)
+		return nil, &OCPPError{OCPP_INTERNAL_ERROR, err.Error()}
+	}
+	return response, nil
+}
+
+func (charge_point *ChargePoint) MarkSeen(model *string) {
+	err := charge_point.Store.MarkSeen(charge_point.ChargerID, model)
+	if err != nil {
+		log.Printf("ocpp %s: failed to mark seen: %s", charge_point.ChargerID.Hex(), err)
+	}
+}
+
+func (charge_point *ChargePoint) BootNotification(request OCPPBootNotificationReq) (interface{}, error) {
+	model := request.ChargePointVendor + " " + request.ChargePointModel
+	charge_point.MarkSeen(&model)
+	return OCPPBootNotificationConf{
+		Status:      "Accepted",
+		CurrentTime: OCPPTimestamp(time.Now()),
+		Interval:    ocpp_heartbeat_seconds,
+	}, nil
+}
+
+func (charge_point *ChargePoint) StatusNotification(request OCPPStatusNotificationReq) (interface{}, error) {
+	status, ok := ocpp_charger_statuses[request.Status]
+	if !ok {
+		return struct{}{}, nil
+	}
+
+	_, err := charge_point.Store.TransitionCharger(charge_point.ChargerID, OCPPStatusesLeadingTo(status), status, STATUS_REASON_CHARGE_POINT, nil)
+	if err == ErrInvalidTransition {
+		// already there, or held by the owner.
+		return struct{}{}, nil
+	}
+	return struct{}{}, err
+}
+
+func (charge_point *ChargePoint) Authorize(request OCPPAuthorizeReq) (interface{}, error) {
+	_, is_valid, err := charge_point.Store.IdTagUser(request.IdTag)
+	if err != nil {
+		return nil, err
+	}
+	if !is_valid {
+		return OCPPAuthorizeConf{OCPPIdTagInfo{"Invalid"}}, nil
+	}
+	return OCPPAuthorizeConf{OCPPIdTagInfo{"Accepted"}}, nil
+}
+
+func (charge_point *ChargePoint) StartTransaction(request OCPPStartTransactionReq) (interface{}, error) {
+	rejected := func(status string) (interface{}, error) {
+		return OCPPStartTransactionConf{0, OCPPIdTagInfo{status}}, nil
+	}
+
+	user_id, is_valid, err := charge_point.Store.IdTagUser(request.IdTag)
+	if err != nil {
+		return nil, err
+	}
+	if !is_valid {
+		return rejected("Invalid")
+	}
+
+	charger, err := charge_point.Store.GetCharger(charge_point.ChargerID)
+	if err != nil {
+		return nil, err
+	}
+	// imported chargers can't be billed until the owner sets a price.
+	if charger.PriceUnknown {
+		return rejected("Blocked")
+	}
+	can_access, err := charge_point.Store.CanAccessCharger(charger, user_id)
+	if err != nil {
+		return nil, err
+	}
+	if !can_access {
+		return rejected("Blocked")
+	}
+	maintenance, err := charge_point.Store.MaintenanceConflict(charger.ID)
+	if err != nil {
+		return nil, err
+	}
+	if maintenance != nil {
+		return rejected("Blocked")
+	}
+
+	_, err = charge_point.Store.OpenSession(user_id, charger.ID)
+	if err == nil {
+		return rejected("ConcurrentTx")
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	// the charge point may have reported Charging before starting the
+	// transaction, in which case the charger is in use already.
+	_, err = charge_point.Store.TransitionCharger(charger.ID, session_start_statuses, CHARGER_IN_USE, STATUS_REASON_SESSION_START, &user_id)
+	if err == ErrInvalidTransition && charger.Status != CHARGER_IN_USE {
+		return rejected("Blocked")
+	}
+	if err != nil && err != ErrInvalidTransition {
+		return nil, err
+	}
+
+	transaction_id, err := charge_point.Store.NextTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	err = charge_point.Store.CreateSession(Session{
+		ID:             primitive.NewObjectID(),
+		UserID:         user_id,
+		ChargerID:      charger.ID,
+		StartTimestamp: time.Now().Unix(),
+		EndTimestamp:   0,
+		PaymentAmount:  0,
+		PowerUsed:      0,
+		TransactionID:  transaction_id,
+		MeterStart:     float64(request.MeterStart),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return OCPPStartTransactionConf{transaction_id, OCPPIdTagInfo{"Accepted"}}, nil
+}
+
+func (charge_point *ChargePoint) StopTransaction(request OCPPStopTransactionReq) (interface{}, error) {
+	accepted := OCPPStopTransactionConf{&OCPPIdTagInfo{"Accepted"}}
+
+	session, err := charge_point.Store.OpenTransaction(charge_point.ChargerID, request.TransactionID)
+	if err == mongo.ErrNoDocuments {
+		// a retry of a stop we already handled.
+		return accepted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	charger, err := charge_point.Store.GetCharger(charge_point.ChargerID)
+	if err != nil {
+		return nil, err
+	}
+
+	power_used := math.Max(0, float64(request.MeterStop)-session.MeterStart) / 1000
+	err = charge_point.Store.EndSession(session.ID, power_used, power_used*charger.Price)
+	if err == ErrSessionNotOpen {
+		return accepted, nil // stopped meanwhile.
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = charge_point.Store.TransitionCharger(charger.ID, []string{CHARGER_IN_USE}, CHARGER_AVAILABLE, STATUS_REASON_SESSION_END, &session.UserID)
+	if err != nil && err != ErrInvalidTransition {
+		return nil, err
+	}
+
+	return accepted, nil
+}
+
+// Energy register reading in Wh, if the meter value has one.
+func OCPPEnergyReading(meter_value OCPPMeterValue) (float64, bool) {
+	for _, sample := range meter_value.SampledValue {
+		if sample.Measurand != "" && sample.Measurand != OCPP_ENERGY_MEASURAND {
+			continue
+		}
+		value, err := strconv.ParseFloat(sample.Value, 64)
+		if err != nil {
+			continue
+		}
+		if sample.Unit == "kWh" {
+			value *= 1000
+		}
+		return value, true
+	}
+	return 0, false
+}
+
+// Turns a charge point meter value into a reading. Values the app doesn't
+// track, or can't parse, are left out.
+func OCPPMeterReading(meter_value OCPPMeterValue) (MeterReadingInput, bool) {
+	energy, ok := OCPPEnergyReading(meter_value)
+	if !ok {
+		return MeterReadingInput{}, false
+	}
+	recorded_at, err := time.Parse(time.RFC3339, meter_value.Timestamp)
+	if err != nil {
+		return MeterReadingInput{}, false
+	}
+
+	reading := MeterReadingInput{RecordedAt: recorded_at, EnergyWh: energy}
+	for _, sample := range meter_value.SampledValue {
+		value, err := strconv.ParseFloat(sample.Value, 64)
+		if err != nil {
+			continue
+		}
+		switch sample.Measurand {
+		case OCPP_POWER_MEASURAND:
+			if sample.Unit != "kW" {
+				value /= 1000
+			}
+			reading.PowerKW = &value
+		case OCPP_VOLTAGE_MEASURAND:
+			reading.Voltage = &value
+		case OCPP_CURRENT_MEASURAND:
+			reading.Current = &value
+		case OCPP_SOC_MEASURAND:
+			reading.StateOfCharge = &value
+		}
+	}
+	return reading, true
+}
+
+// Records the readings of a running session. Implausible ones are logged and
+// dropped, since the charge point can't act on a rejection.
+func (charge_point *ChargePoint) MeterValues(request OCPPMeterValuesReq) (interface{}, error) {
+	if request.TransactionID == nil {
+		return struct{}{}, nil
+	}
+
+	session, err := charge_point.Store.OpenTransaction(charge_point.ChargerID, *request.TransactionID)
+	if err == mongo.ErrNoDocuments {
+		return struct{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	charger, err := charge_point.Store.GetCharger(charge_point.ChargerID)
+	if err != nil {
+		return nil, err
+	}
+
+	readings := []MeterReadingInput{}
+	for _, meter_value := range request.MeterValue {
+		reading, ok := OCPPMeterReading(meter_value)
+		if ok {
+			readings = append(readings, reading)
+		}
+	}
+	if len(readings) == 0 {
+		return struct{}{}, nil
+	}
+
+	rejected, err := charge_point.Store.IngestMeterReadings(session, charger, readings)
+	if err != nil {
+		return nil, err
+	}
+	for _, reading := range rejected {
+		log.Printf("ocpp %s: meter value %d rejected: %s", charge_point.ChargerID.Hex(), reading.Index, reading.Reason)
+	}
+	return struct{}{}, nil
+}
+
+// Issue a new OCPP key for a charger. The old key stops working and a charge
+// point connected with it is dropped.
+func HandleRotateOCPPKey(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	key, err := GenInviteToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = UpdateOne(
+		CHARGER_COLL,
+		bson.D{{"_id", charger.ID}},
+		bson.D{{"$set", bson.D{{"ocpp_key", key}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	charge_point := GetChargePoint(charger.ID)
+	if charge_point != nil {
+		charge_point.Close()
+	}
+
+	c.JSON(http.StatusOK, OCPPKeyOutput{charger.ID, "/ocpp/" + charger.ID.Hex(), key})
+}
+
+// Ask a networked charger to start a session for the user. The session
+// itself appears once the charge point starts the transaction.
+func HandleRemoteStartSession(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[NewSessionInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(append(SessionChargerMatch(body_data),
+		bson.E{"is_archived", bson.D{{"$ne", true}}},
+		bson.E{"is_decommissioned", bson.D{{"$ne", true}}},
+	))
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	can_access, err := CanAccessStation(station, user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !can_access {
+		c.JSON(http.StatusForbidden, "This charger is only available to approved guests")
+		return
+	}
+	if charger.Status != CHARGER_AVAILABLE {
+		c.JSON(http.StatusConflict, "This charger is not available")
+		return
+	}
+	if charger.PriceUnknown {
+		c.JSON(http.StatusConflict, "This charger has no price set yet")
+		return
+	}
+	maintenance, err := SessionMaintenanceConflict(charger.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if maintenance != nil {
+		c.JSON(http.StatusConflict, MaintenanceConflictMessage(maintenance))
+		return
+	}
+
+	charge_point := GetChargePoint(charger.ID)
+	if charge_point == nil {
+		c.JSON(http.StatusConflict, "This charger is offline")
+		return
+	}
+
+	id_tag, err := EnsureOCPPIdTag(user_id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var conf OCPPRemoteConf
+	err = charge_point.Call("RemoteStartTransaction", OCPPRemoteStartTransactionReq{1, id_tag.Tag}, &conf)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, err.Error())
+		return
+	}
+	if conf.Status != "Accepted" {
+		c.JSON(http.StatusConflict, "The charger declined to start a session")
+		return
+	}
+
+	c.JSON(http.StatusOK, conf)
+}
+
+// Ask the charger running one of the user's sessions to stop it.
+func HandleRemoteStopSession(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[SessionIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	session, err := GetOne[Session](SESSION_COLL, bson.D{
+		{"_id", body_data.SessionID},
+		{"user_id", user_id},
+		{"end_timestamp", 0},
+		{"transaction_id", bson.D{{"$exists", true}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such session found")
+		return
+	}
+
+	charge_point := GetChargePoint(session.ChargerID)
+	if charge_point == nil {
+		c.JSON(http.StatusConflict, "This charger is offline")
+		return
+	}
+
+	var conf OCPPRemoteConf
+	err = charge_point.Call("RemoteStopTransaction", OCPPRemoteStopTransactionReq{session.TransactionID}, &conf)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, err.Error())
+		return
+	}
+	if conf.Status != "Accepted" {
+		c.JSON(http.StatusConflict, "The charger declined to stop the session")
+		return
+	}
+
+	c.JSON(http.StatusOK, conf)
+}
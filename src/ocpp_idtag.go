@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// OCPP 1.6 id tags are CiString20Type.
+const OCPP_ID_TAG_LENGTH = 20
+const OCPP_ID_TAG_ATTEMPTS = 5
+
+// Issues a new id tag for the user, retrying on the rare collision.
+func CreateOCPPIdTag(user_id primitive.ObjectID) (OCPPIdTag, error) {
+	for attempt := 0; attempt < OCPP_ID_TAG_ATTEMPTS; attempt++ {
+		tag, err := GenCode(OCPP_ID_TAG_LENGTH)
+		if err != nil {
+			return OCPPIdTag{}, err
+		}
+		id_tag := OCPPIdTag{
+			ID:        primitive.NewObjectID(),
+			Tag:       tag,
+			UserID:    user_id,
+			IsRevoked: false,
+			CreatedAt: time.Now(),
+		}
+		_, err = CreateOne(OCPP_ID_TAG_COLL, id_tag)
+		if mongo.IsDuplicateKeyError(err) {
+			// another request may have issued the user's tag meanwhile.
+			existing, get_err := GetOne[OCPPIdTag](OCPP_ID_TAG_COLL, bson.D{
+				{"user_id", user_id},
+				{"is_revoked", false},
+			})
+			if get_err == nil {
+				return existing, nil
+			}
+			continue
+		}
+		return id_tag, err
+	}
+	return OCPPIdTag{}, fmt.Errorf("no free id tag after %d attempts", OCPP_ID_TAG_ATTEMPTS)
+}
+
+// The user's id tag, issued on first use.
+func EnsureOCPPIdTag(user_id primitive.ObjectID) (OCPPIdTag, error) {
+	id_tag, err := GetOne[OCPPIdTag](OCPP_ID_TAG_COLL, bson.D{
+		{"user_id", user_id},
+		{"is_revoked", false},
+	})
+	if err == mongo.ErrNoDocuments {
+		return CreateOCPPIdTag(user_id)
+	}
+	return id_tag, err
+}
+
+// Resolves an id tag to a user.
+func OCPPUser(id_tag string) (primitive.ObjectID, bool, error) {
+	tag, err := GetOne[OCPPIdTag](OCPP_ID_TAG_COLL, bson.D{
+		{"tag", id_tag},
+		{"is_revoked", false},
+	})
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, false, nil
+	}
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	_, err = GetUser(bson.D{{"_id", tag.UserID}})
+	if err == mongo.ErrNoDocuments {
+		return tag.UserID, false, nil
+	}
+	return tag.UserID, err == nil, err
+}
+
+// Get the id tag to program on the user's RFID card.
+func HandleGetOCPPIdTag(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id_tag, err := EnsureOCPPIdTag(user_id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, id_tag)
+}
+
+// Replace the user's id tag, e.g. after losing a card. The old tag stops
+// authorizing right away.
+func HandleRotateOCPPIdTag(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = UpdateMany(
+		OCPP_ID_TAG_COLL,
+		bson.D{
+			{"user_id", user_id},
+			{"is_revoked", false},
+		},
+		bson.D{{"$set", bson.D{
+			{"is_revoked", true},
+			{"revoked_at", time.Now()},
+		}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id_tag, err := CreateOCPPIdTag(user_id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, id_tag)
+}
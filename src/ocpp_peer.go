@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OCPP-J frames are JSON arrays led by one of these message types.
+const OCPP_CALL = 2
+const OCPP_CALL_RESULT = 3
+const OCPP_CALL_ERROR = 4
+
+const OCPP_SUBPROTOCOL = "ocpp1.6"
+const OCPP_CALL_TIMEOUT = 30 * time.Second
+
+// OCPP-J error codes used here.
+const OCPP_NOT_IMPLEMENTED = "NotImplemented"
+const OCPP_FORMATION_VIOLATION = "FormationViolation"
+const OCPP_INTERNAL_ERROR = "InternalError"
+
+type OCPPError struct {
+	Code        string
+	Description string
+}
+
+func (err *OCPPError) Error() string {
+	return err.Code + ": " + err.Description
+}
+
+type OCPPResult struct {
+	Payload json.RawMessage
+	Err     error
+}
+
+// one end of an OCPP-J connection, used by the central system and by the
+// simulated charge point alike. calls from the other end go to handle_call,
+// which runs on the read loop and so must not wait on calls of its own.
+type OCPPPeer struct {
+	conn        *websocket.Conn
+	write_mu    sync.Mutex
+	pending_mu  sync.Mutex
+	pending     map[string]chan OCPPResult
+	handle_call func(action string, payload json.RawMessage) (interface{}, *OCPPError)
+}
+
+var ErrOCPPClosed = errors.New("connection closed")
+var ErrOCPPTimeout = errors.New("no answer from the other end")
+
+func NewOCPPPeer(conn *websocket.Conn, handle_call func(string, json.RawMessage) (interface{}, *OCPPError)) *OCPPPeer {
+	return &OCPPPeer{
+		conn:        conn,
+		pending:     map[string]chan OCPPResult{},
+		handle_call: handle_call,
+	}
+}
+
+func (peer *OCPPPeer) send(frame []interface{}) error {
+	peer.write_mu.Lock()
+	defer peer.write_mu.Unlock()
+	return peer.conn.WriteJSON(frame)
+}
+
+// Reads frames until the connection drops, answering calls and resolving
+// pending ones.
+func (peer *OCPPPeer) Run() error {
+	defer func() {
+		peer.pending_mu.Lock()
+		for id, result := range peer.pending {
+			result <- OCPPResult{Err: ErrOCPPClosed}
+			delete(peer.pending, id)
+		}
+		peer.pending_mu.Unlock()
+	}()
+
+	for {
+		_, data, err := peer.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		frame := []json.RawMessage{}
+		var message_type int
+		var message_id string
+		if json.Unmarshal(data, &frame) != nil || len(frame) < 3 ||
+			json.Unmarshal(frame[0], &message_type) != nil || json.Unmarshal(frame[1], &message_id) != nil {
+			// without a message id there is nothing to answer.
+			continue
+		}
+
+		switch message_type {
+		case OCPP_CALL:
+			var action string
+			var response interface{}
+			ocpp_err := &OCPPError{OCPP_FORMATION_VIOLATION, "Malformed call"}
+			if len(frame) == 4 && json.Unmarshal(frame[2], &action) == nil {
+				response, ocpp_err = peer.handle_call(action, frame[3])
+			}
+			if ocpp_err != nil {
+				err = peer.send([]interface{}{OCPP_CALL_ERROR, message_id, ocpp_err.Code, ocpp_err.Description, struct{}{}})
+			} else {
+				err = peer.send([]interface{}{OCPP_CALL_RESULT, message_id, response})
+			}
+			if err != nil {
+				return err
+			}
+
+		case OCPP_CALL_RESULT, OCPP_CALL_ERROR:
+			peer.pending_mu.Lock()
+			result, ok := peer.pending[message_id]
+			delete(peer.pending, message_id)
+			peer.pending_mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			if message_type == OCPP_CALL_RESULT {
+				result <- OCPPResult{Payload: frame[2]}
+			} else {
+				ocpp_err := &OCPPError{}
+				json.Unmarshal(frame[2], &ocpp_err.Code)
+				if len(frame) > 3 {
+					json.Unmarshal(frame[3], &ocpp_err.Description)
+				}
+				result <- OCPPResult{Err: ocpp_err}
+			}
+		}
+	}
+}
+
+// Sends a call and waits for its result, decoding it into response.
+func (peer *OCPPPeer) Call(action string, request interface{}, response interface{}) error {
+	id_bytes := make([]byte, 8)
+	_, err := rand.Read(id_bytes)
+	if err != nil {
+		return err
+	}
+	message_id := hex.EncodeToString(id_bytes)
+
+	result := make(chan OCPPResult, 1)
+	peer.pending_mu.Lock()
+	peer.pending[message_id] = result
+	peer.pending_mu.Unlock()
+
+	err = peer.send([]interface{}{OCPP_CALL, message_id, action, request})
+	if err != nil {
+		peer.pending_mu.Lock()
+		delete(peer.pending, message_id)
+		peer.pending_mu.Unlock()
+		return err
+	}
+
+	select {
+	case answer := <-result:
+		if answer.Err != nil {
+			return answer.Err
+		}
+		return json.Unmarshal(answer.Payload, response)
+	case <-time.After(OCPP_CALL_TIMEOUT):
+		peer.pending_mu.Lock()
+		delete(peer.pending, message_id)
+		peer.pending_mu.Unlock()
+		return ErrOCPPTimeout
+	}
+}
+
+func (peer *OCPPPeer) Close() error {
+	return peer.conn.Close()
+}
+
+func OCPPTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
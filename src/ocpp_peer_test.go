@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Serves OCPP peers answering calls with handle_call. Every connection's peer
+// is sent on the returned channel once it runs.
+func ServeTestPeers(t *testing.T, handle_call func(string, json.RawMessage) (interface{}, *OCPPError)) (string, chan *OCPPPeer) {
+	peers := make(chan *OCPPPeer, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ocpp_upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		peer := NewOCPPPeer(conn, handle_call)
+		peers <- peer
+		peer.Run()
+		peer.Close()
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), peers
+}
+
+func DialTestConn(t *testing.T, url string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{OCPP_SUBPROTOCOL}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// A connected pair of peers, the client one already running.
+func ConnectTestPeers(t *testing.T, server_handle func(string, json.RawMessage) (interface{}, *OCPPError), client_handle func(string, json.RawMessage) (interface{}, *OCPPError)) (*OCPPPeer, *OCPPPeer) {
+	url, peers := ServeTestPeers(t, server_handle)
+	client := NewOCPPPeer(DialTestConn(t, url), client_handle)
+	go client.Run()
+	return <-peers, client
+}
+
+func NotImplementedHandler(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+	return nil, &OCPPError{OCPP_NOT_IMPLEMENTED, "Unsupported action " + action}
+}
+
+type testEcho struct {
+	Action string `json:"action"`
+	Value  int    `json:"value"`
+}
+
+func EchoHandler(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+	var request testEcho
+	if json.Unmarshal(payload, &request) != nil {
+		return nil, &OCPPError{OCPP_FORMATION_VIOLATION, "Malformed echo"}
+	}
+	return testEcho{action, request.Value}, nil
+}
+
+func TestOCPPPeerCallResult(t *testing.T) {
+	server, client := ConnectTestPeers(t, EchoHandler, EchoHandler)
+
+	var response testEcho
+	err := client.Call("Echo", testEcho{Value: 7}, &response)
+	if err != nil {
+		t.Fatalf("client call failed: %s", err)
+	}
+	if response != (testEcho{"Echo", 7}) {
+		t.Errorf("client got %+v", response)
+	}
+
+	// calls go both ways over the same connection.
+	err = server.Call("Reverse", testEcho{Value: 9}, &response)
+	if err != nil {
+		t.Fatalf("server call failed: %s", err)
+	}
+	if response != (testEcho{"Reverse", 9}) {
+		t.Errorf("server got %+v", response)
+	}
+}
+
+func TestOCPPPeerCallError(t *testing.T) {
+	_, client := ConnectTestPeers(t, func(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+		return nil, &OCPPError{OCPP_INTERNAL_ERROR, "database down"}
+	}, NotImplementedHandler)
+
+	err := client.Call("Heartbeat", struct{}{}, &struct{}{})
+	var ocpp_err *OCPPError
+	if !errors.As(err, &ocpp_err) {
+		t.Fatalf("expected an OCPPError, got %v", err)
+	}
+	if ocpp_err.Code != OCPP_INTERNAL_ERROR || ocpp_err.Description != "database down" {
+		t.Errorf("got %+v", ocpp_err)
+	}
+}
+
+func TestOCPPPeerUnknownAction(t *testing.T) {
+	_, client := ConnectTestPeers(t, NotImplementedHandler, NotImplementedHandler)
+
+	err := client.Call("DataTransfer", struct{}{}, &struct{}{})
+	var ocpp_err *OCPPError
+	if !errors.As(err, &ocpp_err) || ocpp_err.Code != OCPP_NOT_IMPLEMENTED {
+		t.Fatalf("expected NotImplemented, got %v", err)
+	}
+}
+
+// Frames as they go over the wire, seen from a charge point without a peer.
+func TestOCPPPeerFraming(t *testing.T) {
+	url, _ := ServeTestPeers(t, EchoHandler)
+	conn := DialTestConn(t, url)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read_frame := func() []json.RawMessage {
+		t.Helper()
+		frame := []json.RawMessage{}
+		err := conn.ReadJSON(&frame)
+		if err != nil {
+			t.Fatalf("no frame: %s", err)
+		}
+		return frame
+	}
+	assert_string := func(raw json.RawMessage, expected string) {
+		t.Helper()
+		var value string
+		if json.Unmarshal(raw, &value) != nil || value != expected {
+			t.Errorf("expected %q, got %s", expected, raw)
+		}
+	}
+
+	// a call is answered with a result carrying its message id.
+	conn.WriteMessage(websocket.TextMessage, []byte(`[2,"call-1","Echo",{"value":3}]`))
+	frame := read_frame()
+	if len(frame) != 3 || string(frame[0]) != "3" {
+		t.Fatalf("expected a CALLRESULT, got %s", frame)
+	}
+	assert_string(frame[1], "call-1")
+	var response testEcho
+	json.Unmarshal(frame[2], &response)
+	if response != (testEcho{"Echo", 3}) {
+		t.Errorf("got %+v", response)
+	}
+
+	// a call without a payload is answered with an error.
+	conn.WriteMessage(websocket.TextMessage, []byte(`[2,"call-2","Echo"]`))
+	frame = read_frame()
+	if len(frame) != 5 || string(frame[0]) != "4" {
+		t.Fatalf("expected a CALLERROR, got %s", frame)
+	}
+	assert_string(frame[1], "call-2")
+	assert_string(frame[2], OCPP_FORMATION_VIOLATION)
+
+	// frames without a message id can't be answered and are dropped, so the
+	// next answer is for the next call.
+	conn.WriteMessage(websocket.TextMessage, []byte(`not json`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`[2]`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`[2,"call-3","Echo",{"value":4}]`))
+	frame = read_frame()
+	assert_string(frame[1], "call-3")
+
+	// results nobody waits for are ignored as well.
+	conn.WriteMessage(websocket.TextMessage, []byte(`[3,"unknown",{}]`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`[2,"call-4","Echo",{"value":5}]`))
+	frame = read_frame()
+	assert_string(frame[1], "call-4")
+}
+
+func TestOCPPPeerClosedWhileWaiting(t *testing.T) {
+	// the server side never answers, it hangs up once the call arrived.
+	received := make(chan struct{})
+	release := make(chan struct{})
+	url, peers := ServeTestPeers(t, func(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+		close(received)
+		<-release
+		return struct{}{}, nil
+	})
+	t.Cleanup(func() { close(release) })
+
+	client := NewOCPPPeer(DialTestConn(t, url), NotImplementedHandler)
+	done := make(chan error, 1)
+	go func() { done <- client.Run() }()
+
+	server := <-peers
+	result := make(chan error, 1)
+	go func() { result <- client.Call("Heartbeat", struct{}{}, &struct{}{}) }()
+	<-received
+	server.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrOCPPClosed {
+			t.Errorf("expected ErrOCPPClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call still waiting after the connection closed")
+	}
+	<-done
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A simulated charge point, for exercising the central system end to end:
+//
+//	hello simulate-charge-point -url ws://localhost:8083/ocpp/<charger id> -charger <charger id> -key <ocpp key> -id-tag <id tag>
+//
+// It boots, runs one transaction and stops, failing loudly on any answer the
+// central system shouldn't give. With -remote it waits for the app to send
+// RemoteStartTransaction, and charges until RemoteStopTransaction arrives.
+// Tests run the same session against the real charge point handlers.
+
+const SIMULATOR_METER_INTERVAL = 2 * time.Second
+const SIMULATOR_METER_SAMPLES = 5
+
+type SimulatedChargePoint struct {
+	*OCPPPeer
+	remote_start chan string
+	remote_stop  chan int64
+}
+
+func (sim *SimulatedChargePoint) HandleCall(action string, payload json.RawMessage) (interface{}, *OCPPError) {
+	switch action {
+	case "RemoteStartTransaction":
+		var request OCPPRemoteStartTransactionReq
+		if json.Unmarshal(payload, &request) != nil {
+			return nil, &OCPPError{OCPP_FORMATION_VIOLATION, "Malformed RemoteStartTransaction"}
+		}
+		select {
+		case sim.remote_start <- request.IdTag:
+			return OCPPRemoteConf{"Accepted"}, nil
+		default:
+			return OCPPRemoteConf{"Rejected"}, nil
+		}
+	case "RemoteStopTransaction":
+		var request OCPPRemoteStopTransactionReq
+		if json.Unmarshal(payload, &request) != nil {
+			return nil, &OCPPError{OCPP_FORMATION_VIOLATION, "Malformed RemoteStopTransaction"}
+		}
+		select {
+		case sim.remote_stop <- request.TransactionID:
+			return OCPPRemoteConf{"Accepted"}, nil
+		default:
+			return OCPPRemoteConf{"Rejected"}, nil
+		}
+	}
+	return nil, &OCPPError{OCPP_NOT_IMPLEMENTED, "Unsupported action " + action}
+}
+
+func NewSimulatedChargePoint(conn *websocket.Conn) *SimulatedChargePoint {
+	sim := &SimulatedChargePoint{
+		remote_start: make(chan string),
+		remote_stop:  make(chan int64),
+	}
+	sim.OCPPPeer = NewOCPPPeer(conn, sim.HandleCall)
+	return sim
+}
+
+// Like Call, but logs the answer and names the action in errors.
+func (sim *SimulatedChargePoint) LoggedCall(action string, request interface{}, response interface{}) error {
+	err := sim.Call(action, request, response)
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", action, err)
+	}
+	log.Printf("%s: %+v", action, response)
+	return nil
+}
+
+func (sim *SimulatedChargePoint) SendStatus(status string) error {
+	return sim.LoggedCall("StatusNotification", OCPPStatusNotificationReq{
+		ConnectorID: 1,
+		ErrorCode:   "NoError",
+		Status:      status,
+		Timestamp:   OCPPTimestamp(time.Now()),
+	}, &struct{}{})
+}
+
+type SimulatorOptions struct {
+	IdTag    string  // ignored with Remote, the central system sends one
+	PowerKW  float64 // delivered while charging
+	Remote   bool    // wait for RemoteStartTransaction, and charge until RemoteStopTransaction
+	Samples  int     // meter values sent when not Remote
+	Interval time.Duration
+}
+
+type SimulatorResult struct {
+	TransactionID int64
+	EnergyWh      int64
+}
+
+// Boots, runs one transaction and checks every answer along the way,
+// including that a second start and an unknown action are refused.
+func (sim *SimulatedChargePoint) RunSession(opts SimulatorOptions) (SimulatorResult, error) {
+	result := SimulatorResult{}
+
+	var boot OCPPBootNotificationConf
+	err := sim.LoggedCall("BootNotification", OCPPBootNotificationReq{
+		ChargePointVendor: "GoCharge",
+		ChargePointModel:  "Simulator",
+	}, &boot)
+	if err != nil {
+		return result, err
+	}
+	if boot.Status != "Accepted" || boot.Interval <= 0 {
+		return result, errors.New("boot not accepted")
+	}
+	err = sim.LoggedCall("Heartbeat", struct{}{}, &OCPPHeartbeatConf{})
+	if err != nil {
+		return result, err
+	}
+	err = sim.SendStatus("Available")
+	if err != nil {
+		return result, err
+	}
+
+	id_tag := opts.IdTag
+	if opts.Remote {
+		log.Print("waiting for RemoteStartTransaction")
+		id_tag = <-sim.remote_start
+	}
+
+	var authorize OCPPAuthorizeConf
+	err = sim.LoggedCall("Authorize", OCPPAuthorizeReq{id_tag}, &authorize)
+	if err != nil {
+		return result, err
+	}
+	if authorize.IdTagInfo.Status != "Accepted" {
+		return result, fmt.Errorf("id tag %s not accepted: %s", id_tag, authorize.IdTagInfo.Status)
+	}
+
+	err = sim.SendStatus("Preparing")
+	if err != nil {
+		return result, err
+	}
+	meter := int64(0)
+	var start OCPPStartTransactionConf
+	err = sim.LoggedCall("StartTransaction", OCPPStartTransactionReq{
+		ConnectorID: 1,
+		IdTag:       id_tag,
+		MeterStart:  meter,
+		Timestamp:   OCPPTimestamp(time.Now()),
+	}, &start)
+	if err != nil {
+		return result, err
+	}
+	if start.IdTagInfo.Status != "Accepted" || start.TransactionID == 0 {
+		return result, fmt.Errorf("transaction not started: %s", start.IdTagInfo.Status)
+	}
+	result.TransactionID = start.TransactionID
+
+	// a second start for the same user has to be refused.
+	var second_start OCPPStartTransactionConf
+	err = sim.LoggedCall("StartTransaction", OCPPStartTransactionReq{
+		ConnectorID: 1,
+		IdTag:       id_tag,
+		MeterStart:  meter,
+		Timestamp:   OCPPTimestamp(time.Now()),
+	}, &second_start)
+	if err != nil {
+		return result, err
+	}
+	if second_start.IdTagInfo.Status == "Accepted" {
+		return result, errors.New("concurrent transaction accepted")
+	}
+
+	err = sim.SendStatus("Charging")
+	if err != nil {
+		return result, err
+	}
+
+	// readings must not rise faster than a charger can deliver.
+	step := int64(opts.PowerKW * 1000 * opts.Interval.Hours())
+	for sample := 0; opts.Remote || sample < opts.Samples; sample++ {
+		stopped := false
+		select {
+		case transaction_id := <-sim.remote_stop:
+			if transaction_id != start.TransactionID {
+				return result, fmt.Errorf("asked to stop transaction %d, running %d", transaction_id, start.TransactionID)
+			}
+			stopped = true
+		case <-time.After(opts.Interval):
+		}
+		if stopped {
+			break
+		}
+
+		meter += step
+		err = sim.LoggedCall("MeterValues", OCPPMeterValuesReq{
+			ConnectorID:   1,
+			TransactionID: &start.TransactionID,
+			MeterValue: []OCPPMeterValue{{
+				Timestamp: OCPPTimestamp(time.Now()),
+				SampledValue: []OCPPSampledValue{
+					{
+						Value:     strconv.FormatInt(meter, 10),
+						Measurand: OCPP_ENERGY_MEASURAND,
+						Unit:      "Wh",
+					},
+					{
+						Value:     strconv.FormatFloat(opts.PowerKW, 'f', 1, 64),
+						Measurand: OCPP_POWER_MEASURAND,
+						Unit:      "kW",
+					},
+				},
+			}},
+		}, &struct{}{})
+		if err != nil {
+			return result, err
+		}
+	}
+	result.EnergyWh = meter
+
+	err = sim.SendStatus("Finishing")
+	if err != nil {
+		return result, err
+	}
+	var stop OCPPStopTransactionConf
+	err = sim.LoggedCall("StopTransaction", OCPPStopTransactionReq{
+		TransactionID: start.TransactionID,
+		IdTag:         id_tag,
+		MeterStop:     meter,
+		Timestamp:     OCPPTimestamp(time.Now()),
+		Reason:        "Local",
+	}, &stop)
+	if err != nil {
+		return result, err
+	}
+	if stop.IdTagInfo != nil && stop.IdTagInfo.Status != "Accepted" {
+		return result, fmt.Errorf("transaction not stopped: %s", stop.IdTagInfo.Status)
+	}
+	err = sim.SendStatus("Available")
+	if err != nil {
+		return result, err
+	}
+
+	// unknown actions must be refused rather than dropped.
+	err = sim.Call("DataTransfer", struct{}{}, &struct{}{})
+	ocpp_err, ok := err.(*OCPPError)
+	if !ok || ocpp_err.Code != OCPP_NOT_IMPLEMENTED {
+		return result, fmt.Errorf("unsupported action answered with %v", err)
+	}
+
+	return result, nil
+}
+
+func RunChargePointSimulator(args []string) {
+	flags := flag.NewFlagSet("simulate-charge-point", flag.ExitOnError)
+	url := flags.String("url", "", "websocket url of the charger, ending in /ocpp/<charger id>")
+	charger := flags.String("charger", "", "charger id, sent as the basic auth username")
+	key := flags.String("key", "", "the charger's OCPP key")
+	id_tag := flags.String("id-tag", "", "id tag to charge as, from /user/ocpp-id-tag, unless -remote is set")
+	power := flags.Float64("power", 7.4, "kW delivered while charging")
+	remote := flags.Bool("remote", false, "wait for the app to start and stop the session")
+	flags.Parse(args)
+
+	if *url == "" || *charger == "" || *key == "" || (*id_tag == "" && !*remote) {
+		flags.Usage()
+		log.Fatal("-url, -charger, -key and -id-tag or -remote are required")
+	}
+
+	header := http.Header{}
+	credentials := base64.StdEncoding.EncodeToString([]byte(*charger + ":" + *key))
+	header.Set("Authorization", "Basic "+credentials)
+	dialer := websocket.Dialer{Subprotocols: []string{OCPP_SUBPROTOCOL}}
+	conn, _, err := dialer.Dial(*url, header)
+	if err != nil {
+		log.Fatalf("could not connect: %s", err)
+	}
+
+	sim := NewSimulatedChargePoint(conn)
+	go func() {
+		log.Printf("connection closed: %s", sim.Run())
+	}()
+	defer sim.Close()
+
+	result, err := sim.RunSession(SimulatorOptions{
+		IdTag:    *id_tag,
+		PowerKW:  *power,
+		Remote:   *remote,
+		Samples:  SIMULATOR_METER_SAMPLES,
+		Interval: SIMULATOR_METER_INTERVAL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("simulated session done: transaction %d, %d Wh", result.TransactionID, result.EnergyWh)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const TEST_ID_TAG = "TESTTAG0000000000001"
+const TEST_PRICE = 0.5
+
+// A charge point store kept in memory for a single charger, so the real
+// OCPP handlers can run without a database.
+type TestChargePointStore struct {
+	mu           sync.Mutex
+	charger      Charger
+	can_access   bool
+	maintenance  *MaintenanceWindow
+	id_tags      map[string]primitive.ObjectID
+	sessions     []Session
+	statuses     []string // every status the charger was moved to
+	readings     []MeterReadingInput
+	model        string
+	transactions int64
+}
+
+func NewTestChargePointStore(status string) (*TestChargePointStore, primitive.ObjectID) {
+	user_id := primitive.NewObjectID()
+	store := &TestChargePointStore{
+		charger: Charger{
+			ID:        primitive.NewObjectID(),
+			StationID: primitive.NewObjectID(),
+			Status:    status,
+			Price:     TEST_PRICE,
+		},
+		can_access: true,
+		id_tags:    map[string]primitive.ObjectID{TEST_ID_TAG: user_id},
+	}
+	return store, user_id
+}
+
+func (store *TestChargePointStore) MarkSeen(charger_id primitive.ObjectID, model *string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if model != nil {
+		store.model = *model
+	}
+	return nil
+}
+
+func (store *TestChargePointStore) IdTagUser(id_tag string) (primitive.ObjectID, bool, error) {
+	user_id, ok := store.id_tags[id_tag]
+	return user_id, ok, nil
+}
+
+func (store *TestChargePointStore) GetCharger(charger_id primitive.ObjectID) (Charger, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if charger_id != store.charger.ID {
+		return Charger{}, mongo.ErrNoDocuments
+	}
+	return store.charger, nil
+}
+
+func (store *TestChargePointStore) CanAccessCharger(charger Charger, user_id primitive.ObjectID) (bool, error) {
+	return store.can_access, nil
+}
+
+func (store *TestChargePointStore) MaintenanceConflict(charger_id primitive.ObjectID) (*MaintenanceWindow, error) {
+	return store.maintenance, nil
+}
+
+func (store *TestChargePointStore) OpenSession(user_id primitive.ObjectID, charger_id primitive.ObjectID) (Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, session := range store.sessions {
+		if session.EndTimestamp == 0 && (session.UserID == user_id || session.ChargerID == charger_id) {
+			return session, nil
+		}
+	}
+	return Session{}, mongo.ErrNoDocuments
+}
+
+func (store *TestChargePointStore) OpenTransaction(charger_id primitive.ObjectID, transaction_id int64) (Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, session := range store.sessions {
+		if session.EndTimestamp == 0 && session.ChargerID == charger_id && session.TransactionID == transaction_id {
+			return session, nil
+		}
+	}
+	return Session{}, mongo.ErrNoDocuments
+}
+
+func (store *TestChargePointStore) TransitionCharger(charger_id primitive.ObjectID, from []string, to string, reason string, changed_by *primitive.ObjectID) (Charger, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	before := store.charger
+	for _, status := range from {
+		if charger_id == before.ID && status == before.Status {
+			store.charger.Status = to
+			store.statuses = append(store.statuses, to)
+			return before, nil
+		}
+	}
+	return before, ErrInvalidTransition
+}
+
+func (store *TestChargePointStore) NextTransactionID() (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.transactions++
+	return store.transactions, nil
+}
+
+func (store *TestChargePointStore) CreateSession(session Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.sessions = append(store.sessions, session)
+	return nil
+}
+
+func (store *TestChargePointStore) EndSession(session_id primitive.ObjectID, power_used float64, payment_amount float64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i, session := range store.sessions {
+		if session.ID == session_id && session.EndTimestamp == 0 {
+			store.sessions[i].PowerUsed = power_used
+			store.sessions[i].PaymentAmount = payment_amount
+			store.sessions[i].EndTimestamp = time.Now().Unix()
+			return nil
+		}
+	}
+	return ErrSessionNotOpen
+}
+
+func (store *TestChargePointStore) IngestMeterReadings(session Session, charger Charger, readings []MeterReadingInput) ([]RejectedReading, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.readings = append(store.readings, readings...)
+	return []RejectedReading{}, nil
+}
+
+func (store *TestChargePointStore) Status() string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.charger.Status
+}
+
+func (store *TestChargePointStore) Readings() []MeterReadingInput {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]MeterReadingInput{}, store.readings...)
+}
+
+// Serves a charge point backed by store and connects a simulator to it.
+func StartTestSimulator(t *testing.T, store *TestChargePointStore) (*ChargePoint, *SimulatedChargePoint) {
+	charge_point := &ChargePoint{ChargerID: store.charger.ID, Store: store}
+	url, peers := ServeTestPeers(t, charge_point.HandleCall)
+	sim := NewSimulatedChargePoint(DialTestConn(t, url))
+	go sim.Run()
+	charge_point.OCPPPeer = <-peers
+	return charge_point, sim
+}
+
+func CheckSimulatedSession(t *testing.T, store *TestChargePointStore, user_id primitive.ObjectID, result SimulatorResult) {
+	t.Helper()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if result.TransactionID != 1 {
+		t.Errorf("transaction %d, expected 1", result.TransactionID)
+	}
+	// Available on boot changes nothing, Charging and Finishing follow the
+	// transaction start.
+	expected_statuses := []string{CHARGER_IN_USE, CHARGER_AVAILABLE}
+	if !reflect.DeepEqual(store.statuses, expected_statuses) {
+		t.Errorf("statuses %v, expected %v", store.statuses, expected_statuses)
+	}
+	if store.model != "GoCharge Simulator" {
+		t.Errorf("model %q", store.model)
+	}
+
+	// the second start was refused, so there's a single session.
+	if len(store.sessions) != 1 {
+		t.Fatalf("%d sessions, expected 1", len(store.sessions))
+	}
+	session := store.sessions[0]
+	if session.UserID != user_id || session.ChargerID != store.charger.ID || session.TransactionID != result.TransactionID {
+		t.Errorf("session %+v", session)
+	}
+	if session.EndTimestamp == 0 {
+		t.Error("session left open")
+	}
+	power_used := float64(result.EnergyWh) / 1000
+	if session.PowerUsed != power_used || math.Abs(session.PaymentAmount-power_used*TEST_PRICE) > 1e-9 {
+		t.Errorf("session used %v kWh for %v, expected %v kWh", session.PowerUsed, session.PaymentAmount, power_used)
+	}
+
+	if len(store.readings) == 0 {
+		t.Fatal("no meter values received")
+	}
+	for i, reading := range store.readings {
+		if reading.PowerKW == nil {
+			t.Errorf("reading %d has no power", i)
+		}
+		if i > 0 && reading.EnergyWh <= store.readings[i-1].EnergyWh {
+			t.Errorf("energy went from %v to %v", store.readings[i-1].EnergyWh, reading.EnergyWh)
+		}
+	}
+	if last := store.readings[len(store.readings)-1].EnergyWh; last != float64(result.EnergyWh) {
+		t.Errorf("last reading %v Wh, simulator stopped at %d Wh", last, result.EnergyWh)
+	}
+}
+
+func TestSimulatedSession(t *testing.T) {
+	store, user_id := NewTestChargePointStore(CHARGER_AVAILABLE)
+	_, sim := StartTestSimulator(t, store)
+
+	result, err := sim.RunSession(SimulatorOptions{
+		IdTag:    TEST_ID_TAG,
+		PowerKW:  36000, // 100 Wh every 10ms
+		Samples:  3,
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CheckSimulatedSession(t, store, user_id, result)
+	if len(store.Readings()) != 3 || result.EnergyWh != 300 {
+		t.Errorf("%d readings and %d Wh, expected 3 and 300", len(store.Readings()), result.EnergyWh)
+	}
+}
+
+func TestSimulatedSessionRejectedIdTag(t *testing.T) {
+	store, _ := NewTestChargePointStore(CHARGER_AVAILABLE)
+	_, sim := StartTestSimulator(t, store)
+
+	_, err := sim.RunSession(SimulatorOptions{
+		IdTag:    "UNKNOWN",
+		PowerKW:  36000,
+		Samples:  1,
+		Interval: 10 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("session ran with an unknown id tag")
+	}
+	if len(store.sessions) != 0 || store.Status() != CHARGER_AVAILABLE {
+		t.Errorf("%d sessions and charger %s after an unknown id tag", len(store.sessions), store.Status())
+	}
+}
+
+// Calls the charge point until it accepts, since it only takes remote calls
+// while waiting for them.
+func CallUntilAccepted(t *testing.T, central_peer *OCPPPeer, action string, request interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var conf OCPPRemoteConf
+		err := central_peer.Call(action, request, &conf)
+		if err != nil {
+			t.Errorf("%s failed: %s", action, err)
+			return
+		}
+		if conf.Status == "Accepted" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("%s never accepted", action)
+}
+
+func TestSimulatedRemoteSession(t *testing.T) {
+	store, user_id := NewTestChargePointStore(CHARGER_AVAILABLE)
+	charge_point, sim := StartTestSimulator(t, store)
+
+	go func() {
+		CallUntilAccepted(t, charge_point.OCPPPeer, "RemoteStartTransaction", OCPPRemoteStartTransactionReq{1, TEST_ID_TAG})
+		for len(store.Readings()) < 2 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		CallUntilAccepted(t, charge_point.OCPPPeer, "RemoteStopTransaction", OCPPRemoteStopTransactionReq{1})
+	}()
+
+	result, err := sim.RunSession(SimulatorOptions{
+		PowerKW:  36000,
+		Remote:   true,
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CheckSimulatedSession(t, store, user_id, result)
+}
+
+func TestSimulatedChargePointUnknownAction(t *testing.T) {
+	store, _ := NewTestChargePointStore(CHARGER_AVAILABLE)
+	charge_point, _ := StartTestSimulator(t, store)
+
+	err := charge_point.Call("Reset", struct{}{}, &struct{}{})
+	ocpp_err, ok := err.(*OCPPError)
+	if !ok || ocpp_err.Code != OCPP_NOT_IMPLEMENTED {
+		t.Errorf("expected NotImplemented, got %v", err)
+	}
+}
+
+func CallChargePoint(t *testing.T, charge_point *ChargePoint, action string, request interface{}, response interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(request)
+	conf, ocpp_err := charge_point.HandleCall(action, payload)
+	if ocpp_err != nil {
+		t.Fatalf("%s failed: %s", action, ocpp_err)
+	}
+	encoded, _ := json.Marshal(conf)
+	json.Unmarshal(encoded, response)
+}
+
+// a charge point reporting Available on reconnect can't undo an owner's or
+// the fault reports' status, but it can report a fault.
+func TestChargePointStatusNotification(t *testing.T) {
+	cases := []struct {
+		status      string
+		ocpp_status string
+		expected    string
+	}{
+		{CHARGER_OUT_OF_ORDER, "Available", CHARGER_OUT_OF_ORDER},
+		{CHARGER_MAINTENANCE, "Available", CHARGER_MAINTENANCE},
+		{CHARGER_OUT_OF_ORDER, "Unavailable", CHARGER_OUT_OF_ORDER},
+		{CHARGER_MAINTENANCE, "Charging", CHARGER_MAINTENANCE},
+		{CHARGER_DECOMMISSIONED, "Available", CHARGER_DECOMMISSIONED},
+		{CHARGER_AVAILABLE, "Unavailable", CHARGER_AVAILABLE},
+		{CHARGER_AVAILABLE, "Preparing", CHARGER_AVAILABLE},
+		{CHARGER_AVAILABLE, "Faulted", CHARGER_OUT_OF_ORDER},
+		{CHARGER_IN_USE, "Faulted", CHARGER_OUT_OF_ORDER},
+		{CHARGER_AVAILABLE, "Reserved", CHARGER_RESERVED},
+		{CHARGER_RESERVED, "Available", CHARGER_AVAILABLE},
+		{CHARGER_IN_USE, "Available", CHARGER_AVAILABLE},
+	}
+	for _, test := range cases {
+		store, _ := NewTestChargePointStore(test.status)
+		charge_point := &ChargePoint{ChargerID: store.charger.ID, Store: store}
+		CallChargePoint(t, charge_point, "StatusNotification", OCPPStatusNotificationReq{
+			ConnectorID: 1,
+			ErrorCode:   "NoError",
+			Status:      test.ocpp_status,
+			Timestamp:   OCPPTimestamp(time.Now()),
+		}, &struct{}{})
+		if store.Status() != test.expected {
+			t.Errorf("%s on a %s charger left it %s, expected %s", test.ocpp_status, test.status, store.Status(), test.expected)
+		}
+	}
+}
+
+func TestChargePointStartTransactionRefused(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(store *TestChargePointStore)
+		id_tag   string
+		expected string
+	}{
+		{"unknown id tag", func(store *TestChargePointStore) {}, "UNKNOWN", "Invalid"},
+		{"reserved", func(store *TestChargePointStore) { store.charger.Status = CHARGER_RESERVED }, TEST_ID_TAG, "Blocked"},
+		{"out of order", func(store *TestChargePointStore) { store.charger.Status = CHARGER_OUT_OF_ORDER }, TEST_ID_TAG, "Blocked"},
+		{"guests only", func(store *TestChargePointStore) { store.can_access = false }, TEST_ID_TAG, "Blocked"},
+		{"maintenance", func(store *TestChargePointStore) { store.maintenance = &MaintenanceWindow{} }, TEST_ID_TAG, "Blocked"},
+		{"unknown price", func(store *TestChargePointStore) { store.charger.PriceUnknown = true }, TEST_ID_TAG, "Blocked"},
+		{"open session", func(store *TestChargePointStore) {
+			store.sessions = append(store.sessions, Session{ID: primitive.NewObjectID(), UserID: store.id_tags[TEST_ID_TAG]})
+		}, TEST_ID_TAG, "ConcurrentTx"},
+	}
+	for _, test := range cases {
+		store, _ := NewTestChargePointStore(CHARGER_AVAILABLE)
+		test.setup(store)
+		status := store.charger.Status
+		sessions := len(store.sessions)
+		charge_point := &ChargePoint{ChargerID: store.charger.ID, Store: store}
+
+		var conf OCPPStartTransactionConf
+		CallChargePoint(t, charge_point, "StartTransaction", OCPPStartTransactionReq{
+			ConnectorID: 1,
+			IdTag:       test.id_tag,
+			Timestamp:   OCPPTimestamp(time.Now()),
+		}, &conf)
+		if conf.IdTagInfo.Status != test.expected || conf.TransactionID != 0 {
+			t.Errorf("%s: answered %+v, expected %s", test.name, conf, test.expected)
+		}
+		if store.Status() != status || len(store.sessions) != sessions {
+			t.Errorf("%s: charger went to %s with %d sessions", test.name, store.Status(), len(store.sessions))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What a charge point reads and writes. The handlers only go through this,
+// so tests can run them against a store kept in memory.
+type ChargePointStore interface {
+	MarkSeen(charger_id primitive.ObjectID, model *string) error
+	// the user holding the id tag, and whether the tag is valid.
+	IdTagUser(id_tag string) (primitive.ObjectID, bool, error)
+	GetCharger(charger_id primitive.ObjectID) (Charger, error)
+	CanAccessCharger(charger Charger, user_id primitive.ObjectID) (bool, error)
+	MaintenanceConflict(charger_id primitive.ObjectID) (*MaintenanceWindow, error)
+	// the open session of the user or on the charger, mongo.ErrNoDocuments if none.
+	OpenSession(user_id primitive.ObjectID, charger_id primitive.ObjectID) (Session, error)
+	// the open session of a transaction, mongo.ErrNoDocuments if none.
+	OpenTransaction(charger_id primitive.ObjectID, transaction_id int64) (Session, error)
+	TransitionCharger(charger_id primitive.ObjectID, from []string, to string, reason string, changed_by *primitive.ObjectID) (Charger, error)
+	NextTransactionID() (int64, error)
+	CreateSession(session Session) error
+	EndSession(session_id primitive.ObjectID, power_used float64, payment_amount float64) error
+	IngestMeterReadings(session Session, charger Charger, readings []MeterReadingInput) ([]RejectedReading, error)
+}
+
+var ErrSessionNotOpen = errors.New("Session is not open")
+
+type MongoChargePointStore struct{}
+
+func (MongoChargePointStore) MarkSeen(charger_id primitive.ObjectID, model *string) error {
+	update := bson.D{{"ocpp_last_seen_at", time.Now()}}
+	if model != nil {
+		update = append(update, bson.E{"ocpp_model", *model})
+	}
+	return UpdateMany(CHARGER_COLL, bson.D{{"_id", charger_id}}, bson.D{{"$set", update}})
+}
+
+func (MongoChargePointStore) IdTagUser(id_tag string) (primitive.ObjectID, bool, error) {
+	return OCPPUser(id_tag)
+}
+
+func (MongoChargePointStore) GetCharger(charger_id primitive.ObjectID) (Charger, error) {
+	return GetCharger(bson.D{{"_id", charger_id}})
+}
+
+func (MongoChargePointStore) CanAccessCharger(charger Charger, user_id primitive.ObjectID) (bool, error) {
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		return false, err
+	}
+	return CanAccessStation(station, user_id, true)
+}
+
+func (MongoChargePointStore) MaintenanceConflict(charger_id primitive.ObjectID) (*MaintenanceWindow, error) {
+	return SessionMaintenanceConflict(charger_id)
+}
+
+func (MongoChargePointStore) OpenSession(user_id primitive.ObjectID, charger_id primitive.ObjectID) (Session, error) {
+	return GetOne[Session](SESSION_COLL, bson.D{
+		{"end_timestamp", 0},
+		{"$or", bson.A{
+			bson.D{{"user_id", user_id}},
+			bson.D{{"charger_id", charger_id}},
+		}},
+	})
+}
+
+func (MongoChargePointStore) OpenTransaction(charger_id primitive.ObjectID, transaction_id int64) (Session, error) {
+	return GetOne[Session](SESSION_COLL, bson.D{
+		{"charger_id", charger_id},
+		{"transaction_id", transaction_id},
+		{"end_timestamp", 0},
+	})
+}
+
+func (MongoChargePointStore) TransitionCharger(charger_id primitive.ObjectID, from []string, to string, reason string, changed_by *primitive.ObjectID) (Charger, error) {
+	return TransitionChargerStatus(charger_id, from, to, reason, changed_by)
+}
+
+func (MongoChargePointStore) NextTransactionID() (int64, error) {
+	return NextSequence(OCPP_TRANSACTION_COUNTER)
+}
+
+func (MongoChargePointStore) CreateSession(session Session) error {
+	_, err := CreateOne(SESSION_COLL, session)
+	return err
+}
+
+// Ends the session unless something else ended it first.
+func (MongoChargePointStore) EndSession(session_id primitive.ObjectID, power_used float64, payment_amount float64) error {
+	res, err := mongoClient.Database("GoCharge").Collection(SESSION_COLL).UpdateOne(
+		context.TODO(),
+		bson.D{
+			{"_id", session_id},
+			{"end_timestamp", 0},
+		},
+		bson.D{{"$set", bson.D{
+			{"power_used", power_used},
+			{"payment_amount", payment_amount},
+			{"end_timestamp", time.Now().Unix()},
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotOpen
+	}
+	return nil
+}
+
+func (MongoChargePointStore) IngestMeterReadings(session Session, charger Charger, readings []MeterReadingInput) ([]RejectedReading, error) {
+	_, rejected, err := IngestMeterReadings(session, charger, readings, METER_SOURCE_OCPP)
+	return rejected, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOCPPChargerStatuses(t *testing.T) {
+	expected := map[string]string{
+		"Available":     CHARGER_AVAILABLE,
+		"Charging":      CHARGER_IN_USE,
+		"SuspendedEV":   CHARGER_IN_USE,
+		"SuspendedEVSE": CHARGER_IN_USE,
+		"Finishing":     CHARGER_IN_USE,
+		"Reserved":      CHARGER_RESERVED,
+		"Faulted":       CHARGER_OUT_OF_ORDER,
+	}
+	for ocpp_status, status := range expected {
+		if ocpp_charger_statuses[ocpp_status] != status {
+			t.Errorf("%s maps to %q, expected %q", ocpp_status, ocpp_charger_statuses[ocpp_status], status)
+		}
+	}
+	if len(ocpp_charger_statuses) != len(expected) {
+		t.Errorf("unexpected statuses in %v", ocpp_charger_statuses)
+	}
+
+	// in use only follows a started transaction.
+	if _, ok := ocpp_charger_statuses["Preparing"]; ok {
+		t.Error("Preparing should not change the charger status")
+	}
+	for ocpp_status, status := range ocpp_charger_statuses {
+		if len(OCPPStatusesLeadingTo(status)) == 0 {
+			t.Errorf("%s maps to %q, which no status leads to", ocpp_status, status)
+		}
+	}
+}
+
+// charge points move chargers between available, in use and reserved, and
+// may report a fault, but never bring one back from out of order or
+// maintenance.
+func TestOCPPStatusesLeadingTo(t *testing.T) {
+	expected := map[string][]string{
+		CHARGER_AVAILABLE:    {CHARGER_IN_USE, CHARGER_RESERVED},
+		CHARGER_IN_USE:       {CHARGER_AVAILABLE, CHARGER_RESERVED},
+		CHARGER_RESERVED:     {CHARGER_AVAILABLE},
+		CHARGER_OUT_OF_ORDER: {CHARGER_AVAILABLE, CHARGER_IN_USE, CHARGER_RESERVED},
+	}
+	for to, from := range expected {
+		got := OCPPStatusesLeadingTo(to)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, from) {
+			t.Errorf("%s is reached from %v, expected %v", to, got, from)
+		}
+	}
+	for ocpp_status, status := range ocpp_charger_statuses {
+		if _, ok := expected[status]; !ok {
+			t.Errorf("%s maps to %q, which charge points shouldn't set", ocpp_status, status)
+		}
+	}
+}
+
+func TestOCPPEnergyReading(t *testing.T) {
+	cases := []struct {
+		name     string
+		samples  []OCPPSampledValue
+		expected float64
+		ok       bool
+	}{
+		{"default measurand and unit", []OCPPSampledValue{{Value: "1500"}}, 1500, true},
+		{"kWh", []OCPPSampledValue{{Value: "1.5", Measurand: OCPP_ENERGY_MEASURAND, Unit: "kWh"}}, 1500, true},
+		{"other measurands skipped", []OCPPSampledValue{
+			{Value: "7.4", Measurand: OCPP_POWER_MEASURAND, Unit: "kW"},
+			{Value: "2000", Measurand: OCPP_ENERGY_MEASURAND, Unit: "Wh"},
+		}, 2000, true},
+		{"unparseable", []OCPPSampledValue{{Value: "n/a"}}, 0, false},
+		{"no energy", []OCPPSampledValue{{Value: "230", Measurand: OCPP_VOLTAGE_MEASURAND}}, 0, false},
+	}
+	for _, test := range cases {
+		reading, ok := OCPPEnergyReading(OCPPMeterValue{SampledValue: test.samples})
+		if ok != test.ok || reading != test.expected {
+			t.Errorf("%s: got %v, %v", test.name, reading, ok)
+		}
+	}
+}
+
+func TestOCPPMeterReading(t *testing.T) {
+	recorded_at := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	reading, ok := OCPPMeterReading(OCPPMeterValue{
+		Timestamp: OCPPTimestamp(recorded_at),
+		SampledValue: []OCPPSampledValue{
+			{Value: "12.5", Measurand: OCPP_ENERGY_MEASURAND, Unit: "kWh"},
+			{Value: "7400", Measurand: OCPP_POWER_MEASURAND, Unit: "W"},
+			{Value: "230.5", Measurand: OCPP_VOLTAGE_MEASURAND, Unit: "V"},
+			{Value: "32", Measurand: OCPP_CURRENT_MEASURAND, Unit: "A"},
+			{Value: "55", Measurand: OCPP_SOC_MEASURAND, Unit: "Percent"},
+		},
+	})
+	if !ok {
+		t.Fatal("reading not parsed")
+	}
+	if !reading.RecordedAt.Equal(recorded_at) {
+		t.Errorf("recorded at %s", reading.RecordedAt)
+	}
+	if reading.EnergyWh != 12500 {
+		t.Errorf("energy %v Wh, expected 12500", reading.EnergyWh)
+	}
+	check := func(name string, value *float64, expected float64) {
+		t.Helper()
+		if value == nil || *value != expected {
+			t.Errorf("%s is %v, expected %v", name, value, expected)
+		}
+	}
+	check("power", reading.PowerKW, 7.4)
+	check("voltage", reading.Voltage, 230.5)
+	check("current", reading.Current, 32)
+	check("state of charge", reading.StateOfCharge, 55)
+
+	// power is in W unless said otherwise, and kW is kept as is.
+	reading, _ = OCPPMeterReading(OCPPMeterValue{
+		Timestamp: OCPPTimestamp(recorded_at),
+		SampledValue: []OCPPSampledValue{
+			{Value: "100"},
+			{Value: "11", Measurand: OCPP_POWER_MEASURAND, Unit: "kW"},
+		},
+	})
+	check("power in kW", reading.PowerKW, 11)
+	reading, _ = OCPPMeterReading(OCPPMeterValue{
+		Timestamp: OCPPTimestamp(recorded_at),
+		SampledValue: []OCPPSampledValue{
+			{Value: "100"},
+			{Value: "11000", Measurand: OCPP_POWER_MEASURAND},
+		},
+	})
+	check("power without unit", reading.PowerKW, 11)
+
+	// values that don't parse are left out rather than read as 0.
+	reading, ok = OCPPMeterReading(OCPPMeterValue{
+		Timestamp: OCPPTimestamp(recorded_at),
+		SampledValue: []OCPPSampledValue{
+			{Value: "100"},
+			{Value: "", Measurand: OCPP_VOLTAGE_MEASURAND},
+		},
+	})
+	if !ok || reading.Voltage != nil || reading.PowerKW != nil {
+		t.Errorf("got %+v", reading)
+	}
+
+	_, ok = OCPPMeterReading(OCPPMeterValue{
+		Timestamp:    "yesterday",
+		SampledValue: []OCPPSampledValue{{Value: "100"}},
+	})
+	if ok {
+		t.Error("reading with a bad timestamp accepted")
+	}
+	_, ok = OCPPMeterReading(OCPPMeterValue{
+		Timestamp:    OCPPTimestamp(recorded_at),
+		SampledValue: []OCPPSampledValue{{Value: "7.4", Measurand: OCPP_POWER_MEASURAND}},
+	})
+	if ok {
+		t.Error("reading without energy accepted")
+	}
+}
+
+// unknown actions are refused before the charger is looked up.
+func TestChargePointUnknownAction(t *testing.T) {
+	charge_point := &ChargePoint{}
+	for _, action := range []string{"DataTransfer", "FirmwareStatusNotification", ""} {
+		_, ocpp_err := charge_point.HandleCall(action, json.RawMessage(`{}`))
+		if ocpp_err == nil || ocpp_err.Code != OCPP_NOT_IMPLEMENTED {
+			t.Errorf("%q answered with %v", action, ocpp_err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// a cursor points just past the last result of a page. it carries a hash of
+// the search filters so it can't be replayed against a different search.
+type StationCursor struct {
+	SortKey    float64            `json:"k"`
+	Distance   float64            `json:"d"`
+	ID         primitive.ObjectID `json:"id"`
+	FilterHash string             `json:"f"`
+}
+
+func EncodeStationCursor(cursor StationCursor) (string, error) {
+	cursor_json, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(cursor_json), nil
+}
+
+func DecodeStationCursor(cursor_str string, filter_hash string) (StationCursor, error) {
+	var cursor StationCursor
+
+	cursor_json, err := base64.RawURLEncoding.DecodeString(cursor_str)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	err = json.Unmarshal(cursor_json, &cursor)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if cursor.FilterHash != filter_hash {
+		return cursor, errors.New("cursor does not match the search filters")
+	}
+	return cursor, nil
+}
+
+// hashes everything that shapes the result set, i.e. the input without its
+// paging fields.
+func HashSearchFilters(filters any) string {
+	filters_json, _ := json.Marshal(filters)
+	sum := sha256.Sum256(filters_json)
+	return hex.EncodeToString(sum[:8])
+}
+
+// matches documents that come strictly after the cursor in
+// (sort_key, distance, _id) order.
+func StationCursorMatch(cursor StationCursor) bson.D {
+	return bson.D{
+		{"$match", bson.D{
+			{"$or", bson.A{
+				bson.D{{"sort_key", bson.D{{"$gt", cursor.SortKey}}}},
+				bson.D{
+					{"sort_key", cursor.SortKey},
+					{"distance", bson.D{{"$gt", cursor.Distance}}},
+				},
+				bson.D{
+					{"sort_key", cursor.SortKey},
+					{"distance", cursor.Distance},
+					{"_id", bson.D{{"$gt", cursor.ID}}},
+				},
+			}},
+		}},
+	}
+}
+
+type FacetCount struct {
+	Count int64 `bson:"count"`
+}
+
+// first element of a $count facet, or 0 when nothing matched.
+func FacetTotal(counts []FacetCount) int64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	return counts[0].Count
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// roles an owner can grant on a station.
+const STATION_ROLE_MANAGER = "manager"
+const STATION_ROLE_TECHNICIAN = "technician"
+const STATION_ROLE_VIEWER = "viewer"
+
+// what a user may do with a station. only the owner can manage it, i.e.
+// archive it, share it, or hand it over.
+const PERM_VIEW_STATION = "view_station"
+const PERM_EDIT_STATION = "edit_station"
+const PERM_EDIT_CHARGERS = "edit_chargers"
+const PERM_MANAGE_STATION = "manage_station"
+
+var station_role_permissions = map[string][]string{
+	STATION_ROLE_MANAGER:    {PERM_VIEW_STATION, PERM_EDIT_STATION, PERM_EDIT_CHARGERS},
+	STATION_ROLE_TECHNICIAN: {PERM_VIEW_STATION, PERM_EDIT_CHARGERS},
+	STATION_ROLE_VIEWER:     {PERM_VIEW_STATION},
+}
+
+const GRANT_PENDING = "pending"
+const GRANT_ACCEPTED = "accepted"
+const GRANT_REVOKED = "revoked"
+
+const STATION_INVITE_LIFETIME = 7 * 24 * time.Hour
+
+var ErrStationForbidden = errors.New("You do not have access to this station")
+
+// Checks that a user may act on a station, as its owner or through an
+// accepted grant whose role allows the permission. Deleted stations are off
+// limits to everyone.
+func AuthorizeStation(user_id primitive.ObjectID, station_id primitive.ObjectID, permission string) (Station, error) {
+	station, err := GetStation(bson.D{
+		{"_id", station_id},
+		{"is_deleted", bson.D{{"$ne", true}}},
+	})
+	if err == mongo.ErrNoDocuments {
+		return station, ErrStationForbidden
+	}
+	if err != nil {
+		return station, err
+	}
+	if station.OwnerID == user_id {
+		return station, nil
+	}
+	if permission == PERM_MANAGE_STATION {
+		return station, ErrStationForbidden
+	}
+
+	grant, err := GetOne[StationGrant](STATION_GRANT_COLL, bson.D{
+		{"station_id", station_id},
+		{"user_id", user_id},
+		{"status", GRANT_ACCEPTED},
+	})
+	if err == mongo.ErrNoDocuments {
+		return station, ErrStationForbidden
+	}
+	if err != nil {
+		return station, err
+	}
+
+	for _, granted := range station_role_permissions[grant.Role] {
+		if granted == permission {
+			return station, nil
+		}
+	}
+	return station, ErrStationForbidden
+}
+
+// Responds to a failed AuthorizeStation.
+func RespondStationAuthError(c *gin.Context, err error) {
+	if err == ErrStationForbidden {
+		c.JSON(http.StatusUnauthorized, err.Error())
+	} else {
+		c.JSON(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func GenInviteToken() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func HandleInviteStationManager(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[InviteStationManagerInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := station_role_permissions[body_data.Role]; !ok {
+		c.JSON(http.StatusBadRequest, "Role must be 'manager', 'technician' or 'viewer'")
+		return
+	}
+	body_data.Email, err = ParseEmailAddress(body_data.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Email == user_claim.Email {
+		c.JSON(http.StatusBadRequest, "Cannot invite yourself")
+		return
+	}
+
+	station, err := AuthorizeStation(user_id, body_data.StationID, PERM_MANAGE_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	// a new invite replaces an unanswered one.
+	err = UpdateMany(
+		STATION_GRANT_COLL,
+		bson.D{
+			{"station_id", station.ID},
+			{"email", body_data.Email},
+			{"status", GRANT_PENDING},
+		},
+		bson.D{{"$set", bson.D{{"status", GRANT_REVOKED}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := GenInviteToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	grant := StationGrant{
+		ID:        primitive.NewObjectID(),
+		StationID: station.ID,
+		UserID:    nil,
+		Email:     body_data.Email,
+		Role:      body_data.Role,
+		Status:    GRANT_PENDING,
+		Token:     token,
+		InvitedBy: user_id,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(STATION_INVITE_LIFETIME),
+	}
+	_, err = CreateOne(STATION_GRANT_COLL, grant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	subject := "GoCharge Station Invitation"
+	message := "You were invited to help run " + station.Name + " as a " + body_data.Role + ". Use this code to accept the invitation: " + token
+	err = SendEmail(body_data.Email, FormNoticeBody(body_data.Email, message), subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, grant)
+}
+
+func HandleAcceptStationInvite(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var token string
+	err = ReadBody(c, QPPair{"token", &token})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// invites are bound to the email they were sent to.
+	filter := bson.D{
+		{"token", token},
+		{"email", user_claim.Email},
+		{"status", GRANT_PENDING},
+		{"expires_at", bson.D{{"$gt", time.Now()}}},
+	}
+	err = UpdateOne(STATION_GRANT_COLL, filter, bson.D{
+		{"$set", bson.D{
+			{"user_id", user_id},
+			{"status", GRANT_ACCEPTED},
+		}},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No open invitation with this token was found for your email")
+		return
+	}
+
+	grant, err := GetOne[StationGrant](STATION_GRANT_COLL, bson.D{{"token", token}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, grant)
+}
+
+func HandleGetStationGrants(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_MANAGE_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	grants, err := GetAll[StationGrant](STATION_GRANT_COLL, bson.D{
+		{"station_id", body_data.StationID},
+		{"status", bson.D{{"$ne", GRANT_REVOKED}}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, grants)
+}
+
+func HandleRevokeStationGrant(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[GrantIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	grant, err := GetOne[StationGrant](STATION_GRANT_COLL, bson.D{{"_id", body_data.GrantID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such grant found")
+		return
+	}
+
+	// owners revoke anyone, grantees can give up their own access.
+	is_own_grant := grant.UserID != nil && *grant.UserID == user_id
+	if !is_own_grant {
+		_, err = AuthorizeStation(user_id, grant.StationID, PERM_MANAGE_STATION)
+		if err != nil {
+			RespondStationAuthError(c, err)
+			return
+		}
+	}
+
+	err = UpdateOne(
+		STATION_GRANT_COLL,
+		bson.D{{"_id", grant.ID}},
+		bson.D{{"$set", bson.D{{"status", GRANT_REVOKED}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, "")
+}
+
+// Get the stations the user helps run, along with their role on each.
+func HandleGetManagedStations(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	stations, err := Aggregate[ManagedStationOutput](STATION_GRANT_COLL, bson.A{
+		bson.D{
+			{"$match", bson.D{
+				{"user_id", user_id},
+				{"status", GRANT_ACCEPTED},
+			}},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Stations"},
+				{"localField", "station_id"},
+				{"foreignField", "_id"},
+				{"as", "station"},
+			}},
+		},
+		bson.D{
+			{"$unwind", "$station"},
+		},
+		bson.D{
+			{"$match", bson.D{
+				{"station.is_deleted", bson.D{{"$ne", true}}},
+			}},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, stations)
+}
+
+// Offer a station to another owner account. The station changes hands once
+// they accept.
+func HandleTransferStation(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[TransferStationInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	station, err := AuthorizeStation(user_id, body_data.StationID, PERM_MANAGE_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	new_owner, err := GetUser(bson.D{
+		{"email", body_data.Email},
+		{"role", OWNER_ROLE},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No owner account with this email was found")
+		return
+	}
+	new_owner_id, err := primitive.ObjectIDFromHex(new_owner.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if new_owner_id == user_id {
+		c.JSON(http.StatusBadRequest, "You already own this station")
+		return
+	}
+
+	err = UpdateOne(
+		STATION_COLL,
+		bson.D{{"_id", station.ID}},
+		bson.D{{"$set", bson.D{{"pending_owner_id", new_owner_id}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	subject := "GoCharge Station Transfer"
+	message := user_claim.Username + " would like to transfer " + station.Name + " to you. Use this station id to accept ownership: " + station.ID.Hex()
+	err = SendEmail(new_owner.Email, FormNoticeBody(new_owner.Username, message), subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, "")
+}
+
+func HandleAcceptStationTransfer(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = UpdateOne(
+		STATION_COLL,
+		bson.D{
+			{"_id", body_data.StationID},
+			{"pending_owner_id", user_id},
+		},
+		bson.D{{"$set", bson.D{
+			{"owner_id", user_id},
+			{"pending_owner_id", nil},
+		}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No station transfer to you was found")
+		return
+	}
+
+	// the new owner needs no grant of their own anymore.
+	err = UpdateMany(
+		STATION_GRANT_COLL,
+		bson.D{
+			{"station_id", body_data.StationID},
+			{"user_id", user_id},
+		},
+		bson.D{{"$set", bson.D{{"status", GRANT_REVOKED}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	station, err := GetStation(bson.D{{"_id", body_data.StationID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, station)
+}
+
+const MAX_STATION_SESSIONS = 100
+
+// Get the latest sessions on a station's chargers.
+func HandleGetStationSessions(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	sessions, err := Aggregate[Session](CHARGER_COLL, bson.A{
+		bson.D{
+			{"$match", bson.D{{"station_id", body_data.StationID}}},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Sessions"},
+				{"localField", "_id"},
+				{"foreignField", "charger_id"},
+				{"as", "session"},
+			}},
+		},
+		bson.D{
+			{"$unwind", "$session"},
+		},
+		bson.D{
+			{"$replaceRoot", bson.D{{"newRoot", "$session"}}},
+		},
+		bson.D{
+			{"$sort", bson.D{{"start_timestamp", -1}}},
+		},
+		bson.D{
+			{"$limit", MAX_STATION_SESSIONS},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
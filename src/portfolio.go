@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const APPROVAL_PENDING = "pending"
+const APPROVAL_APPROVED = "approved"
+const APPROVAL_DENIED = "denied"
+const APPROVAL_REVISION_PENDING = "revision_pending"
+const APPROVAL_ARCHIVED = "archived"
+
+// Explains where a station stands with admins.
+func StationApproval(station Station) (string, string) {
+	switch {
+	case station.IsArchived:
+		return APPROVAL_ARCHIVED, "Archived stations are hidden from drivers until an admin restores them"
+	case station.IsDenied:
+		return APPROVAL_DENIED, "An admin denied this station"
+	case !station.IsPublic:
+		return APPROVAL_PENDING, "Waiting on an admin to approve this station"
+	case station.PendingRevisionID != nil:
+		return APPROVAL_REVISION_PENDING, "Live, with location edits waiting on admin approval"
+	}
+	return APPROVAL_APPROVED, "Live for drivers"
+}
+
+// Get a page of the owner's stations, each with its chargers, open sessions
+// and earnings to date.
+func HandleGetPortfolio(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[PortfolioInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	max_results := min(body_data.MaxResults, max_station_results)
+	if max_results <= 0 {
+		max_results = max_station_results
+	}
+
+	station_match := bson.D{
+		{"owner_id", user_id},
+		{"is_deleted", bson.D{{"$ne", true}}},
+	}
+	if body_data.Cursor != "" {
+		after_id, err := primitive.ObjectIDFromHex(body_data.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		station_match = append(station_match, bson.E{"_id", bson.D{{"$gt", after_id}}})
+	}
+
+	stations, err := Aggregate[PortfolioStationDoc](STATION_COLL, bson.A{
+		bson.D{
+			{"$match", station_match},
+		},
+		bson.D{
+			{"$sort", bson.D{{"_id", 1}}},
+		},
+		bson.D{
+			{"$limit", max_results + 1},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Chargers"},
+				{"localField", "_id"},
+				{"foreignField", "station_id"},
+				{"as", "chargers"},
+				{"pipeline", bson.A{
+					bson.D{
+						{"$lookup", bson.D{
+							{"from", "Sessions"},
+							{"localField", "_id"},
+							{"foreignField", "charger_id"},
+							{"as", "session_stats"},
+							{"pipeline", bson.A{
+								bson.D{
+									{"$group", bson.D{
+										{"_id", nil},
+										{"earnings", bson.D{{"$sum", "$payment_amount"}}},
+										{"session_count", bson.D{{"$sum", bson.D{
+											{"$cond", bson.A{bson.D{{"$ne", bson.A{"$end_timestamp", 0}}}, 1, 0}},
+										}}}},
+										{"open_sessions", bson.D{{"$push", bson.D{
+											{"$cond", bson.A{bson.D{{"$eq", bson.A{"$end_timestamp", 0}}}, "$$ROOT", "$$REMOVE"}},
+										}}}},
+									}},
+								},
+							}},
+						}},
+					},
+				}},
+			}},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	page := PortfolioPage{
+		Stations: []PortfolioStationOutput{},
+	}
+	if int64(len(stations)) > max_results {
+		stations = stations[:max_results]
+		page.NextCursor = stations[len(stations)-1].ID.Hex()
+	}
+
+	for _, station := range stations {
+		approval_status, approval_note := StationApproval(station.Station)
+		station_output := PortfolioStationOutput{
+			Station:        station.Station,
+			ApprovalStatus: approval_status,
+			ApprovalNote:   approval_note,
+			OpenSessions:   []Session{},
+			Chargers:       []PortfolioChargerOutput{},
+		}
+
+		for _, charger := range station.Chargers {
+			charger_output := PortfolioChargerOutput{
+				Charger:    charger.Charger,
+				LiveStatus: charger.Status,
+			}
+			// the group stage yields at most one document.
+			for _, stats := range charger.SessionStats {
+				charger_output.Earnings = stats.Earnings
+				charger_output.SessionCount = stats.SessionCount
+				if len(stats.OpenSessions) > 0 {
+					charger_output.OpenSession = &stats.OpenSessions[0]
+					charger_output.LiveStatus = CHARGER_IN_USE
+				}
+				station_output.OpenSessions = append(station_output.OpenSessions, stats.OpenSessions...)
+			}
+			station_output.Earnings += charger_output.Earnings
+			station_output.SessionCount += charger_output.SessionCount
+			station_output.Chargers = append(station_output.Chargers, charger_output)
+		}
+
+		page.Stations = append(page.Stations, station_output)
+	}
+
+	c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const REVISION_PENDING = "pending"
+const REVISION_APPROVED = "approved"
+const REVISION_DENIED = "denied"
+const REVISION_SUPERSEDED = "superseded" // replaced by a newer edit before review
+
+func LocationFieldsOf(station Station) StationLocationFields {
+	return StationLocationFields{
+		Name:             station.Name,
+		Address:          station.Address,
+		Coordinates:      station.Coordinates,
+		CoLocatedIDs:     NonNilIDs(station.CoLocatedIDs),
+		LocationMismatch: station.LocationMismatch,
+		MismatchMeters:   station.MismatchMeters,
+		DuplicateIDs:     NonNilIDs(station.DuplicateIDs),
+	}
+}
+
+// $set entries publishing location fields on a station.
+func (fields StationLocationFields) SetDoc() bson.D {
+	return bson.D{
+		{"name", fields.Name},
+		{"address", fields.Address},
+		{"coordinates", fields.Coordinates},
+		{"co_located_station_ids", fields.CoLocatedIDs},
+		{"search_tokens", StationSearchTokens(fields.Name, fields.Address)},
+		{"location_mismatch", fields.LocationMismatch},
+		{"mismatch_meters", fields.MismatchMeters},
+		{"possible_duplicate_ids", fields.DuplicateIDs},
+	}
+}
+
+// Fields an owner changed, leaving out the ones derived by geocoding and
+// duplicate detection.
+func DiffLocationFields(previous StationLocationFields, changes StationLocationFields) []FieldChange {
+	diff := []FieldChange{}
+	if previous.Name != changes.Name {
+		diff = append(diff, FieldChange{"name", previous.Name, changes.Name})
+	}
+	if previous.Address != changes.Address {
+		diff = append(diff, FieldChange{"address", previous.Address, changes.Address})
+	}
+	if previous.Coordinates != changes.Coordinates {
+		diff = append(diff, FieldChange{"coordinates", previous.Coordinates, changes.Coordinates})
+	}
+	if !reflect.DeepEqual(previous.CoLocatedIDs, changes.CoLocatedIDs) {
+		diff = append(diff, FieldChange{"co_located_station_ids", previous.CoLocatedIDs, changes.CoLocatedIDs})
+	}
+	return diff
+}
+
+// Stores location edits of a published station for admin review, replacing
+// any edit still waiting on review.
+func CreateStationRevision(station Station, owner_id primitive.ObjectID, changes StationLocationFields) (primitive.ObjectID, error) {
+	err := UpdateMany(
+		STATION_REVISION_COLL,
+		bson.D{{"station_id", station.ID}, {"status", REVISION_PENDING}},
+		bson.D{{"$set", bson.D{{"status", REVISION_SUPERSEDED}}}},
+	)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	return CreateOne(STATION_REVISION_COLL, StationRevision{
+		ID:        primitive.NewObjectID(),
+		StationID: station.ID,
+		OwnerID:   owner_id,
+		Status:    REVISION_PENDING,
+		Previous:  LocationFieldsOf(station),
+		Changes:   changes,
+		CreatedAt: time.Now(),
+	})
+}
+
+func HandlePendingStationRevisions(c *gin.Context) {
+	revisions, err := GetAll[StationRevision](STATION_REVISION_COLL, bson.D{{"status", REVISION_PENDING}}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	revisions_out := []StationRevisionOutput{}
+	for _, revision := range revisions {
+		diff := DiffLocationFields(revision.Previous, revision.Changes)
+		revisions_out = append(revisions_out, StationRevisionOutput{revision, diff})
+	}
+
+	c.JSON(http.StatusOK, revisions_out)
+}
+
+func HandleStationRevisionApproval(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[ApproveStationRevisionInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	revision, err := GetOne[StationRevision](STATION_REVISION_COLL, bson.D{
+		{"_id", body_data.RevisionID},
+		{"status", REVISION_PENDING},
+	})
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, "A pending revision with this id was not found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// publish (or drop) the edit on the live station.
+	station_update := bson.D{{"pending_revision_id", nil}}
+	if body_data.Approved {
+		station_update = append(station_update, revision.Changes.SetDoc()...)
+	}
+	// only while this is still the station's pending revision, so another
+	// review or a newer edit can't be undone by a stale one.
+	res, err := mongoClient.Database("GoCharge").Collection(STATION_COLL).UpdateOne(
+		context.TODO(),
+		bson.D{
+			{"_id", revision.StationID},
+			{"pending_revision_id", revision.ID},
+		},
+		bson.D{{"$set", station_update}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, "Revision was reviewed or replaced in the meantime")
+		return
+	}
+
+	status := REVISION_DENIED
+	if body_data.Approved {
+		status = REVISION_APPROVED
+	}
+	res, err = mongoClient.Database("GoCharge").Collection(STATION_REVISION_COLL).UpdateOne(
+		context.TODO(),
+		bson.D{
+			{"_id", revision.ID},
+			{"status", REVISION_PENDING},
+		},
+		bson.D{{"$set", bson.D{
+			{"status", status},
+			{"reviewed_at", time.Now()},
+		}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, "Revision was reviewed or replaced in the meantime")
+		return
+	}
+
+	c.JSON(http.StatusOK, "")
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const DEFAULT_MAX_RESULTS = 20
+const DEFAULT_MAX_VIEWPORT_STATIONS = 500
+const DEFAULT_MAX_ROUTE_STATIONS = 100
+
+// cap on how many stations (or chargers per station) a single request can
+// return. configurable through MAX_STATION_RESULTS.
+var max_station_results int64 = DEFAULT_MAX_RESULTS
+
+// cap on individual stations returned for a zoomed-in viewport. configurable
+// through MAX_VIEWPORT_STATIONS.
+var max_viewport_stations int64 = DEFAULT_MAX_VIEWPORT_STATIONS
+
+// cap on stations returned along a route. configurable through
+// MAX_ROUTE_STATIONS.
+var max_route_stations int64 = DEFAULT_MAX_ROUTE_STATIONS
+
+func InitSearchConfig() {
+	max_station_results = ReadEnvPositiveInt64("MAX_STATION_RESULTS", DEFAULT_MAX_RESULTS)
+	max_viewport_stations = ReadEnvPositiveInt64("MAX_VIEWPORT_STATIONS", DEFAULT_MAX_VIEWPORT_STATIONS)
+	max_route_stations = ReadEnvPositiveInt64("MAX_ROUTE_STATIONS", DEFAULT_MAX_ROUTE_STATIONS)
+}
+
+// matches approved stations that are up, whoever they are visible to.
+func PublishedStationMatch() bson.D {
+	return bson.D{
+		{"is_public", true},
+		{"is_disabled", false},
+		{"is_archived", bson.D{{"$ne", true}}},
+	}
+}
+
+// matches stations anyone is allowed to find.
+func VisibleStationMatch() bson.D {
+	return append(PublishedStationMatch(),
+		bson.E{"visibility", bson.D{{"$nin", bson.A{VISIBILITY_UNLISTED, VISIBILITY_GUESTS_ONLY}}}},
+	)
+}
+
+// Pipeline stages applying StationFilters to a stream of stations. Chargers
+// that pass the filters are joined into "chargers", and stations without any
+// are dropped.
+func StationFilterStages(visible bson.D, filters StationFilters) bson.A {
+	station_match := append(visible,
+		bson.E{"$expr", bson.D{
+			{"$gte", bson.A{
+				"$review_score",
+				bson.D{{"$multiply", bson.A{filters.MinRating, "$review_count"}}},
+			}},
+		}},
+		bson.E{"$or", bson.A{
+			bson.D{{"$expr", bson.D{
+				{"$eq", bson.A{filters.MinRating, 0}},
+			}}},
+			bson.D{{"$expr", bson.D{
+				{"$ne", bson.A{"$review_count", 0}},
+			}}},
+		}},
+	)
+	if len(filters.Amenities) > 0 {
+		station_match = append(station_match, bson.E{"amenities", bson.D{{"$all", filters.Amenities}}})
+	}
+
+	stages := bson.A{
+		bson.D{
+			{"$match", station_match},
+		},
+	}
+
+	matchConditions := bson.D{{"is_decommissioned", bson.D{{"$ne", true}}}}
+
+	if len(filters.Statuses) > 0 {
+		matchConditions = append(matchConditions, bson.E{"status", bson.D{{"$in", filters.Statuses}}})
+	}
+	if len(filters.PowerOutputs) > 0 {
+		power_outputs := NormalizeCatalogFilter(CATALOG_KIND_POWER, filters.PowerOutputs)
+		matchConditions = append(matchConditions, bson.E{"kWh_types_id", bson.D{{"$in", power_outputs}}})
+	}
+	if len(filters.PlugTypes) > 0 {
+		plug_types := NormalizeCatalogFilter(CATALOG_KIND_CONNECTOR, filters.PlugTypes)
+		matchConditions = append(matchConditions, bson.E{"charger_types_id", bson.D{{"$in", plug_types}}})
+	}
+
+	// imported chargers without a price only show up when price doesn't matter.
+	if filters.MaxPrice > 0 {
+		matchConditions = append(matchConditions, bson.E{"price", bson.D{{"$lte", filters.MaxPrice}}})
+	}
+
+	stages = append(stages, bson.D{
+		{"$lookup", bson.D{
+			{"from", "Chargers"},
+			{"localField", "_id"},
+			{"foreignField", "station_id"},
+			{"as", "chargers"},
+			{"pipeline", bson.A{
+				bson.D{
+					{"$match", matchConditions},
+				},
+			}},
+		}},
+	})
+
+	stages = append(stages, bson.D{
+		{"$match", bson.D{
+			{"chargers.0", bson.D{
+				{"$exists", true},
+			}},
+		}},
+	}, AverageRatingStage())
+
+	return stages
+}
+
+// adds average_rating, or 0 for stations without reviews.
+func AverageRatingStage() bson.D {
+	return bson.D{
+		{"$addFields", bson.D{
+			{"average_rating", bson.D{
+				{"$cond", bson.A{
+					bson.D{{"$gt", bson.A{"$review_count", 0}}},
+					bson.D{{"$divide", bson.A{"$review_score", "$review_count"}}},
+					0,
+				}},
+			}},
+		}},
+	}
+}
+
+const SORT_DISTANCE = "distance"
+const SORT_PRICE = "price"
+const SORT_RATING = "rating"
+const SORT_AVAILABILITY = "availability"
+const SORT_BEST_MATCH = "best_match"
+
+// weights of the best match score, which sums terms that each lie in [0, 1].
+const BEST_MATCH_DISTANCE_WEIGHT = 0.35
+const BEST_MATCH_RATING_WEIGHT = 0.25
+const BEST_MATCH_AVAILABILITY_WEIGHT = 0.25
+const BEST_MATCH_PRICE_WEIGHT = 0.15
+
+// distance in meters and price at which their best match terms are halved.
+const BEST_MATCH_DISTANCE_SCALE = 5000
+const BEST_MATCH_PRICE_SCALE = 1
+
+const MAX_RATING = 5
+
+const UNKNOWN_PRICE_SORT_KEY = math.MaxFloat64
+
+// Builds the expression results are ordered by, ascending. Sorts where higher
+// is better are negated, so paging always moves up (sort_key, distance, _id).
+// Runs after StationFilterStages, on the chargers that passed the filters.
+func StationSortKey(sort_by string) (interface{}, error) {
+	available_chargers := bson.D{{"$size", bson.D{
+		{"$filter", bson.D{
+			{"input", "$chargers"},
+			{"cond", bson.D{{"$eq", bson.A{"$$this.status", CHARGER_AVAILABLE}}}},
+		}},
+	}}}
+	// stations whose chargers all lack a price sort as the most expensive.
+	min_price := bson.D{{"$ifNull", bson.A{
+		bson.D{{"$min", "$chargers.price"}},
+		UNKNOWN_PRICE_SORT_KEY,
+	}}}
+
+	switch sort_by {
+	case "", SORT_DISTANCE:
+		return "$distance", nil
+	case SORT_PRICE:
+		return min_price, nil
+	case SORT_RATING:
+		return bson.D{{"$multiply", bson.A{-1, "$average_rating"}}}, nil
+	case SORT_AVAILABILITY:
+		return bson.D{{"$multiply", bson.A{-1, available_chargers}}}, nil
+	case SORT_BEST_MATCH:
+		return bson.D{{"$multiply", bson.A{-1, bson.D{{"$add", bson.A{
+			bson.D{{"$multiply", bson.A{
+				BEST_MATCH_DISTANCE_WEIGHT,
+				bson.D{{"$divide", bson.A{
+					BEST_MATCH_DISTANCE_SCALE,
+					bson.D{{"$add", bson.A{BEST_MATCH_DISTANCE_SCALE, "$distance"}}},
+				}}},
+			}}},
+			bson.D{{"$multiply", bson.A{
+				BEST_MATCH_RATING_WEIGHT,
+				bson.D{{"$divide", bson.A{"$average_rating", MAX_RATING}}},
+			}}},
+			bson.D{{"$multiply", bson.A{
+				BEST_MATCH_AVAILABILITY_WEIGHT,
+				bson.D{{"$divide", bson.A{available_chargers, bson.D{{"$size", "$chargers"}}}}},
+			}}},
+			bson.D{{"$multiply", bson.A{
+				BEST_MATCH_PRICE_WEIGHT,
+				bson.D{{"$divide", bson.A{
+					BEST_MATCH_PRICE_SCALE,
+					bson.D{{"$add", bson.A{BEST_MATCH_PRICE_SCALE, min_price}}},
+				}}},
+			}}},
+		}}}}}}, nil
+	}
+	return nil, errors.New("sort must be 'distance', 'price', 'rating', 'availability' or 'best_match'")
+}
+
+// from this zoom level on, the map shows individual stations.
+const CLUSTER_MAX_ZOOM = 14
+
+// grid cells per 256px map tile side, i.e. roughly one cluster per 64px.
+const CLUSTER_CELLS_PER_TILE = 4
+
+// Get every station inside the visible map bounds. Below CLUSTER_MAX_ZOOM the
+// stations are grouped into grid clusters inside the aggregation.
+func HandleViewportStations(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[ViewportStationsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if body_data.Zoom < 0 {
+		c.JSON(http.StatusBadRequest, "Zoom must not be negative")
+		return
+	}
+
+	pipeline := bson.A{
+		bson.D{
+			{"$match", BoundingBoxFilter(body_data.Bounds)},
+		},
+	}
+	// drivers also see guests-only stations they were approved for.
+	visible, ok := RequestStationAccessMatch(c, false)
+	if !ok {
+		return
+	}
+	pipeline = append(pipeline, StationFilterStages(visible, body_data.StationFilters)...)
+
+	output := ViewportStationsOutput{
+		Clustered: body_data.Zoom < CLUSTER_MAX_ZOOM,
+		Stations:  []FindStationsOutput{},
+		Clusters:  []StationCluster{},
+	}
+
+	if !output.Clustered {
+		pipeline = append(pipeline,
+			bson.D{{"$sort", bson.D{{"_id", 1}}}},
+			bson.D{{"$limit", max_viewport_stations}},
+		)
+		output.Stations, err = Aggregate[FindStationsOutput](STATION_COLL, pipeline)
+		if err != nil {
+			log.Printf("Error with MongoDB aggregation: %v", err)
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, output)
+		return
+	}
+
+	cell_size := 360 / (math.Pow(2, float64(body_data.Zoom)) * CLUSTER_CELLS_PER_TILE)
+
+	pipeline = append(pipeline,
+		bson.D{
+			{"$project", bson.D{
+				{"lng", bson.D{{"$arrayElemAt", bson.A{"$coordinates", 0}}}},
+				{"lat", bson.D{{"$arrayElemAt", bson.A{"$coordinates", 1}}}},
+				{"min_price", bson.D{{"$min", "$chargers.price"}}},
+				{"available_chargers", bson.D{
+					{"$size", bson.D{
+						{"$filter", bson.D{
+							{"input", "$chargers"},
+							{"cond", bson.D{{"$eq", bson.A{"$$this.status", CHARGER_AVAILABLE}}}},
+						}},
+					}},
+				}},
+			}},
+		},
+		bson.D{
+			{"$group", bson.D{
+				{"_id", bson.D{
+					{"x", bson.D{{"$floor", bson.D{{"$divide", bson.A{"$lng", cell_size}}}}}},
+					{"y", bson.D{{"$floor", bson.D{{"$divide", bson.A{"$lat", cell_size}}}}}},
+				}},
+				{"lng", bson.D{{"$avg", "$lng"}}},
+				{"lat", bson.D{{"$avg", "$lat"}}},
+				{"count", bson.D{{"$sum", 1}}},
+				{"min_price", bson.D{{"$min", "$min_price"}}},
+				{"available_chargers", bson.D{{"$sum", "$available_chargers"}}},
+			}},
+		},
+		bson.D{
+			{"$project", bson.D{
+				{"_id", 0},
+				{"coordinates", bson.A{"$lng", "$lat"}},
+				{"count", 1},
+				{"min_price", 1},
+				{"available_chargers", 1},
+			}},
+		},
+	)
+
+	output.Clusters, err = Aggregate[StationCluster](STATION_COLL, pipeline)
+	if err != nil {
+		log.Printf("Error with MongoDB aggregation: %v", err)
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, output)
+}
+
+const DEFAULT_CORRIDOR_WIDTH = 2000
+const MAX_CORRIDOR_WIDTH = 25000
+
+// stations fetched from the route's boxes before the exact distance check.
+// routes with more are refused, since a cut at the limit would drop
+// arbitrary stations.
+const MAX_ROUTE_CANDIDATES = 5000
+
+// routes are simplified until they have at most this many points, and
+// candidates are fetched with at most this many bounding boxes.
+const MAX_ROUTE_POINTS = 500
+const MAX_ROUTE_BOXES = 50
+
+// Get public stations within a corridor around a trip, ordered by how far
+// along the route they are.
+func HandleRouteStations(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[RouteStationsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var route [][2]float64
+	if body_data.Polyline != "" {
+		route, err = DecodePolyline(body_data.Polyline)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if body_data.LineString != nil && body_data.LineString.Type == "LineString" {
+		route = body_data.LineString.Coordinates
+	}
+	if len(route) < 2 {
+		c.JSON(http.StatusBadRequest, "A route needs a polyline or LineString with at least 2 points")
+		return
+	}
+
+	corridor_width := body_data.CorridorWidth
+	if corridor_width <= 0 {
+		corridor_width = DEFAULT_CORRIDOR_WIDTH
+	}
+	corridor_width = min(corridor_width, MAX_CORRIDOR_WIDTH)
+	max_results := min(body_data.MaxResults, max_route_stations)
+	if max_results <= 0 {
+		max_results = max_route_stations
+	}
+
+	// simplify with a tolerance well under the corridor width, loosening it
+	// only when the route is still too detailed.
+	tolerance := corridor_width / 4
+	route = SimplifyPolyline(route, tolerance)
+	for len(route) > MAX_ROUTE_POINTS {
+		tolerance *= 2
+		route = SimplifyPolyline(route, tolerance)
+	}
+
+	// candidates come from boxes around consecutive runs of the route. they
+	// are grown by the tolerance too, since the simplified route may have
+	// drifted that far from the real one.
+	points_per_box := max(2, (len(route)+MAX_ROUTE_BOXES-1)/MAX_ROUTE_BOXES+1)
+	boxes := bson.A{}
+	for i := 0; i < len(route)-1; i += points_per_box - 1 {
+		end := min(i+points_per_box, len(route))
+		boxes = append(boxes, BoundingBoxFilter(ExpandedBounds(route[i:end], corridor_width+tolerance)))
+	}
+
+	pipeline := bson.A{
+		bson.D{
+			{"$match", bson.D{{"$or", boxes}}},
+		},
+	}
+	// drivers also see guests-only stations they were approved for.
+	visible, ok := RequestStationAccessMatch(c, false)
+	if !ok {
+		return
+	}
+	pipeline = append(pipeline, StationFilterStages(visible, body_data.StationFilters)...)
+	pipeline = append(pipeline, bson.D{{"$limit", MAX_ROUTE_CANDIDATES + 1}})
+
+	candidates, err := Aggregate[FindStationsOutput](STATION_COLL, pipeline)
+	if err != nil {
+		log.Printf("Error with MongoDB aggregation: %v", err)
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(candidates) > MAX_ROUTE_CANDIDATES {
+		c.JSON(http.StatusBadRequest, "Too many stations along this route, use a shorter route, a narrower corridor or more filters")
+		return
+	}
+
+	// cumulative length of the route at the start of every segment.
+	segment_starts := make([]float64, len(route))
+	for i := 1; i < len(route); i++ {
+		segment_starts[i] = segment_starts[i-1] + HaversineDistance(route[i-1], route[i])
+	}
+
+	stations := []RouteStationOutput{}
+	for _, candidate := range candidates {
+		best_distance, best_along := math.MaxFloat64, 0.0
+		for i := 0; i < len(route)-1; i++ {
+			distance, t := PointSegmentDistance(candidate.Coordinates, route[i], route[i+1])
+			if distance < best_distance {
+				best_distance = distance
+				best_along = segment_starts[i] + t*(segment_starts[i+1]-segment_starts[i])
+			}
+		}
+		if best_distance > corridor_width {
+			continue
+		}
+
+		candidate.Distance = best_distance
+		stations = append(stations, RouteStationOutput{candidate, best_along})
+	}
+
+	sort.Slice(stations, func(i, j int) bool {
+		if stations[i].DistanceAlongRoute != stations[j].DistanceAlongRoute {
+			return stations[i].DistanceAlongRoute < stations[j].DistanceAlongRoute
+		}
+		return stations[i].ID.Hex() < stations[j].ID.Hex()
+	})
+	if int64(len(stations)) > max_results {
+		stations = stations[:max_results]
+	}
+
+	c.JSON(http.StatusOK, stations)
+}
+
+// proximity multiplies a text score by up to 2, halving the boost every
+// PROXIMITY_BOOST_SCALE meters.
+const PROXIMITY_BOOST_SCALE = 5000
+
+// how many text matches are considered before proximity reranks them.
+const TEXT_CANDIDATES_PER_RESULT = 5
+
+const MAX_AUTOCOMPLETE_CANDIDATES = 500
+
+func ProximityBoost(score float64, distance float64) float64 {
+	return score * (1 + 1/(1+distance/PROXIMITY_BOOST_SCALE))
+}
+
+// Full-text search over station name, address and description, optionally
+// boosted by proximity.
+func HandleTextSearchStations(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[TextSearchStationsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(Tokenize(body_data.Query)) == 0 {
+		c.JSON(http.StatusBadRequest, "No search query provided")
+		return
+	}
+
+	max_results := min(body_data.MaxResults, max_station_results)
+	if max_results <= 0 {
+		max_results = max_station_results
+	}
+	candidate_count := max_results
+	if body_data.Coordinates != nil {
+		candidate_count *= TEXT_CANDIDATES_PER_RESULT
+	}
+
+	// $text has to be in the first stage, so proximity is applied afterwards.
+	pipeline := bson.A{
+		bson.D{
+			{"$match", append(VisibleStationMatch(),
+				bson.E{"$text", bson.D{{"$search", body_data.Query}}},
+			)},
+		},
+		bson.D{
+			{"$addFields", bson.D{
+				{"score", bson.D{{"$meta", "textScore"}}},
+			}},
+		},
+		bson.D{
+			{"$sort", bson.D{{"score", -1}, {"_id", 1}}},
+		},
+		bson.D{
+			{"$limit", candidate_count},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Chargers"},
+				{"localField", "_id"},
+				{"foreignField", "station_id"},
+				{"as", "chargers"},
+				{"pipeline", bson.A{
+					bson.D{{"$match", bson.D{{"is_decommissioned", bson.D{{"$ne", true}}}}}},
+				}},
+			}},
+		},
+		AverageRatingStage(),
+	}
+
+	stations, err := Aggregate[TextSearchStationOutput](STATION_COLL, pipeline)
+	if err != nil {
+		log.Printf("Error with MongoDB aggregation: %v", err)
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if body_data.Coordinates != nil {
+		for i := range stations {
+			stations[i].Distance = HaversineDistance(*body_data.Coordinates, stations[i].Coordinates)
+			stations[i].Score = ProximityBoost(stations[i].Score, stations[i].Distance)
+		}
+		sort.SliceStable(stations, func(i, j int) bool {
+			return stations[i].Score > stations[j].Score
+		})
+	}
+	if int64(len(stations)) > max_results {
+		stations = stations[:max_results]
+	}
+
+	c.JSON(http.StatusOK, stations)
+}
+
+// Typo-tolerant prefix matching on station names and addresses. Every word
+// of the query has to match, the last one as a prefix.
+func HandleAutocompleteStations(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[TextSearchStationsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query_tokens := Tokenize(body_data.Query)
+	if len(query_tokens) == 0 {
+		c.JSON(http.StatusOK, []StationSuggestion{})
+		return
+	}
+
+	max_results := min(body_data.MaxResults, max_station_results)
+	if max_results <= 0 {
+		max_results = max_station_results
+	}
+
+	// every query word has to match, so candidates share the first two
+	// letters with each of them. typos are only tolerated after that, which
+	// keeps the regexes anchored and indexed.
+	prefixes := bson.A{}
+	for _, token := range query_tokens {
+		runes := []rune(token)
+		prefix := string(runes[:min(2, len(runes))])
+		prefixes = append(prefixes, bson.D{
+			{"search_tokens", bson.D{{"$regex", "^" + regexp.QuoteMeta(prefix)}}},
+		})
+	}
+	match := append(VisibleStationMatch(), bson.E{"$and", prefixes})
+
+	// when there are more candidates than we score, keep the closest ones,
+	// or failing a position, a stable slice of them.
+	pipeline := bson.A{}
+	if body_data.Coordinates != nil {
+		pipeline = append(pipeline, bson.D{
+			{"$geoNear", bson.D{
+				{"near", bson.D{
+					{"type", "Point"},
+					{"coordinates", body_data.Coordinates},
+				}},
+				{"query", match},
+				{"spherical", true},
+				{"key", "coordinates"},
+				{"distanceField", "distance"},
+			}},
+		})
+	} else {
+		pipeline = append(pipeline,
+			bson.D{{"$match", match}},
+			bson.D{{"$sort", bson.D{{"name", 1}, {"_id", 1}}}},
+		)
+	}
+	pipeline = append(pipeline, bson.D{{"$limit", MAX_AUTOCOMPLETE_CANDIDATES}})
+	candidates, err := Aggregate[StationSuggestion](STATION_COLL, pipeline)
+	if err != nil {
+		log.Printf("Error with MongoDB aggregation: %v", err)
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	suggestions := []StationSuggestion{}
+	for _, candidate := range candidates {
+		score, matched := AutocompleteScore(query_tokens, candidate.SearchTokens)
+		if !matched {
+			continue
+		}
+
+		candidate.Score = score
+		if body_data.Coordinates != nil {
+			candidate.Distance = HaversineDistance(*body_data.Coordinates, candidate.Coordinates)
+			candidate.Score = ProximityBoost(candidate.Score, candidate.Distance)
+		}
+		suggestions = append(suggestions, candidate)
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].Name < suggestions[j].Name
+	})
+	if int64(len(suggestions)) > max_results {
+		suggestions = suggestions[:max_results]
+	}
+
+	c.JSON(http.StatusOK, suggestions)
+}
+
+// Scores how well a station's words match the query. Each query word earns
+// 1 for an exact match, less for every typo, and the station only matches
+// when all query words do.
+func AutocompleteScore(query_tokens []string, station_tokens []string) (float64, bool) {
+	score := 0.0
+	for i, query_token := range query_tokens {
+		is_prefix := i == len(query_tokens)-1
+		allowed := AllowedTypos(query_token)
+
+		best := allowed + 1
+		for _, station_token := range station_tokens {
+			if is_prefix {
+				best = min(best, PrefixEditDistance(query_token, station_token))
+			} else {
+				best = min(best, EditDistance(query_token, station_token))
+			}
+		}
+		if best > allowed {
+			return 0, false
+		}
+		score += 1 / float64(1+best)
+	}
+	return score, true
+}
+
+// Fills in search_tokens for stations created before autocomplete existed.
+func BackfillStationSearchTokens() {
+	stations, err := GetStations(bson.D{{"search_tokens", bson.D{{"$exists", false}}}}, 0)
+	if err != nil {
+		log.Printf("Error finding stations without search tokens: %v", err)
+		return
+	}
+
+	for _, station := range stations {
+		err = UpdateOne(
+			STATION_COLL,
+			bson.D{{"_id", station.ID}},
+			bson.D{{"$set", bson.D{
+				{"search_tokens", StationSearchTokens(station.Name, station.Address)},
+			}}},
+		)
+		if err != nil {
+			log.Printf("Error backfilling search tokens for station %s: %v", station.ID.Hex(), err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -24,18 +25,62 @@ func HandleStartSession(c *gin.Context) {
 		return
 	}
 
+	charger, err := GetCharger(append(SessionChargerMatch(start_session_data),
+		bson.E{"is_archived", bson.D{{"$ne", true}}},
+		bson.E{"is_decommissioned", bson.D{{"$ne", true}}},
+	))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// imported chargers can't be billed until the owner sets a price.
+	if charger.PriceUnknown {
+		c.JSON(http.StatusConflict, "This charger has no price set yet")
+		return
+	}
+
+	// a driver at an unlisted station's charger counts as having its link.
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	can_access, err := CanAccessStation(station, user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !can_access {
+		c.JSON(http.StatusForbidden, "This charger is only available to approved guests")
+		return
+	}
+
+	maintenance, err := SessionMaintenanceConflict(charger.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if maintenance != nil {
+		c.JSON(http.StatusConflict, MaintenanceConflictMessage(maintenance))
+		return
+	}
+
 	// search for ongoing sessions with the current charger, or the current user.
 	filter := bson.D{
 		{"end_timestamp", 0}, // end_timestamp of 0 means not done.
 		{"$or", []interface{}{
 			bson.D{{"user_id", user_id}},
-			bson.D{{"charger_id", start_session_data.ChargerID}},
+			bson.D{{"charger_id", charger.ID}},
 		}},
 	}
 	conflicting_session, err := GetOne[Session](SESSION_COLL, filter)
 	if err == nil {
 		same_user := conflicting_session.UserID == user_id
-		same_charger := conflicting_session.ChargerID == start_session_data.ChargerID
+		same_charger := conflicting_session.ChargerID == charger.ID
 		if same_user && same_charger {
 			c.JSON(http.StatusInternalServerError, "You already have a session open with this charger")
 			return
@@ -52,10 +97,21 @@ func HandleStartSession(c *gin.Context) {
 		return
 	}
 
+	// taking the charger is atomic, so only one driver gets it.
+	_, err = TransitionChargerStatus(charger.ID, session_start_statuses, CHARGER_IN_USE, STATUS_REASON_SESSION_START, &user_id)
+	if err == ErrInvalidTransition {
+		c.JSON(http.StatusConflict, "This charger is not available")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	session := Session{
 		ID:             primitive.NewObjectID(),
 		UserID:         user_id,
-		ChargerID:      start_session_data.ChargerID,
+		ChargerID:      charger.ID,
 		StartTimestamp: time.Now().Unix(),
 		EndTimestamp:   0,
 		PaymentAmount:  0,
@@ -63,6 +119,7 @@ func HandleStartSession(c *gin.Context) {
 	}
 	object_id, err := CreateOne(SESSION_COLL, session)
 	if err != nil {
+		TransitionChargerStatus(charger.ID, []string{CHARGER_IN_USE}, CHARGER_AVAILABLE, STATUS_REASON_SESSION_FAILED, &user_id)
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -95,22 +152,52 @@ func HandleEndSession(c *gin.Context) {
 		{"user_id", user_id},
 		{"end_timestamp", 0},
 	}
+	open_session, err := GetOne[Session](SESSION_COLL, filter)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, "No such session found.")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the charge point keeps charging until it stops the transaction itself.
+	if open_session.TransactionID != 0 {
+		c.JSON(http.StatusConflict, "This session is run by its charger, end it through /user/remote-stop-session")
+		return
+	}
+
+	// a metered session is billed on its readings, not what the app reports.
+	payment_amount := end_session_data.PaymentAmount
+	power_used := end_session_data.PowerUsed
+	if open_session.MeterReadingCount > 0 {
+		charger, err := GetCharger(bson.D{{"_id", open_session.ChargerID}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		power_used = open_session.PowerUsed
+		payment_amount = power_used * charger.Price
+	}
+
+	// the meter position guards against readings landing in between.
+	filter = append(filter, bson.E{"meter_last_at", open_session.MeterLastAt})
 	update := bson.D{
 		{"$set", bson.D{
-			{"payment_amount", end_session_data.PaymentAmount},
-			{"power_used", end_session_data.PowerUsed},
+			{"payment_amount", payment_amount},
+			{"power_used", power_used},
 			{"end_timestamp", time.Now().Unix()},
 		}},
 	}
-	err = UpdateOne(SESSION_COLL, filter, update)
-	if err == mongo.ErrNoDocuments {
-		c.JSON(http.StatusInternalServerError, "No such session found.")
-		return
-	}
+	res, err := mongoClient.Database("GoCharge").Collection(SESSION_COLL).UpdateOne(context.TODO(), filter, update)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, "Session changed while ending, retry")
+		return
+	}
 
 	session, err := GetOne[Session](SESSION_COLL, bson.D{{"_id", end_session_data.ID}})
 	if err != nil {
@@ -118,5 +205,12 @@ func HandleEndSession(c *gin.Context) {
 		return
 	}
 
+	// a charger marked out of order mid-session stays that way.
+	_, err = TransitionChargerStatus(session.ChargerID, []string{CHARGER_IN_USE}, CHARGER_AVAILABLE, STATUS_REASON_SESSION_END, &user_id)
+	if err != nil && err != ErrInvalidTransition {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	c.JSON(http.StatusOK, session)
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// short codes skip 0/O, 1/I/L and the like, so they can be read off a
+// sticker and typed in.
+const SHORT_CODE_ALPHABET = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+const SHORT_CODE_LENGTH = 6
+const SHORT_CODE_ATTEMPTS = 5
+
+const DEFAULT_CHARGER_LINK_URL = "gocharge://charger/"
+const DEFAULT_QR_SIZE = 512
+const MIN_QR_SIZE = 128
+const MAX_QR_SIZE = 2048
+
+// deep links on the QR codes are this followed by the short code.
+var charger_link_url = DEFAULT_CHARGER_LINK_URL
+
+func InitShortCodeConfig() {
+	if url := os.Getenv("CHARGER_LINK_URL"); url != "" {
+		charger_link_url = url
+	}
+}
+
+func GenShortCode() (string, error) {
+	return GenCode(SHORT_CODE_LENGTH)
+}
+
+// A random code of the given length from SHORT_CODE_ALPHABET.
+func GenCode(length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(SHORT_CODE_ALPHABET)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = SHORT_CODE_ALPHABET[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Uppercases a typed code and drops spaces and dashes.
+func NormalizeShortCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func ChargerLink(charger Charger) string {
+	return charger_link_url + charger.ShortCode
+}
+
+// Gives the charger a fresh short code, retrying on the rare collision. The
+// old code stops working right away.
+func AssignShortCode(charger_id primitive.ObjectID) (string, error) {
+	for attempt := 0; attempt < SHORT_CODE_ATTEMPTS; attempt++ {
+		code, err := GenShortCode()
+		if err != nil {
+			return "", err
+		}
+		err = UpdateOne(
+			CHARGER_COLL,
+			bson.D{{"_id", charger_id}},
+			bson.D{{"$set", bson.D{{"short_code", code}}}},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return code, err
+	}
+	return "", fmt.Errorf("no free short code after %d attempts", SHORT_CODE_ATTEMPTS)
+}
+
+// Gives chargers from before short codes one.
+func BackfillChargerShortCodes() {
+	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{{"short_code", bson.D{{"$in", bson.A{"", nil}}}}}, 0)
+	if err != nil {
+		log.Printf("failed to backfill charger short codes: %s", err)
+		return
+	}
+	for _, charger := range chargers {
+		_, err = AssignShortCode(charger.ID)
+		if err != nil {
+			log.Printf("failed to backfill charger short codes: %s", err)
+			return
+		}
+	}
+	if len(chargers) > 0 {
+		log.Printf("assigned short codes to %d chargers", len(chargers))
+	}
+}
+
+// The charger a session request points at, by id or by short code.
+func SessionChargerMatch(body_data NewSessionInput) bson.D {
+	if body_data.ChargerID.IsZero() && body_data.ShortCode != "" {
+		return bson.D{{"short_code", NormalizeShortCode(body_data.ShortCode)}}
+	}
+	return bson.D{{"_id", body_data.ChargerID}}
+}
+
+// Renders a QR code as SVG, one square per dark module.
+func QRCodeSVG(code *qrcode.QRCode, size int) []byte {
+	bitmap := code.Bitmap()
+	modules := len(bitmap)
+
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, is_dark := range row {
+			if is_dark {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+	return svg.Bytes()
+}
+
+// Get a printable QR code linking to a charger, as png or svg.
+func HandleGetChargerQRCode(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	charger_id, err := primitive.ObjectIDFromHex(c.Query("charger_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "charger_id must be a charger id")
+		return
+	}
+	format := c.DefaultQuery("format", "png")
+	if format != "png" && format != "svg" {
+		c.JSON(http.StatusBadRequest, "Format must be 'png' or 'svg'")
+		return
+	}
+	size := DEFAULT_QR_SIZE
+	if c.Query("size") != "" {
+		size, err = strconv.Atoi(c.Query("size"))
+		if err != nil || size < MIN_QR_SIZE || size > MAX_QR_SIZE {
+			c.JSON(http.StatusBadRequest, "Size must be between 128 and 2048 pixels")
+			return
+		}
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", charger_id}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+	if charger.IsDecommissioned {
+		c.JSON(http.StatusConflict, "Charger is decommissioned")
+		return
+	}
+	if charger.ShortCode == "" {
+		charger.ShortCode, err = AssignShortCode(charger.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// high recovery, since stickers get scratched.
+	code, err := qrcode.New(ChargerLink(charger), qrcode.High)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := "charger-" + charger.ShortCode + "." + format
+	c.Header("Content-Disposition", `inline; filename="`+filename+`"`)
+	if format == "svg" {
+		c.Data(http.StatusOK, "image/svg+xml", QRCodeSVG(code, size))
+		return
+	}
+	png, err := code.PNG(size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// Replace a charger's short code, e.g. after its sticker was defaced. Printed
+// codes with the old one stop working.
+func HandleRegenerateChargerCode(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+	if charger.IsDecommissioned {
+		c.JSON(http.StatusConflict, "Charger is decommissioned")
+		return
+	}
+
+	charger.ShortCode, err = AssignShortCode(charger.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, ChargerCodeOutput{charger.ID, charger.ShortCode, ChargerLink(charger)})
+}
+
+// Look up the charger behind a scanned or typed code, with its station.
+func HandleGetChargerByCode(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerCodeInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{
+		{"short_code", NormalizeShortCode(body_data.ShortCode)},
+		{"is_archived", bson.D{{"$ne", true}}},
+		{"is_decommissioned", bson.D{{"$ne", true}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No charger with this code found")
+		return
+	}
+	station, err := GetStation(bson.D{{"_id", charger.StationID}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// standing at the charger counts as having the station's link.
+	can_access, err := CanAccessStation(station, user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !can_access {
+		c.JSON(http.StatusForbidden, "This charger is only available to approved guests")
+		return
+	}
+
+	c.JSON(http.StatusOK, ChargerByCodeOutput{station, charger})
+}
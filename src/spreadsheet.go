@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// one row per charger. station columns repeat on each of a station's rows,
+// and a station without chargers gets a single row with blank charger columns.
+var station_sheet_columns = []string{
+	"station_id",
+	"station_name",
+	"address",
+	"latitude",
+	"longitude",
+	"station_description",
+	"amenities",
+	"charger_name",
+	"charger_description",
+	"connector",
+	"power",
+	"price",
+}
+
+const STATION_SHEET_NAME = "Stations"
+const MAX_STATION_SHEET_ROWS = 5000
+const MAX_STATION_SHEET_BYTES = 10 << 20
+
+// coordinates survive a round trip through a spreadsheet to about this many
+// degrees.
+const SHEET_COORDINATE_EPSILON = 1e-6
+
+type StationSheetRow struct {
+	Line               int
+	StationID          string
+	StationName        string
+	Address            string
+	Coordinates        [2]float64
+	StationDescription string
+	Amenities          []string
+	ChargerName        string
+	ChargerDescription string
+	Connector          string
+	Power              string
+	Price              float64
+}
+
+type StationSheetUpdate struct {
+	StationID   primitive.ObjectID
+	Description string
+	Amenities   []string
+}
+
+// everything an import will write, gathered before anything is written.
+type StationSheetPlan struct {
+	NewStations    []Station
+	StationUpdates []StationSheetUpdate
+	NewChargers    []Charger
+	ChargerUpdates []Charger
+}
+
+func ReadSheetRecords(file io.Reader, filename string) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		return reader.ReadAll()
+	case ".xlsx":
+		workbook, err := excelize.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer workbook.Close()
+		return workbook.GetRows(workbook.GetSheetName(0))
+	}
+	return nil, errors.New("File must be a .csv or .xlsx spreadsheet")
+}
+
+// Maps records to rows by header name, reporting cells that don't parse.
+func ParseStationSheet(records [][]string) ([]StationSheetRow, []RowError) {
+	if len(records) == 0 {
+		return nil, []RowError{{Row: 1, Message: "Spreadsheet is empty"}}
+	}
+
+	columns := map[string]int{}
+	for i, header := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(header))] = i
+	}
+	row_errors := []RowError{}
+	for _, column := range station_sheet_columns {
+		if _, ok := columns[column]; !ok {
+			row_errors = append(row_errors, RowError{Row: 1, Column: column, Message: "Missing column"})
+		}
+	}
+	if len(row_errors) > 0 {
+		return nil, row_errors
+	}
+	if len(records)-1 > MAX_STATION_SHEET_ROWS {
+		return nil, []RowError{{Row: 1, Message: fmt.Sprintf("Spreadsheet has more than %d rows", MAX_STATION_SHEET_ROWS)}}
+	}
+
+	rows := []StationSheetRow{}
+	for i, record := range records[1:] {
+		line := i + 2
+		cell := func(column string) string {
+			index := columns[column]
+			if index >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[index])
+		}
+		number := func(column string) float64 {
+			value := cell(column)
+			if value == "" {
+				return 0
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				row_errors = append(row_errors, RowError{Row: line, Column: column, Message: "Not a number"})
+			}
+			return parsed
+		}
+
+		if strings.Join(record, "") == "" {
+			continue
+		}
+		row := StationSheetRow{
+			Line:               line,
+			StationID:          cell("station_id"),
+			StationName:        cell("station_name"),
+			Address:            cell("address"),
+			Coordinates:        [2]float64{number("longitude"), number("latitude")},
+			StationDescription: cell("station_description"),
+			Amenities:          []string{},
+			ChargerName:        cell("charger_name"),
+			ChargerDescription: cell("charger_description"),
+			Connector:          strings.ToLower(cell("connector")),
+			Power:              strings.ToLower(cell("power")),
+			Price:              number("price"),
+		}
+		for _, amenity := range strings.Split(cell("amenities"), ";") {
+			amenity = strings.TrimSpace(amenity)
+			if amenity != "" {
+				row.Amenities = append(row.Amenities, amenity)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, row_errors
+}
+
+// Checks a row on its own, normalizing its connector and power level.
+func ValidateStationSheetRow(row *StationSheetRow, catalog ChargerCatalog) []RowError {
+	row_errors := []RowError{}
+	invalid := func(column string, message string) {
+		row_errors = append(row_errors, RowError{Row: row.Line, Column: column, Message: message})
+	}
+
+	if row.StationName == "" {
+		invalid("station_name", "Required")
+	}
+	if row.Address == "" {
+		invalid("address", "Required")
+	}
+	if row.Coordinates[1] < -90 || row.Coordinates[1] > 90 {
+		invalid("latitude", "Must be between -90 and 90")
+	}
+	if row.Coordinates[0] < -180 || row.Coordinates[0] > 180 {
+		invalid("longitude", "Must be between -180 and 180")
+	}
+	if row.ChargerName == "" {
+		if row.ChargerDescription != "" || row.Connector != "" || row.Power != "" || row.Price != 0 {
+			invalid("charger_name", "Required when other charger columns are set")
+		}
+		return row_errors
+	}
+	connector, ok := catalog.Resolve(CATALOG_KIND_CONNECTOR, row.Connector)
+	if ok && connector.IsActive {
+		row.Connector = connector.Key
+	} else {
+		invalid("connector", ErrUnknownConnector.Error())
+	}
+	power, ok := catalog.Resolve(CATALOG_KIND_POWER, row.Power)
+	if ok && power.IsActive {
+		row.Power = power.Key
+	} else {
+		invalid("power", ErrUnknownPowerLevel.Error())
+	}
+	if row.Price < 0 {
+		invalid("price", "Can't be negative")
+	}
+	return row_errors
+}
+
+func SameStationColumns(a StationSheetRow, b StationSheetRow) bool {
+	return a.StationName == b.StationName &&
+		a.Address == b.Address &&
+		a.Coordinates == b.Coordinates &&
+		a.StationDescription == b.StationDescription &&
+		strings.Join(a.Amenities, ";") == strings.Join(b.Amenities, ";")
+}
+
+func SameCoordinates(a [2]float64, b [2]float64) bool {
+	return math.Abs(a[0]-b[0]) < SHEET_COORDINATE_EPSILON && math.Abs(a[1]-b[1]) < SHEET_COORDINATE_EPSILON
+}
+
+// Checks every row against the database and works out what to write. Rows
+// for a station are grouped by station_id, or by name for new stations.
+func PlanStationSheet(user_id primitive.ObjectID, rows []StationSheetRow) (StationSheetPlan, []RowError) {
+	plan := StationSheetPlan{
+		NewStations:    []Station{},
+		StationUpdates: []StationSheetUpdate{},
+		NewChargers:    []Charger{},
+		ChargerUpdates: []Charger{},
+	}
+	row_errors := []RowError{}
+	invalid := func(row StationSheetRow, column string, message string) {
+		row_errors = append(row_errors, RowError{Row: row.Line, Column: column, Message: message})
+	}
+
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		return plan, []RowError{{Row: 1, Message: err.Error()}}
+	}
+
+	groups := map[string][]StationSheetRow{}
+	group_keys := []string{}
+	for i := range rows {
+		row_errors = append(row_errors, ValidateStationSheetRow(&rows[i], catalog)...)
+		row := rows[i]
+
+		key := "id:" + row.StationID
+		if row.StationID == "" {
+			key = "name:" + strings.ToLower(row.StationName)
+		}
+		if _, ok := groups[key]; !ok {
+			group_keys = append(group_keys, key)
+		}
+		groups[key] = append(groups[key], row)
+	}
+	if len(row_errors) > 0 {
+		return plan, row_errors
+	}
+
+	for _, key := range group_keys {
+		group := groups[key]
+		first := group[0]
+
+		is_consistent := true
+		charger_names := map[string]bool{}
+		for _, row := range group {
+			if !SameStationColumns(first, row) {
+				invalid(row, "", fmt.Sprintf("Station columns differ from row %d of the same station", first.Line))
+				is_consistent = false
+			}
+			if row.ChargerName != "" {
+				if charger_names[row.ChargerName] {
+					invalid(row, "charger_name", "Charger name repeats within the station")
+					is_consistent = false
+				}
+				charger_names[row.ChargerName] = true
+			}
+		}
+		if !is_consistent {
+			continue
+		}
+
+		existing_chargers := map[string]Charger{}
+		var station_id primitive.ObjectID
+		var current_amenities []string
+
+		if first.StationID != "" {
+			id, err := primitive.ObjectIDFromHex(first.StationID)
+			if err != nil {
+				invalid(first, "station_id", "Not a valid station id")
+				continue
+			}
+			station, err := AuthorizeStation(user_id, id, PERM_EDIT_STATION)
+			if err != nil {
+				invalid(first, "station_id", err.Error())
+				continue
+			}
+			if station.IsArchived {
+				invalid(first, "station_id", "Station is archived")
+				continue
+			}
+			if station.Name != first.StationName || station.Address != first.Address || !SameCoordinates(station.Coordinates, first.Coordinates) {
+				invalid(first, "", "Name, address and coordinates of existing stations can only change through edit-station")
+				continue
+			}
+			station_id = station.ID
+			current_amenities = station.Amenities
+
+			chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{
+				{"station_id", station_id},
+				{"is_decommissioned", bson.D{{"$ne", true}}},
+			}, 0)
+			if err != nil {
+				invalid(first, "", err.Error())
+				continue
+			}
+			for _, charger := range chargers {
+				existing_chargers[charger.Name] = charger
+			}
+		}
+
+		amenities, err := ValidateAmenities(first.Amenities, current_amenities)
+		if err != nil {
+			invalid(first, "amenities", err.Error())
+			continue
+		}
+
+		if first.StationID != "" {
+			plan.StationUpdates = append(plan.StationUpdates, StationSheetUpdate{
+				StationID:   station_id,
+				Description: first.StationDescription,
+				Amenities:   amenities,
+			})
+		} else {
+			location, err := CheckStationLocation(first.Address, first.Coordinates)
+			if err != nil {
+				invalid(first, "address", err.Error())
+				continue
+			}
+			station_id = primitive.NewObjectID()
+			duplicate_ids, err := FindPossibleDuplicates(station_id, location.Coordinates, location.Address, nil)
+			if err != nil {
+				invalid(first, "", err.Error())
+				continue
+			}
+
+			// new stations wait for admin approval, as with request-station.
+			plan.NewStations = append(plan.NewStations, Station{
+				ID:               station_id,
+				OwnerID:          user_id,
+				PictureURLs:      []string{},
+				Name:             first.StationName,
+				Description:      first.StationDescription,
+				Coordinates:      location.Coordinates,
+				Address:          location.Address,
+				SearchTokens:     StationSearchTokens(first.StationName, location.Address),
+				LocationMismatch: location.IsMismatch,
+				MismatchMeters:   location.MismatchMeters,
+				CoLocatedIDs:     []primitive.ObjectID{},
+				DuplicateIDs:     duplicate_ids,
+				Amenities:        amenities,
+			})
+		}
+
+		for _, row := range group {
+			if row.ChargerName == "" {
+				continue
+			}
+			charger := Charger{
+				ID:             primitive.NewObjectID(),
+				StationID:      station_id,
+				Name:           row.ChargerName,
+				Description:    row.ChargerDescription,
+				KWhTypesId:     row.Power,
+				ChargerTypesId: row.Connector,
+				Status:         CHARGER_AVAILABLE,
+				Price:          row.Price,
+				TotalPayments:  0,
+			}
+			if existing, ok := existing_chargers[row.ChargerName]; ok {
+				charger.ID = existing.ID
+				plan.ChargerUpdates = append(plan.ChargerUpdates, charger)
+			} else {
+				plan.NewChargers = append(plan.NewChargers, charger)
+			}
+		}
+	}
+
+	return plan, row_errors
+}
+
+// Writes a plan in one transaction, so a failure part way leaves nothing
+// behind.
+func ApplyStationSheetPlan(plan StationSheetPlan) error {
+	session, err := mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(context.TODO(), func(ctx mongo.SessionContext) (interface{}, error) {
+		db := mongoClient.Database("GoCharge")
+
+		if len(plan.NewStations) > 0 {
+			docs := []interface{}{}
+			for _, station := range plan.NewStations {
+				docs = append(docs, station)
+			}
+			_, err := db.Collection(STATION_COLL).InsertMany(ctx, docs)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, update := range plan.StationUpdates {
+			_, err := db.Collection(STATION_COLL).UpdateOne(ctx,
+				bson.D{{"_id", update.StationID}},
+				bson.D{{"$set", bson.D{
+					{"description", update.Description},
+					{"amenities", update.Amenities},
+				}}},
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(plan.NewChargers) > 0 {
+			docs := []interface{}{}
+			for _, charger := range plan.NewChargers {
+				short_code, err := GenShortCode()
+				if err != nil {
+					return nil, err
+				}
+				charger.ShortCode = short_code
+				docs = append(docs, charger)
+			}
+			_, err := db.Collection(CHARGER_COLL).InsertMany(ctx, docs)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, charger := range plan.ChargerUpdates {
+			_, err := db.Collection(CHARGER_COLL).UpdateOne(ctx,
+				bson.D{
+					{"_id", charger.ID},
+					{"station_id", charger.StationID},
+				},
+				bson.D{
+					{"$set", bson.D{
+						{"description", charger.Description},
+						{"kWh_types_id", charger.KWhTypesId},
+						{"charger_types_id", charger.ChargerTypesId},
+						{"price", charger.Price},
+					}},
+					{"$unset", bson.D{{"price_unknown", ""}}},
+				},
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+	return err
+}
+
+// Import stations and chargers from a spreadsheet upload. With dry_run=true
+// only the validation report comes back. Otherwise the import applies in full
+// or not at all.
+func HandleImportStations(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	is_dry_run := c.Query("dry_run") == "true"
+
+	file_header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "No file provided")
+		return
+	}
+	if file_header.Size > MAX_STATION_SHEET_BYTES {
+		c.JSON(http.StatusRequestEntityTooLarge, "File is too large")
+		return
+	}
+	file, err := file_header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	records, err := ReadSheetRecords(file, file_header.Filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := StationImportReport{
+		DryRun: is_dry_run,
+		Errors: []RowError{},
+	}
+
+	rows, row_errors := ParseStationSheet(records)
+	if len(row_errors) == 0 {
+		var plan StationSheetPlan
+		plan, row_errors = PlanStationSheet(user_id, rows)
+		report.StationsCreated = len(plan.NewStations)
+		report.StationsUpdated = len(plan.StationUpdates)
+		report.ChargersCreated = len(plan.NewChargers)
+		report.ChargersUpdated = len(plan.ChargerUpdates)
+
+		if len(row_errors) == 0 && !is_dry_run {
+			err = ApplyStationSheetPlan(plan)
+			if mongo.IsDuplicateKeyError(err) {
+				c.JSON(http.StatusConflict, "A charger with this name already exists at this station")
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, err.Error())
+				return
+			}
+			report.Applied = true
+		}
+	}
+	report.Errors = append(report.Errors, row_errors...)
+
+	if len(report.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func StationSheetRecords(stations []Station, chargers []Charger) [][]string {
+	by_station := map[primitive.ObjectID][]Charger{}
+	for _, charger := range chargers {
+		by_station[charger.StationID] = append(by_station[charger.StationID], charger)
+	}
+
+	format_float := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	records := [][]string{station_sheet_columns}
+	for _, station := range stations {
+		station_cells := []string{
+			station.ID.Hex(),
+			station.Name,
+			station.Address,
+			format_float(station.Coordinates[1]),
+			format_float(station.Coordinates[0]),
+			station.Description,
+			strings.Join(station.Amenities, ";"),
+		}
+		station_chargers := by_station[station.ID]
+		if len(station_chargers) == 0 {
+			records = append(records, append(station_cells, "", "", "", "", ""))
+			continue
+		}
+		for _, charger := range station_chargers {
+			records = append(records, append(append([]string{}, station_cells...),
+				charger.Name,
+				charger.Description,
+				charger.ChargerTypesId,
+				charger.KWhTypesId,
+				format_float(charger.Price),
+			))
+		}
+	}
+	return records
+}
+
+// Export the owner's stations and chargers in the import format, as csv by
+// default or xlsx with format=xlsx.
+func HandleExportStations(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, "Format must be 'csv' or 'xlsx'")
+		return
+	}
+
+	// archived stations can't be imported back, so they're left out.
+	stations, err := GetStations(bson.D{
+		{"owner_id", user_id},
+		{"is_deleted", bson.D{{"$ne", true}}},
+		{"is_archived", bson.D{{"$ne", true}}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	station_ids := []primitive.ObjectID{}
+	for _, station := range stations {
+		station_ids = append(station_ids, station.ID)
+	}
+	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{
+		{"station_id", bson.D{{"$in", station_ids}}},
+		{"is_decommissioned", bson.D{{"$ne", true}}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	records := StationSheetRecords(stations, chargers)
+
+	var buffer bytes.Buffer
+	content_type := "text/csv"
+	if format == "csv" {
+		writer := csv.NewWriter(&buffer)
+		err = writer.WriteAll(records)
+	} else {
+		content_type = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		err = WriteStationWorkbook(&buffer, records)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=stations."+format)
+	c.Data(http.StatusOK, content_type, buffer.Bytes())
+}
+
+func WriteStationWorkbook(out io.Writer, records [][]string) error {
+	workbook := excelize.NewFile()
+	defer workbook.Close()
+
+	err := workbook.SetSheetName(workbook.GetSheetName(0), STATION_SHEET_NAME)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		err = workbook.SetSheetRow(STATION_SHEET_NAME, cell, &record)
+		if err != nil {
+			return err
+		}
+	}
+	return workbook.Write(out)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"math"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -26,26 +29,85 @@ func HandleStationRequest(c *gin.Context) {
 		return
 	}
 
+	location, err := CheckStationLocation(station_data.Address, station_data.Coordinates)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	amenities, err := ValidateAmenities(station_data.Amenities, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	visibility, err := ValidateVisibility(station_data.Visibility)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	catalog, err := LoadChargerCatalog()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i, charger := range station_data.Chargers {
+		connector, power, err := catalog.NormalizeChargerTypes(charger.ChargerTypesId, charger.KWhTypesId, nil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, charger.Name+": "+err.Error())
+			return
+		}
+		station_data.Chargers[i].ChargerTypesId = connector
+		station_data.Chargers[i].KWhTypesId = power
+	}
+
+	share_token, err := GenInviteToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	station_id := primitive.NewObjectID()
+	co_located_ids, err := ValidateCoLocatedIDs(station_id, location.Coordinates, station_data.CoLocatedIDs)
+	if err == ErrInvalidCoLocated {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	duplicate_ids, err := FindPossibleDuplicates(station_id, location.Coordinates, location.Address, co_located_ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	new_station := Station{
-		ID:               primitive.NewObjectID(),
+		ID:               station_id,
 		OwnerID:          user_id,
 		PictureURLs:      []string{},
 		Name:             station_data.Name,
 		Description:      station_data.Description,
-		Coordinates:      station_data.Coordinates,
-		Address:          station_data.Address,
+		Coordinates:      location.Coordinates,
+		Address:          location.Address,
 		IsPublic:         false,
 		IsDenied:         false,
 		IsDisabled:       false,
 		OperationalHours: station_data.OperationalHours,
 		ReviewCount:      0,
 		ReviewScore:      0,
+		SearchTokens:     StationSearchTokens(station_data.Name, location.Address),
+		LocationMismatch: location.IsMismatch,
+		MismatchMeters:   location.MismatchMeters,
+		CoLocatedIDs:     co_located_ids,
+		DuplicateIDs:     duplicate_ids,
+		Amenities:        amenities,
+		Visibility:       visibility,
+		ShareToken:       share_token,
 	}
-	station_id, err := CreateStation(new_station)
-	if mongo.IsDuplicateKeyError(err) {
-		c.JSON(http.StatusConflict, "A station with this location must already exist")
-		return
-	}
+	_, err = CreateStation(new_station)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
@@ -67,13 +129,13 @@ func HandleStationRequest(c *gin.Context) {
 			Description:    charger.Description,
 			KWhTypesId:     charger.KWhTypesId,
 			ChargerTypesId: charger.ChargerTypesId,
-			Status:         "working",
+			Status:         CHARGER_AVAILABLE,
 			Price:          charger.Price,
 			TotalPayments:  0,
 		}
 		charger_id, err := CreateCharger(new_charger)
 		if mongo.IsDuplicateKeyError(err) {
-			c.JSON(http.StatusConflict, "A station with this location must already exist")
+			c.JSON(http.StatusConflict, "A charger with this name already exists at this station")
 			return
 		}
 		if err != nil {
@@ -139,6 +201,7 @@ func HandleUnapprovedStations(c *gin.Context) {
 			{"$match", bson.D{
 				{"is_public", false},
 				{"is_denied", false},
+				{"is_archived", bson.D{{"$ne", true}}},
 			}},
 		},
 		// join valid chargers
@@ -150,6 +213,15 @@ func HandleUnapprovedStations(c *gin.Context) {
 				{"as", "chargers"},
 			}},
 		},
+		// join stations this one may duplicate
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Stations"},
+				{"localField", "possible_duplicate_ids"},
+				{"foreignField", "_id"},
+				{"as", "possible_duplicates"},
+			}},
+		},
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
@@ -159,9 +231,8 @@ func HandleUnapprovedStations(c *gin.Context) {
 	c.JSON(http.StatusOK, stations)
 }
 
-const TRUE_MAX_RESULTS = 20
-
-// Get k-closest stations to a location. k is capped at 20.
+// Get the closest stations to a location, one page at a time. Pages are capped
+// at max_station_results, and next_cursor continues the same search.
 func HandleClosestStations(c *gin.Context) {
 	body_data, err := ReadBodyToStruct[FindStationsInput](c)
 	if err != nil {
@@ -169,11 +240,33 @@ func HandleClosestStations(c *gin.Context) {
 		return
 	}
 
-	max_results := min(body_data.MaxResults, TRUE_MAX_RESULTS)
+	max_results := min(body_data.MaxResults, max_station_results)
+	if max_results <= 0 {
+		max_results = max_station_results
+	}
+
+	// the cursor is only valid for the filters it was issued with.
+	filters := body_data
+	filters.Cursor = ""
+	filters.MaxResults = 0
+	filter_hash := HashSearchFilters(filters)
+
+	var cursor *StationCursor
+	if body_data.Cursor != "" {
+		decoded_cursor, err := DecodeStationCursor(body_data.Cursor, filter_hash)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		cursor = &decoded_cursor
+	}
 
-	if body_data.MaxPrice == 0 {
-		body_data.MaxPrice = math.MaxFloat64
+	sort_key, err := StationSortKey(body_data.Sort)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
 	}
+
 	if body_data.MaxRadius == 0 {
 		body_data.MaxRadius = math.MaxFloat64
 	}
@@ -191,78 +284,61 @@ func HandleClosestStations(c *gin.Context) {
 				{"distanceField", "distance"},
 			}},
 		},
-		bson.D{
-			{"$match", bson.D{
-				{"is_public", true},
-				{"is_disabled", false},
-				{"$expr", bson.D{
-					{"$gte", bson.A{
-						"$review_score",
-						bson.D{{"$multiply", bson.A{body_data.MinRating, "$review_count"}}},
-					}},
-				}},
-				{"$or", bson.A{
-					bson.D{{"$expr", bson.D{
-						{"$eq", bson.A{body_data.MinRating, 0}},
-					}}},
-					bson.D{{"$expr", bson.D{
-						{"$ne", bson.A{"$review_count", 0}},
-					}}},
-				}},
-			}},
-		},
-	}
-
-	matchConditions := bson.D{}
-
-	if len(body_data.Statuses) > 0 {
-		matchConditions = append(matchConditions, bson.E{"status", bson.D{{"$in", body_data.Statuses}}})
-	}
-	if len(body_data.PowerOutputs) > 0 {
-		matchConditions = append(matchConditions, bson.E{"kWh_types_id", bson.D{{"$in", body_data.PowerOutputs}}})
 	}
-	if len(body_data.PlugTypes) > 0 {
-		matchConditions = append(matchConditions, bson.E{"charger_types_id", bson.D{{"$in", body_data.PlugTypes}}})
+	// drivers also see guests-only stations they were approved for.
+	visible, ok := RequestStationAccessMatch(c, false)
+	if !ok {
+		return
 	}
+	pipeline = append(pipeline, StationFilterStages(visible, body_data.StationFilters)...)
+	pipeline = append(pipeline, bson.D{
+		{"$addFields", bson.D{{"sort_key", sort_key}}},
+	})
 
-	matchConditions = append(matchConditions, bson.E{"price", bson.D{{"$lte", body_data.MaxPrice}}})
-
-	if len(matchConditions) > 0 {
-		pipeline = append(pipeline, bson.D{
-			{"$lookup", bson.D{
-				{"from", "Chargers"},
-				{"localField", "_id"},
-				{"foreignField", "station_id"},
-				{"as", "chargers"},
-				{"pipeline", bson.A{
-					bson.D{
-						{"$match", matchConditions},
-					},
-				}},
-			}},
-		})
+	// the total is counted over the whole search, the page only past the cursor.
+	// one extra result is fetched to know whether there is a next page.
+	page_pipeline := bson.A{}
+	if cursor != nil {
+		page_pipeline = append(page_pipeline, StationCursorMatch(*cursor))
 	}
+	page_pipeline = append(page_pipeline,
+		bson.D{{"$sort", bson.D{{"sort_key", 1}, {"distance", 1}, {"_id", 1}}}},
+		bson.D{{"$limit", max_results + 1}},
+	)
 
 	pipeline = append(pipeline, bson.D{
-		{"$match", bson.D{
-			{"chargers.0", bson.D{
-				{"$exists", true},
+		{"$facet", bson.D{
+			{"stations", page_pipeline},
+			{"total", bson.A{
+				bson.D{{"$count", "count"}},
 			}},
 		}},
 	})
 
-	pipeline = append(pipeline, bson.D{
-		{"$limit", max_results},
-	})
-
-	stations, err := Aggregate[FindStationsOutput](STATION_COLL, pipeline)
+	results, err := Aggregate[ClosestStationsFacet](STATION_COLL, pipeline)
 	if err != nil {
 		log.Printf("Error with MongoDB aggregation: %v", err)
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, stations)
+	page := FindStationsPage{Stations: []FindStationsOutput{}}
+	if len(results) > 0 {
+		page.Stations = results[0].Stations
+		page.EstimatedTotal = FacetTotal(results[0].Total)
+	}
+
+	if int64(len(page.Stations)) > max_results {
+		page.Stations = page.Stations[:max_results]
+		last := page.Stations[max_results-1]
+		page.NextCursor, err = EncodeStationCursor(StationCursor{last.SortKey, last.Distance, last.ID, filter_hash})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, page)
 }
 
 func HandleFavoriteStation(c *gin.Context) {
@@ -285,6 +361,22 @@ func HandleFavoriteStation(c *gin.Context) {
 		return
 	}
 
+	// only stations the driver can reach can be favorited.
+	visible, err := StationAccessMatch(user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = GetStation(append(visible, bson.E{"_id", station_id}))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, "No such station found")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	err = UpdateUser(
 		bson.D{
 			{"_id", user_id},
@@ -353,6 +445,161 @@ func HandleUnfavoriteStation(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// Get the user's favorite stations with their chargers and live availability.
+// Favorites of deleted stations are pruned, and favorites of stations drivers
+// can't currently find are flagged.
+func HandleGetFavoriteStations(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[FavoriteStationsInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := GetUser(bson.D{{"_id", user_id}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	favorite_ids := NonNilIDs(user.FavoriteStationIDs)
+
+	visible, err := StationAccessMatch(user_id, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	stations, err := Aggregate[FavoriteStationOutput](STATION_COLL, bson.A{
+		bson.D{
+			{"$match", append(visible, bson.E{"_id", bson.D{{"$in", favorite_ids}}})},
+		},
+		bson.D{
+			{"$lookup", bson.D{
+				{"from", "Chargers"},
+				{"localField", "_id"},
+				{"foreignField", "station_id"},
+				{"as", "chargers"},
+				{"pipeline", bson.A{
+					bson.D{{"$match", bson.D{{"is_decommissioned", bson.D{{"$ne", true}}}}}},
+				}},
+			}},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// sort out favorites that weren't found.
+	existing, err := GetStations(bson.D{
+		{"_id", bson.D{{"$in", favorite_ids}}},
+		{"is_deleted", bson.D{{"$ne", true}}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	is_existing, is_visible := map[primitive.ObjectID]bool{}, map[primitive.ObjectID]bool{}
+	for _, station := range existing {
+		is_existing[station.ID] = true
+	}
+	for _, station := range stations {
+		is_visible[station.ID] = true
+	}
+
+	deleted_ids, unavailable_ids := []primitive.ObjectID{}, []primitive.ObjectID{}
+	for _, favorite_id := range favorite_ids {
+		if !is_existing[favorite_id] {
+			deleted_ids = append(deleted_ids, favorite_id)
+		} else if !is_visible[favorite_id] {
+			unavailable_ids = append(unavailable_ids, favorite_id)
+		}
+	}
+	if len(deleted_ids) > 0 {
+		err = UpdateUser(
+			bson.D{{"_id", user_id}},
+			bson.D{{"$pull", bson.D{
+				{"favorite_station_ids", bson.D{{"$in", deleted_ids}}},
+			}}},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// chargers with an open session are busy, whatever their status says.
+	charger_ids := []primitive.ObjectID{}
+	for _, station := range stations {
+		for _, charger := range station.Chargers {
+			charger_ids = append(charger_ids, charger.ID)
+		}
+	}
+	open_sessions, err := GetAll[Session](SESSION_COLL, bson.D{
+		{"charger_id", bson.D{{"$in", charger_ids}}},
+		{"end_timestamp", 0},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	is_busy := map[primitive.ObjectID]bool{}
+	for _, session := range open_sessions {
+		is_busy[session.ChargerID] = true
+	}
+
+	now := time.Now()
+	for i := range stations {
+		station := &stations[i]
+		for j := range station.Chargers {
+			charger := &station.Chargers[j]
+			charger.IsAvailable = charger.Status == CHARGER_AVAILABLE && !is_busy[charger.ID]
+			if charger.IsAvailable {
+				station.AvailableChargers++
+			}
+		}
+		station.IsOpenNow = IsStationOpen(station.OperationalHours, now)
+		if body_data.Coordinates != nil {
+			distance := HaversineDistance(*body_data.Coordinates, station.Coordinates)
+			station.Distance = &distance
+		}
+	}
+
+	if body_data.Coordinates != nil {
+		sort.Slice(stations, func(i, j int) bool {
+			return *stations[i].Distance < *stations[j].Distance
+		})
+	}
+
+	c.JSON(http.StatusOK, FavoriteStationsOutput{stations, unavailable_ids})
+}
+
+// Whether a station is open at t. Hours are in UTC seconds since the start of
+// the day, indexed by weekday starting on Sunday. A week of all zeros means
+// the owner never set hours, so the station counts as always open. A day
+// whose end is before its start runs past midnight.
+func IsStationOpen(hours [7][2]int64, t time.Time) bool {
+	if hours == [7][2]int64{} {
+		return true
+	}
+
+	t = t.UTC()
+	day_hours := hours[t.Weekday()]
+	seconds := int64(t.Hour()*3600 + t.Minute()*60 + t.Second())
+
+	start, end := day_hours[0], day_hours[1]
+	if start <= end {
+		return start <= seconds && seconds < end
+	}
+	return seconds >= start || seconds < end
+}
+
 func HandleGetUserChargers(c *gin.Context) {
 	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
 	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
@@ -360,7 +607,10 @@ func HandleGetUserChargers(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
 		return
 	}
-	filter := bson.D{{"owner_id", user_id}}
+	filter := bson.D{
+		{"owner_id", user_id},
+		{"is_deleted", bson.D{{"$ne", true}}},
+	}
 	stations, err := GetStations(filter, 0)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chargers"})
@@ -383,7 +633,31 @@ func HandleGetStationAndChargers(c *gin.Context) {
 		return
 	}
 
-	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{{"station_id", station_data.StationID}}, TRUE_MAX_RESULTS)
+	// hosts and their staff always see their stations and every charger,
+	// drivers need access and only see chargers in service.
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	charger_filter := bson.D{{"station_id", station_data.StationID}}
+	_, err = AuthorizeStation(user_id, station.ID, PERM_VIEW_STATION)
+	if err != nil {
+		charger_filter = append(charger_filter, bson.E{"is_decommissioned", bson.D{{"$ne", true}}})
+		has_link := station_data.ShareToken != "" && station_data.ShareToken == station.ShareToken
+		can_access, err := CanAccessStation(station, user_id, has_link)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !can_access {
+			c.JSON(http.StatusForbidden, "This station is only visible to approved guests")
+			return
+		}
+	}
+
+	chargers, err := GetAll[Charger](CHARGER_COLL, charger_filter, max_station_results)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
@@ -407,24 +681,99 @@ func HandleEditStation(c *gin.Context) {
 		return
 	}
 
+	// ensure user may edit this station
+	current_station, err := AuthorizeStation(user_id, body_data.ID, PERM_EDIT_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	amenities, err := ValidateAmenities(body_data.Amenities, current_station.Amenities)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// clients that don't send visibility keep the station's.
+	if body_data.Visibility == "" {
+		body_data.Visibility = current_station.Visibility
+	}
+	visibility, err := ValidateVisibility(body_data.Visibility)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	location, err := CheckStationLocation(body_data.Address, body_data.Coordinates)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	co_located_ids, err := ValidateCoLocatedIDs(body_data.ID, location.Coordinates, body_data.CoLocatedIDs)
+	if err == ErrInvalidCoLocated {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	duplicate_ids, err := FindPossibleDuplicates(body_data.ID, location.Coordinates, location.Address, co_located_ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// cosmetic fields always apply right away.
+	update := bson.D{
+		{"picture_urls", body_data.PictureURLs},
+		{"description", body_data.Description},
+		{"operational_hours", body_data.OperationalHours},
+		{"is_disabled", body_data.IsDisabled},
+		{"amenities", amenities},
+		{"visibility", visibility},
+	}
+
+	// location fields of a published station wait for admin approval, while
+	// the published version stays live.
+	location_fields := StationLocationFields{
+		Name:             body_data.Name,
+		Address:          location.Address,
+		Coordinates:      location.Coordinates,
+		CoLocatedIDs:     co_located_ids,
+		LocationMismatch: location.IsMismatch,
+		MismatchMeters:   location.MismatchMeters,
+		DuplicateIDs:     duplicate_ids,
+	}
+	if !current_station.IsPublic {
+		update = append(update, location_fields.SetDoc()...)
+	} else if len(DiffLocationFields(LocationFieldsOf(current_station), location_fields)) > 0 {
+		revision_id, err := CreateStationRevision(current_station, user_id, location_fields)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		update = append(update, bson.E{"pending_revision_id", revision_id})
+	} else if current_station.PendingRevisionID != nil {
+		// the owner reverted their edit before it was reviewed.
+		err = UpdateOne(
+			STATION_REVISION_COLL,
+			bson.D{{"_id", *current_station.PendingRevisionID}, {"status", REVISION_PENDING}},
+			bson.D{{"$set", bson.D{{"status", REVISION_SUPERSEDED}}}},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		update = append(update, bson.E{"pending_revision_id", nil})
+	}
+
 	// edit station
 	err = UpdateOne(
 		STATION_COLL,
-		bson.D{
-			{"_id", body_data.ID},
-			{"owner_id", user_id}, // ensure owner owns this station
-		},
-		bson.D{
-			{"$set", bson.D{
-				{"picture_urls", body_data.PictureURLs},
-				{"name", body_data.Name},
-				{"description", body_data.Description},
-				{"coordinates", body_data.Coordinates},
-				{"address", body_data.Address},
-				{"operational_hours", body_data.OperationalHours},
-				{"is_disabled", body_data.IsDisabled},
-			}},
-		},
+		bson.D{{"_id", body_data.ID}},
+		bson.D{{"$set", update}},
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
@@ -440,3 +789,262 @@ func HandleEditStation(c *gin.Context) {
 
 	c.JSON(http.StatusOK, station)
 }
+
+const DEFAULT_DUPLICATE_RADIUS_METERS = 75
+
+// stations this close are treated as the same site whatever their addresses.
+const SAME_SITE_METERS = 10
+
+// how alike two addresses must be (shared words over all words) for nearby
+// stations to count as duplicates.
+const DUPLICATE_ADDRESS_SIMILARITY = 0.6
+
+// configurable through DUPLICATE_RADIUS_METERS.
+var duplicate_radius_meters float64 = DEFAULT_DUPLICATE_RADIUS_METERS
+
+func InitDuplicateConfig() {
+	duplicate_radius_meters = float64(ReadEnvInt64("DUPLICATE_RADIUS_METERS", DEFAULT_DUPLICATE_RADIUS_METERS))
+}
+
+var ErrInvalidCoLocated = errors.New("Co-located stations must exist and be nearby")
+
+// Checks the stations an owner declared co-located, so the declaration can't
+// hide duplicates elsewhere. Returns them without repeats.
+func ValidateCoLocatedIDs(station_id primitive.ObjectID, coordinates [2]float64, ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	unique := []primitive.ObjectID{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, id := range ids {
+		if id == station_id {
+			return nil, ErrInvalidCoLocated
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) == 0 {
+		return unique, nil
+	}
+
+	stations, err := GetStations(bson.D{{"_id", bson.D{{"$in", unique}}}}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(stations) != len(unique) {
+		return nil, ErrInvalidCoLocated
+	}
+	for _, station := range stations {
+		if HaversineDistance(coordinates, station.Coordinates) > duplicate_radius_meters {
+			return nil, ErrInvalidCoLocated
+		}
+	}
+	return unique, nil
+}
+
+// Finds existing stations that are probably the same site: very close by, or
+// nearby with a similar address. Stations the owner declared co-located are
+// left out, as are denied ones.
+func FindPossibleDuplicates(station_id primitive.ObjectID, coordinates [2]float64, address string, co_located_ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	nearby, err := Aggregate[FindStationsOutput](STATION_COLL, bson.A{
+		bson.D{
+			{"$geoNear", bson.D{
+				{"near", bson.D{
+					{"type", "Point"},
+					{"coordinates", coordinates},
+				}},
+				{"maxDistance", duplicate_radius_meters},
+				{"spherical", true},
+				{"key", "coordinates"},
+				{"distanceField", "distance"},
+				{"query", bson.D{
+					{"_id", bson.D{{"$nin", append([]primitive.ObjectID{station_id}, co_located_ids...)}}},
+					{"is_denied", false},
+				}},
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	duplicate_ids := []primitive.ObjectID{}
+	for _, station := range nearby {
+		if station.Distance <= SAME_SITE_METERS || AddressSimilarity(address, station.Address) >= DUPLICATE_ADDRESS_SIMILARITY {
+			duplicate_ids = append(duplicate_ids, station.ID)
+		}
+	}
+	return duplicate_ids, nil
+}
+
+// Jaccard similarity of the words in two addresses.
+func AddressSimilarity(a string, b string) float64 {
+	a_tokens, b_tokens := Tokenize(a), Tokenize(b)
+	if len(a_tokens) == 0 || len(b_tokens) == 0 {
+		return 0
+	}
+
+	in_a := map[string]bool{}
+	for _, token := range a_tokens {
+		in_a[token] = true
+	}
+	shared := 0
+	for _, token := range b_tokens {
+		if in_a[token] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a_tokens)+len(b_tokens)-shared)
+}
+
+// Archive a station and its chargers. Archived stations disappear for drivers
+// until an admin restores them.
+func HandleArchiveStation(c *gin.Context) {
+	RemoveStation(c, false)
+}
+
+// Delete a station and its chargers for good. The documents are kept, only
+// archived past restoring, so sessions and reviews that point at them stay
+// readable.
+func HandleDeleteStation(c *gin.Context) {
+	RemoveStation(c, true)
+}
+
+func RemoveStation(c *gin.Context, is_delete bool) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// only the owner may take a station down.
+	_, err = AuthorizeStation(user_id, body_data.StationID, PERM_MANAGE_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	// chargers can't disappear under a driver. they are flagged first, since
+	// archived chargers can't be taken, and then checked, so a session can't
+	// start in between.
+	chargers, err := GetAll[Charger](CHARGER_COLL, bson.D{
+		{"station_id", body_data.StationID},
+		{"is_archived", bson.D{{"$ne", true}}},
+	}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	charger_ids := []primitive.ObjectID{}
+	for _, charger := range chargers {
+		charger_ids = append(charger_ids, charger.ID)
+	}
+	err = UpdateMany(
+		CHARGER_COLL,
+		bson.D{{"_id", bson.D{{"$in", charger_ids}}}},
+		bson.D{{"$set", bson.D{{"is_archived", true}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	unarchive := func() {
+		err := UpdateMany(
+			CHARGER_COLL,
+			bson.D{{"_id", bson.D{{"$in", charger_ids}}}},
+			bson.D{{"$set", bson.D{{"is_archived", false}}}},
+		)
+		if err != nil {
+			log.Printf("Error unarchiving chargers of station %s: %v", body_data.StationID.Hex(), err)
+		}
+	}
+
+	_, err = GetOne[Session](SESSION_COLL, bson.D{
+		{"charger_id", bson.D{{"$in", charger_ids}}},
+		{"end_timestamp", 0},
+	})
+	if err == nil {
+		unarchive()
+		c.JSON(http.StatusConflict, "A charger at this station has a session open")
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		unarchive()
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = GetCharger(bson.D{
+		{"_id", bson.D{{"$in", charger_ids}}},
+		{"status", CHARGER_IN_USE},
+	})
+	if err == nil {
+		unarchive()
+		c.JSON(http.StatusConflict, "A charger at this station is in use")
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		unarchive()
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = UpdateOne(
+		STATION_COLL,
+		bson.D{{"_id", body_data.StationID}},
+		bson.D{{"$set", bson.D{
+			{"is_archived", true},
+			{"is_deleted", is_delete},
+			{"archived_at", time.Now()},
+		}}},
+	)
+	if err != nil {
+		unarchive()
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, "")
+}
+
+func HandleRestoreStation(c *gin.Context) {
+	body_data, err := ReadBodyToStruct[StationIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = UpdateOne(
+		STATION_COLL,
+		bson.D{
+			{"_id", body_data.StationID},
+			{"is_archived", true},
+			{"is_deleted", bson.D{{"$ne", true}}},
+		},
+		bson.D{{"$set", bson.D{
+			{"is_archived", false},
+			{"archived_at", nil},
+		}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusConflict, "An archived station with this id was not found")
+		return
+	}
+
+	err = UpdateMany(
+		CHARGER_COLL,
+		bson.D{{"station_id", body_data.StationID}},
+		bson.D{{"$set", bson.D{{"is_archived", false}}}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, "")
+}
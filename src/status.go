@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CHARGER_AVAILABLE = "available"
+const CHARGER_IN_USE = "in_use"
+const CHARGER_RESERVED = "reserved"
+const CHARGER_OUT_OF_ORDER = "out_of_order"
+const CHARGER_MAINTENANCE = "maintenance"
+const CHARGER_DECOMMISSIONED = "decommissioned"
+
+// why a status changed.
+const STATUS_REASON_SESSION_START = "session_start"
+const STATUS_REASON_SESSION_END = "session_end"
+const STATUS_REASON_SESSION_FAILED = "session_failed"
+const STATUS_REASON_OWNER = "owner"
+const STATUS_REASON_CHARGE_POINT = "charge_point"
+const STATUS_REASON_MAINTENANCE = "maintenance_window"
+const STATUS_REASON_FAULT_REPORTS = "fault_reports"
+
+// the statuses a charger can move to from each status. decommissioned is
+// final.
+var charger_transitions = map[string][]string{
+	CHARGER_AVAILABLE:      {CHARGER_IN_USE, CHARGER_RESERVED, CHARGER_OUT_OF_ORDER, CHARGER_MAINTENANCE, CHARGER_DECOMMISSIONED},
+	CHARGER_IN_USE:         {CHARGER_AVAILABLE, CHARGER_OUT_OF_ORDER},
+	CHARGER_RESERVED:       {CHARGER_AVAILABLE, CHARGER_IN_USE, CHARGER_OUT_OF_ORDER, CHARGER_MAINTENANCE},
+	CHARGER_OUT_OF_ORDER:   {CHARGER_AVAILABLE, CHARGER_MAINTENANCE, CHARGER_DECOMMISSIONED},
+	CHARGER_MAINTENANCE:    {CHARGER_AVAILABLE, CHARGER_OUT_OF_ORDER, CHARGER_DECOMMISSIONED},
+	CHARGER_DECOMMISSIONED: {},
+}
+
+// in_use follows sessions, so owners can't set it or move a charger out of
+// it while a session is open.
+var owner_settable_statuses = map[string]bool{
+	CHARGER_AVAILABLE:      true,
+	CHARGER_RESERVED:       true,
+	CHARGER_OUT_OF_ORDER:   true,
+	CHARGER_MAINTENANCE:    true,
+	CHARGER_DECOMMISSIONED: true,
+}
+
+// statuses a session may start from, in the app or over OCPP. reservations
+// have no holder, so nobody can take a reserved charger.
+var session_start_statuses = []string{CHARGER_AVAILABLE}
+
+var ErrInvalidTransition = errors.New("Charger can't move to this status from its current one")
+
+// statuses a charger may be in to move to the given status.
+func StatusesLeadingTo(to string) []string {
+	from := []string{}
+	for status, targets := range charger_transitions {
+		for _, target := range targets {
+			if target == to {
+				from = append(from, status)
+			}
+		}
+	}
+	return from
+}
+
+// Moves a charger to a new status if it's currently in one of from, which
+// must all allow the move. The check and the write are one operation, so two
+// sessions can't both take an available charger. Every change is logged in
+// the status history.
+func TransitionChargerStatus(charger_id primitive.ObjectID, from []string, to string, reason string, changed_by *primitive.ObjectID) (Charger, error) {
+	now := time.Now()
+
+	update := bson.D{
+		{"status", to},
+		{"status_changed_at", now},
+	}
+	// a decommissioned charger can't connect over OCPP anymore.
+	if to == CHARGER_DECOMMISSIONED {
+		update = append(update,
+			bson.E{"is_decommissioned", true},
+			bson.E{"decommissioned_at", now},
+			bson.E{"ocpp_key", ""},
+		)
+	}
+
+	filter := bson.D{
+		{"_id", charger_id},
+		{"status", bson.D{{"$in", from}}},
+	}
+	// archiving a station flags its chargers before checking they're free.
+	if to == CHARGER_IN_USE {
+		filter = append(filter, bson.E{"is_archived", bson.D{{"$ne", true}}})
+	}
+
+	var before Charger
+	err := mongoClient.Database("GoCharge").Collection(CHARGER_COLL).FindOneAndUpdate(
+		context.TODO(),
+		filter,
+		bson.D{{"$set", update}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return before, ErrInvalidTransition
+	}
+	if err != nil {
+		return before, err
+	}
+
+	_, err = CreateOne(CHARGER_STATUS_HISTORY_COLL, ChargerStatusChange{
+		ID:        primitive.NewObjectID(),
+		ChargerID: charger_id,
+		StationID: before.StationID,
+		From:      before.Status,
+		To:        to,
+		Reason:    reason,
+		ChangedBy: changed_by,
+		ChangedAt: now,
+	})
+	if err != nil {
+		return before, err
+	}
+
+	after := before
+	after.Status = to
+	after.StatusChangedAt = &now
+	if to == CHARGER_DECOMMISSIONED {
+		after.IsDecommissioned = true
+		after.DecommissionedAt = &now
+		after.OCPPKey = ""
+		charge_point := GetChargePoint(charger_id)
+		if charge_point != nil {
+			charge_point.Close()
+		}
+	}
+	return after, nil
+}
+
+// Validates and applies a status an owner or their staff picked.
+func SetChargerStatusByOwner(charger Charger, to string, user_id primitive.ObjectID) (Charger, error) {
+	if !owner_settable_statuses[to] {
+		return charger, errors.New("Status must be 'available', 'reserved', 'out_of_order', 'maintenance' or 'decommissioned'")
+	}
+	if charger.Status == to {
+		return charger, nil
+	}
+	if charger.Status == CHARGER_IN_USE {
+		return charger, errors.New("Charger has a session open")
+	}
+
+	from := []string{}
+	for _, status := range StatusesLeadingTo(to) {
+		if status != CHARGER_IN_USE {
+			from = append(from, status)
+		}
+	}
+	return TransitionChargerStatus(charger.ID, from, to, STATUS_REASON_OWNER, &user_id)
+}
+
+// Maps the free text statuses chargers had before the state machine onto
+// it. Chargers with an open session become in_use.
+func MigrateChargerStatuses() {
+	known := []string{}
+	for status := range charger_transitions {
+		known = append(known, status)
+	}
+
+	coll := mongoClient.Database("GoCharge").Collection(CHARGER_COLL)
+	result, err := coll.UpdateMany(
+		context.TODO(),
+		bson.D{{"status", bson.D{{"$in", bson.A{"working", "", nil}}}}},
+		bson.D{{"$set", bson.D{{"status", CHARGER_AVAILABLE}}}},
+	)
+	if err != nil {
+		log.Printf("failed to migrate charger statuses: %s", err)
+		return
+	}
+	migrated := result.ModifiedCount
+
+	result, err = coll.UpdateMany(
+		context.TODO(),
+		bson.D{{"status", bson.D{{"$nin", known}}}},
+		bson.D{{"$set", bson.D{{"status", CHARGER_OUT_OF_ORDER}}}},
+	)
+	if err != nil {
+		log.Printf("failed to migrate charger statuses: %s", err)
+		return
+	}
+	migrated += result.ModifiedCount
+
+	open_sessions, err := GetAll[Session](SESSION_COLL, bson.D{{"end_timestamp", 0}}, 0)
+	if err != nil {
+		log.Printf("failed to migrate charger statuses: %s", err)
+		return
+	}
+	busy_ids := []primitive.ObjectID{}
+	for _, session := range open_sessions {
+		busy_ids = append(busy_ids, session.ChargerID)
+	}
+	result, err = coll.UpdateMany(
+		context.TODO(),
+		bson.D{
+			{"_id", bson.D{{"$in", busy_ids}}},
+			{"status", CHARGER_AVAILABLE},
+		},
+		bson.D{{"$set", bson.D{{"status", CHARGER_IN_USE}}}},
+	)
+	if err != nil {
+		log.Printf("failed to migrate charger statuses: %s", err)
+		return
+	}
+	migrated += result.ModifiedCount
+
+	// chargers from before decommissioning need the flag for the partial
+	// name index to cover them.
+	result, err = coll.UpdateMany(
+		context.TODO(),
+		bson.D{{"is_decommissioned", bson.D{{"$exists", false}}}},
+		bson.A{bson.D{{"$set", bson.D{
+			{"is_decommissioned", bson.D{{"$eq", bson.A{"$status", CHARGER_DECOMMISSIONED}}}},
+		}}}},
+	)
+	if err != nil {
+		log.Printf("failed to migrate charger statuses: %s", err)
+		return
+	}
+	migrated += result.ModifiedCount
+
+	if migrated > 0 {
+		log.Printf("migrated the status of %d chargers", migrated)
+	}
+}
+
+// Set a charger's status, e.g. to take it down for maintenance.
+func HandleSetChargerStatus(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[SetChargerStatusInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_EDIT_CHARGERS)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	charger, err = SetChargerStatusByOwner(charger, body_data.Status, user_id)
+	if err == ErrInvalidTransition {
+		c.JSON(http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, charger)
+}
+
+const MAX_STATUS_HISTORY = 100
+
+// Get a charger's latest status changes, newest first.
+func HandleGetChargerStatusHistory(c *gin.Context) {
+	user_claim := c.MustGet(MW_USER_KEY).(UserClaim)
+	user_id, err := primitive.ObjectIDFromHex(user_claim.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body_data, err := ReadBodyToStruct[ChargerIDInput](c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	charger, err := GetCharger(bson.D{{"_id", body_data.ChargerID}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, "No such charger found")
+		return
+	}
+	_, err = AuthorizeStation(user_id, charger.StationID, PERM_VIEW_STATION)
+	if err != nil {
+		RespondStationAuthError(c, err)
+		return
+	}
+
+	history, err := Aggregate[ChargerStatusChange](CHARGER_STATUS_HISTORY_COLL, bson.A{
+		bson.D{
+			{"$match", bson.D{{"charger_id", charger.ID}}},
+		},
+		bson.D{
+			{"$sort", bson.D{{"changed_at", -1}}},
+		},
+		bson.D{
+			{"$limit", MAX_STATUS_HISTORY},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Splits text into unique lowercase words.
+func Tokenize(text string) []string {
+	tokens := []string{}
+	seen := map[string]bool{}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// words autocomplete can match a station by.
+func StationSearchTokens(name string, address string) []string {
+	return Tokenize(name + " " + address)
+}
+
+// how many typos a query word of this length may contain.
+func AllowedTypos(word string) int {
+	length := len([]rune(word))
+	switch {
+	case length <= 3:
+		return 0
+	case length <= 7:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Optimal string alignment distance, i.e. Levenshtein distance that also
+// counts swapping two adjacent characters as one edit.
+func EditDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
+
+// Edit distance between a partially typed word and the closest prefix of
+// word, so "walm" and "walmr" both match "walmart". Autocomplete only
+// fetches stations sharing the first two letters, so "wlma" does not.
+func PrefixEditDistance(partial string, word string) int {
+	rp, rw := []rune(partial), []rune(word)
+	best := len(rp)
+	for length := max(0, len(rp)-2); length <= min(len(rw), len(rp)+2); length++ {
+		best = min(best, EditDistance(partial, string(rw[:length])))
+	}
+	return best
+}
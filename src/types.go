@@ -33,47 +33,88 @@ type ResetEmailInput struct {
 }
 
 type NewUser struct {
-	FavoriteStationIDs      []string `json:"favorite_station_ids" bson:"favorite_station_ids"`
-	Username                string   `json:"username" bson:"username"`
-	Password                string   `json:"password" bson:"password"`
-	Email                   string   `json:"email" bson:"email"`
-	Role                    string   `json:"role" bson:"role"`
-	PhotoURL                string   `json:"photo_url" bson:"photo_url"`
-	SecurityQuestionAnswers []string `json:"security_question_answers" bson:"security_question_answers"`
+	FavoriteStationIDs      []primitive.ObjectID `json:"favorite_station_ids" bson:"favorite_station_ids"`
+	Username                string               `json:"username" bson:"username"`
+	Password                string               `json:"password" bson:"password"`
+	Email                   string               `json:"email" bson:"email"`
+	Role                    string               `json:"role" bson:"role"`
+	PhotoURL                string               `json:"photo_url" bson:"photo_url"`
+	SecurityQuestionAnswers []string             `json:"security_question_answers" bson:"security_question_answers"`
 }
 
 type User struct {
-	ID                 string   `json:"_id" bson:"_id"`
-	FavoriteStationIDs []string `json:"favorite_station_ids" bson:"favorite_station_ids"`
-	Username           string   `json:"username" bson:"username"`
-	Email              string   `json:"email" bson:"email"`
-	Role               string   `json:"role" bson:"role"`
-	PhotoURL           string   `json:"photo_url" bson:"photo_url"`
+	ID                 string               `json:"_id" bson:"_id"`
+	FavoriteStationIDs []primitive.ObjectID `json:"favorite_station_ids" bson:"favorite_station_ids"`
+	Username           string               `json:"username" bson:"username"`
+	Email              string               `json:"email" bson:"email"`
+	Role               string               `json:"role" bson:"role"`
+	PhotoURL           string               `json:"photo_url" bson:"photo_url"`
+}
+
+// filters shared by every station search.
+type StationFilters struct {
+	Statuses     []string `json:"statuses"`
+	PowerOutputs []string `json:"power_outputs"`
+	PlugTypes    []string `json:"plug_types"`
+	MaxPrice     float64  `json:"max_price"`
+	MinRating    float64  `json:"min_rating"`
+	Amenities    []string `json:"amenities"` // stations must have all of these
 }
 
 type FindStationsInput struct {
-	Statuses     []string   `json:"statuses"`
-	PowerOutputs []string   `json:"power_outputs"`
-	PlugTypes    []string   `json:"plug_types"`
-	MaxPrice     float64    `json:"max_price"`
-	MaxRadius    float64    `json:"max_radius"`
-	MaxResults   int64      `json:"max_results"`
-	Coordinates  [2]float64 `json:"coordinates"`
-	MinRating    float64    `json:"min_rating"`
+	StationFilters
+	MaxRadius   float64    `json:"max_radius"`
+	MaxResults  int64      `json:"max_results"`
+	Coordinates [2]float64 `json:"coordinates"`
+	Cursor      string     `json:"cursor"`
+	Sort        string     `json:"sort"` // distance (default), price, rating, availability or best_match
+}
+
+type ViewportStationsInput struct {
+	StationFilters
+	Bounds [2][2]float64 `json:"bounds"` // format: [[west, south], [east, north]]
+	Zoom   int           `json:"zoom"`
+}
+
+type StationCluster struct {
+	Coordinates       [2]float64 `json:"coordinates" bson:"coordinates"` // mean position of the clustered stations
+	Count             int64      `json:"count" bson:"count"`
+	MinPrice          *float64   `json:"min_price" bson:"min_price"` // nil when no charger has a price
+	AvailableChargers int64      `json:"available_chargers" bson:"available_chargers"`
+}
+
+type ViewportStationsOutput struct {
+	Clustered bool                 `json:"clustered"`
+	Stations  []FindStationsOutput `json:"stations"`
+	Clusters  []StationCluster     `json:"clusters"`
 }
 
 type UnapprovedStationsOutput struct {
-	ID               primitive.ObjectID `json:"_id" bson:"_id"`
-	OwnerID          primitive.ObjectID `json:"owner_id" bson:"owner_id"`
-	PictureURLs      []string           `json:"picture_urls" bson:"picture_urls"`
-	Name             string             `json:"name" bson:"name"`
-	Description      string             `json:"description" bson:"description"`
-	Coordinates      [2]float64         `json:"coordinates" bson:"coordinates"`
-	Address          string             `json:"address" bson:"address"`
-	IsPublic         bool               `json:"is_public" bson:"is_public"`
-	IsDenied         bool               `json:"is_denied" bson:"is_denied"`
-	OperationalHours [7][2]int64        `json:"operational_hours" bson:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
-	Chargers         []Charger          `json:"chargers" bson:"chargers"`
+	ID                 primitive.ObjectID        `json:"_id" bson:"_id"`
+	OwnerID            primitive.ObjectID        `json:"owner_id" bson:"owner_id"`
+	PictureURLs        []string                  `json:"picture_urls" bson:"picture_urls"`
+	Name               string                    `json:"name" bson:"name"`
+	Description        string                    `json:"description" bson:"description"`
+	Coordinates        [2]float64                `json:"coordinates" bson:"coordinates"`
+	Address            string                    `json:"address" bson:"address"`
+	IsPublic           bool                      `json:"is_public" bson:"is_public"`
+	IsDenied           bool                      `json:"is_denied" bson:"is_denied"`
+	OperationalHours   [7][2]int64               `json:"operational_hours" bson:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
+	LocationMismatch   bool                      `json:"location_mismatch" bson:"location_mismatch"`
+	MismatchMeters     float64                   `json:"mismatch_meters" bson:"mismatch_meters"`
+	Amenities          []string                  `json:"amenities" bson:"amenities"`
+	CoLocatedIDs       []primitive.ObjectID      `json:"co_located_station_ids" bson:"co_located_station_ids"`
+	PossibleDuplicates []DuplicateStationSummary `json:"possible_duplicates" bson:"possible_duplicates"`
+	Chargers           []Charger                 `json:"chargers" bson:"chargers"`
+}
+
+type DuplicateStationSummary struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	OwnerID     primitive.ObjectID `json:"owner_id" bson:"owner_id"`
+	Name        string             `json:"name" bson:"name"`
+	Coordinates [2]float64         `json:"coordinates" bson:"coordinates"`
+	Address     string             `json:"address" bson:"address"`
+	IsPublic    bool               `json:"is_public" bson:"is_public"`
 }
 
 type FindStationsOutput struct {
@@ -85,10 +126,63 @@ type FindStationsOutput struct {
 	Coordinates      [2]float64         `json:"coordinates" bson:"coordinates"`
 	Address          string             `json:"address" bson:"address"`
 	OperationalHours [7][2]int64        `json:"operational_hours" bson:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
+	Amenities        []string           `json:"amenities" bson:"amenities"`
 	Chargers         []Charger          `json:"chargers" bson:"chargers"`
 	Distance         float64            `json:"distance" bson:"distance"`
 	ReviewCount      int                `json:"review_count" bson:"review_count"`
-	ReviewScore      int                `json:"review_score" bson:"review_score"`
+	ReviewScore      int                `json:"-" bson:"review_score"`                // sum of ratings, see average_rating
+	AverageRating    float64            `json:"average_rating" bson:"average_rating"` // 0 without reviews
+	SortKey          float64            `json:"-" bson:"sort_key"`
+}
+
+type FindStationsPage struct {
+	Stations       []FindStationsOutput `json:"stations"`
+	NextCursor     string               `json:"next_cursor"` // empty when there are no more results
+	EstimatedTotal int64                `json:"estimated_total"`
+}
+
+type ClosestStationsFacet struct {
+	Stations []FindStationsOutput `bson:"stations"`
+	Total    []FacetCount         `bson:"total"`
+}
+
+type GeoJSONLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+type RouteStationsInput struct {
+	StationFilters
+	Polyline      string             `json:"polyline"`       // encoded polyline, precision 5
+	LineString    *GeoJSONLineString `json:"line_string"`    // used when no polyline is given
+	CorridorWidth float64            `json:"corridor_width"` // max distance from the route, in meters, up to 25km
+	MaxResults    int64              `json:"max_results"`
+}
+
+type RouteStationOutput struct {
+	FindStationsOutput
+	DistanceAlongRoute float64 `json:"distance_along_route"` // meters from the start of the route; distance is meters off the route
+}
+
+type TextSearchStationsInput struct {
+	Query       string      `json:"query"`
+	Coordinates *[2]float64 `json:"coordinates"` // optional, boosts nearby stations
+	MaxResults  int64       `json:"max_results"`
+}
+
+type TextSearchStationOutput struct {
+	FindStationsOutput `bson:",inline"`
+	Score              float64 `json:"score" bson:"score"`
+}
+
+type StationSuggestion struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Name         string             `json:"name" bson:"name"`
+	Address      string             `json:"address" bson:"address"`
+	Coordinates  [2]float64         `json:"coordinates" bson:"coordinates"`
+	SearchTokens []string           `json:"-" bson:"search_tokens"`
+	Distance     float64            `json:"distance" bson:"-"` // 0 when no position was given
+	Score        float64            `json:"score" bson:"-"`
 }
 
 type ApprovedStationInput struct {
@@ -100,8 +194,95 @@ type FavoriteStationInput struct {
 	StationID string `json:"station_id" bson:"station_id"`
 }
 
+type FavoriteStationsInput struct {
+	Coordinates *[2]float64 `json:"coordinates"` // optional, to get distances
+}
+
+type FavoriteChargerOutput struct {
+	Charger     `bson:",inline"`
+	IsAvailable bool `json:"is_available"` // working and without an open session
+}
+
+type FavoriteStationOutput struct {
+	Station           `bson:",inline"`
+	Chargers          []FavoriteChargerOutput `json:"chargers" bson:"chargers"`
+	AvailableChargers int                     `json:"available_chargers" bson:"-"`
+	IsOpenNow         bool                    `json:"is_open_now" bson:"-"`
+	Distance          *float64                `json:"distance,omitempty" bson:"-"` // only when coordinates were given
+}
+
+type FavoriteStationsOutput struct {
+	Stations              []FavoriteStationOutput `json:"stations"`
+	UnavailableStationIDs []primitive.ObjectID    `json:"unavailable_station_ids"` // favorites that still exist but can't be found by drivers right now
+}
+
+type StationIDInput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+}
+
+type StationGrant struct {
+	ID        primitive.ObjectID  `json:"_id" bson:"_id"`
+	StationID primitive.ObjectID  `json:"station_id" bson:"station_id"`
+	UserID    *primitive.ObjectID `json:"user_id" bson:"user_id"` // set once the invite is accepted
+	Email     string              `json:"email" bson:"email"`
+	Role      string              `json:"role" bson:"role"`
+	Status    string              `json:"status" bson:"status"`
+	Token     string              `json:"-" bson:"token"`
+	InvitedBy primitive.ObjectID  `json:"invited_by" bson:"invited_by"`
+	CreatedAt time.Time           `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time           `json:"expires_at" bson:"expires_at"`
+}
+
+type InviteStationManagerInput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+	Email     string             `json:"email"`
+	Role      string             `json:"role"`
+}
+
+type GrantIDInput struct {
+	GrantID primitive.ObjectID `json:"grant_id"`
+}
+
+type ManagedStationOutput struct {
+	Role    string  `json:"role" bson:"role"`
+	Station Station `json:"station" bson:"station"`
+}
+
+type TransferStationInput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+	Email     string             `json:"email"`
+}
+
 type GetStationAndChargersInput struct {
-	StationID primitive.ObjectID `json:"station_id" bson:"station_id"`
+	StationID  primitive.ObjectID `json:"station_id" bson:"station_id"`
+	ShareToken string             `json:"share_token" bson:"share_token"` // from the share link of an unlisted station
+}
+
+type StationGuest struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	StationID   primitive.ObjectID `json:"station_id" bson:"station_id"`
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Username    string             `json:"username" bson:"username"`
+	Status      string             `json:"status" bson:"status"`
+	Message     string             `json:"message" bson:"message"`
+	RequestedAt time.Time          `json:"requested_at" bson:"requested_at"`
+	DecidedAt   *time.Time         `json:"decided_at" bson:"decided_at"`
+}
+
+type StationAccessRequestInput struct {
+	StationID  primitive.ObjectID `json:"station_id"`
+	ShareToken string             `json:"share_token"`
+	Message    string             `json:"message"`
+}
+
+type DecideStationAccessInput struct {
+	RequestID primitive.ObjectID `json:"request_id"`
+	Approve   bool               `json:"approve"`
+}
+
+type StationShareLinkOutput struct {
+	StationID  primitive.ObjectID `json:"station_id"`
+	ShareToken string             `json:"share_token"`
 }
 
 type GetStationAndChargersOutput struct {
@@ -110,12 +291,15 @@ type GetStationAndChargersOutput struct {
 }
 
 type NewStationInput struct {
-	Name             string            `json:"name"`
-	Description      string            `json:"description"`
-	Coordinates      [2]float64        `json:"coordinates"`
-	Address          string            `json:"address"`
-	OperationalHours [7][2]int64       `json:"operational_hours"`
-	Chargers         []NewChargerInput `json:"chargers"`
+	Name             string               `json:"name"`
+	Description      string               `json:"description"`
+	Coordinates      [2]float64           `json:"coordinates"`
+	Address          string               `json:"address"`
+	OperationalHours [7][2]int64          `json:"operational_hours"`
+	Chargers         []NewChargerInput    `json:"chargers"`
+	CoLocatedIDs     []primitive.ObjectID `json:"co_located_station_ids"` // e.g. other floors of the same garage
+	Amenities        []string             `json:"amenities"`
+	Visibility       string               `json:"visibility"`
 }
 
 type NewStationOutput struct {
@@ -124,19 +308,73 @@ type NewStationOutput struct {
 }
 
 type Station struct {
-	ID               primitive.ObjectID `json:"_id" bson:"_id"`
-	OwnerID          primitive.ObjectID `json:"owner_id" bson:"owner_id"`
-	PictureURLs      []string           `json:"picture_urls" bson:"picture_urls"`
-	Name             string             `json:"name" bson:"name"`
-	Description      string             `json:"description" bson:"description"`
-	Coordinates      [2]float64         `json:"coordinates" bson:"coordinates"`
-	Address          string             `json:"address" bson:"address"`
-	IsPublic         bool               `json:"is_public" bson:"is_public"`
-	IsDenied         bool               `json:"is_denied" bson:"is_denied"`
-	IsDisabled       bool               `json:"is_disabled" bson:"is_disabled"`
-	OperationalHours [7][2]int64        `json:"operational_hours" bson:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
-	ReviewCount      int                `json:"review_count" bson:"review_count"`
-	ReviewScore      int                `json:"review_score" bson:"review_score"`
+	ID                primitive.ObjectID   `json:"_id" bson:"_id"`
+	OwnerID           primitive.ObjectID   `json:"owner_id" bson:"owner_id"`
+	PictureURLs       []string             `json:"picture_urls" bson:"picture_urls"`
+	Name              string               `json:"name" bson:"name"`
+	Description       string               `json:"description" bson:"description"`
+	Coordinates       [2]float64           `json:"coordinates" bson:"coordinates"`
+	Address           string               `json:"address" bson:"address"`
+	IsPublic          bool                 `json:"is_public" bson:"is_public"`
+	IsDenied          bool                 `json:"is_denied" bson:"is_denied"`
+	IsDisabled        bool                 `json:"is_disabled" bson:"is_disabled"`
+	OperationalHours  [7][2]int64          `json:"operational_hours" bson:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
+	ReviewCount       int                  `json:"review_count" bson:"review_count"`
+	ReviewScore       int                  `json:"review_score" bson:"review_score"`
+	SearchTokens      []string             `json:"-" bson:"search_tokens"`                     // lowercase words of name and address, for autocomplete
+	LocationMismatch  bool                 `json:"location_mismatch" bson:"location_mismatch"` // address and coordinates disagree according to the geocoder
+	MismatchMeters    float64              `json:"mismatch_meters" bson:"mismatch_meters"`
+	CoLocatedIDs      []primitive.ObjectID `json:"co_located_station_ids" bson:"co_located_station_ids"` // stations the owner declared to share this location
+	DuplicateIDs      []primitive.ObjectID `json:"possible_duplicate_ids" bson:"possible_duplicate_ids"` // nearby stations that look like the same site, for admins to check
+	PendingRevisionID *primitive.ObjectID  `json:"pending_revision_id" bson:"pending_revision_id"`       // location edits waiting on admin approval
+	IsArchived        bool                 `json:"is_archived" bson:"is_archived"`                       // hidden from drivers, restorable by admins
+	IsDeleted         bool                 `json:"is_deleted" bson:"is_deleted"`                         // archived for good, kept so sessions and reviews stay readable
+	ArchivedAt        *time.Time           `json:"archived_at" bson:"archived_at"`
+	PendingOwnerID    *primitive.ObjectID  `json:"pending_owner_id" bson:"pending_owner_id"`                   // owner the station is being transferred to
+	Amenities         []string             `json:"amenities" bson:"amenities"`                                 // keys from the amenity catalog
+	ExternalSource    string               `json:"external_source,omitempty" bson:"external_source,omitempty"` // set on stations seeded by the import command
+	ExternalID        string               `json:"external_id,omitempty" bson:"external_id,omitempty"`
+	Visibility        string               `json:"visibility" bson:"visibility"` // public, unlisted or guests_only. empty means public
+	ShareToken        string               `json:"-" bson:"share_token"`         // lets link holders reach unlisted stations and ask for access
+}
+
+// Fields of a published station that only change through an approved
+// StationRevision.
+type StationLocationFields struct {
+	Name             string               `json:"name" bson:"name"`
+	Address          string               `json:"address" bson:"address"`
+	Coordinates      [2]float64           `json:"coordinates" bson:"coordinates"`
+	CoLocatedIDs     []primitive.ObjectID `json:"co_located_station_ids" bson:"co_located_station_ids"`
+	LocationMismatch bool                 `json:"location_mismatch" bson:"location_mismatch"`
+	MismatchMeters   float64              `json:"mismatch_meters" bson:"mismatch_meters"`
+	DuplicateIDs     []primitive.ObjectID `json:"possible_duplicate_ids" bson:"possible_duplicate_ids"`
+}
+
+type StationRevision struct {
+	ID         primitive.ObjectID    `json:"_id" bson:"_id"`
+	StationID  primitive.ObjectID    `json:"station_id" bson:"station_id"`
+	OwnerID    primitive.ObjectID    `json:"owner_id" bson:"owner_id"`
+	Status     string                `json:"status" bson:"status"`
+	Previous   StationLocationFields `json:"previous" bson:"previous"`
+	Changes    StationLocationFields `json:"changes" bson:"changes"`
+	CreatedAt  time.Time             `json:"created_at" bson:"created_at"`
+	ReviewedAt *time.Time            `json:"reviewed_at" bson:"reviewed_at"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+type StationRevisionOutput struct {
+	StationRevision
+	Diff []FieldChange `json:"diff"`
+}
+
+type ApproveStationRevisionInput struct {
+	RevisionID primitive.ObjectID `json:"revision_id"`
+	Approved   bool               `json:"approved"`
 }
 
 type NewChargerInput struct {
@@ -155,23 +393,248 @@ type NewCharger struct {
 	ChargerTypesId string             `json:"charger_types_id" bson:"charger_types_id"`
 	Status         string             `json:"status" bson:"status"`
 	Price          float64            `json:"price" bson:"price"`
+	PriceUnknown   bool               `json:"price_unknown" bson:"price_unknown,omitempty"` // imported without a price, until the owner sets one
 	TotalPayments  float64            `json:"total_payments" bson:"total_payments"`
 }
 
 type Charger struct {
+	ID              primitive.ObjectID `json:"_id" bson:"_id"`
+	StationID       primitive.ObjectID `json:"station_id" bson:"station_id"`
+	Name            string             `json:"name" bson:"name"`
+	Description     string             `json:"description" bson:"description"`
+	KWhTypesId      string             `json:"kWh_types_id" bson:"kWh_types_id"`
+	ChargerTypesId  string             `json:"charger_types_id" bson:"charger_types_id"`
+	Status          string             `json:"status" bson:"status"`
+	Price           float64            `json:"price" bson:"price"`
+	PriceUnknown    bool               `json:"price_unknown" bson:"price_unknown,omitempty"` // imported without a price, until the owner sets one
+	TotalPayments   float64            `json:"total_payments" bson:"total_payments"`
+	IsArchived      bool               `json:"is_archived" bson:"is_archived"` // archived along with its station
+	ExternalID      string             `json:"external_id,omitempty" bson:"external_id,omitempty"`
+	StatusChangedAt *time.Time         `json:"status_changed_at" bson:"status_changed_at"`
+	OCPPKey         string             `json:"-" bson:"ocpp_key"` // lets the charge point connect over OCPP
+	OCPPModel       string             `json:"ocpp_model" bson:"ocpp_model"`
+	OCPPLastSeenAt  *time.Time         `json:"ocpp_last_seen_at" bson:"ocpp_last_seen_at"`
+	// decommissioned chargers are kept for their sessions, but hidden from
+	// drivers and free their name for a replacement.
+	IsDecommissioned bool       `json:"is_decommissioned" bson:"is_decommissioned"`
+	ShortCode        string     `json:"short_code,omitempty" bson:"short_code,omitempty"` // printed on the charger, starts sessions
+	DecommissionedAt *time.Time `json:"decommissioned_at" bson:"decommissioned_at"`
+}
+
+type ChargerStatusChange struct {
+	ID        primitive.ObjectID  `json:"_id" bson:"_id"`
+	ChargerID primitive.ObjectID  `json:"charger_id" bson:"charger_id"`
+	StationID primitive.ObjectID  `json:"station_id" bson:"station_id"`
+	From      string              `json:"from" bson:"from"`
+	To        string              `json:"to" bson:"to"`
+	Reason    string              `json:"reason" bson:"reason"`
+	ChangedBy *primitive.ObjectID `json:"changed_by" bson:"changed_by"` // user behind the change, nil for automatic ones
+	ChangedAt time.Time           `json:"changed_at" bson:"changed_at"`
+}
+
+// a period a charger is taken offline for.
+type MaintenanceWindow struct {
 	ID             primitive.ObjectID `json:"_id" bson:"_id"`
+	ChargerID      primitive.ObjectID `json:"charger_id" bson:"charger_id"`
 	StationID      primitive.ObjectID `json:"station_id" bson:"station_id"`
-	Name           string             `json:"name" bson:"name"`
-	Description    string             `json:"description" bson:"description"`
-	KWhTypesId     string             `json:"kWh_types_id" bson:"kWh_types_id"`
-	ChargerTypesId string             `json:"charger_types_id" bson:"charger_types_id"`
-	Status         string             `json:"status" bson:"status"`
-	Price          float64            `json:"price" bson:"price"`
-	TotalPayments  float64            `json:"total_payments" bson:"total_payments"`
+	StartsAt       time.Time          `json:"starts_at" bson:"starts_at"`
+	EndsAt         time.Time          `json:"ends_at" bson:"ends_at"`
+	Reason         string             `json:"reason" bson:"reason"`
+	Status         string             `json:"status" bson:"status"`                   // scheduled, active, completed or cancelled
+	PreviousStatus string             `json:"previous_status" bson:"previous_status"` // charger status when the window started
+	CreatedBy      primitive.ObjectID `json:"created_by" bson:"created_by"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	NotifiedAt     *time.Time         `json:"notified_at" bson:"notified_at"` // when favoriting drivers were emailed
+}
+
+type MaintenanceWindowInput struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+	StartsAt  time.Time          `json:"starts_at"`
+	EndsAt    time.Time          `json:"ends_at"`
+	Reason    string             `json:"reason"`
+}
+
+type MaintenanceWindowIDInput struct {
+	WindowID primitive.ObjectID `json:"window_id"`
+}
+
+// a driver's report of a problem with a charger.
+type FaultReport struct {
+	ID          primitive.ObjectID  `json:"_id" bson:"_id"`
+	ChargerID   primitive.ObjectID  `json:"charger_id" bson:"charger_id"`
+	StationID   primitive.ObjectID  `json:"station_id" bson:"station_id"`
+	UserID      primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	Category    string              `json:"category" bson:"category"`
+	Description string              `json:"description" bson:"description"`
+	PhotoURLs   []string            `json:"photo_urls" bson:"photo_urls"`
+	Status      string              `json:"status" bson:"status"` // open, acknowledged, in_progress or resolved
+	OwnerNote   string              `json:"owner_note" bson:"owner_note"`
+	HasSession  bool                `json:"has_session" bson:"has_session"` // reporter charged at the station recently, only these count towards out of order
+	CreatedAt   time.Time           `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at" bson:"updated_at"`
+	UpdatedBy   *primitive.ObjectID `json:"updated_by" bson:"updated_by"`
+	ResolvedAt  *time.Time          `json:"resolved_at" bson:"resolved_at"`
+}
+
+type FaultReportInput struct {
+	ChargerID   primitive.ObjectID `json:"charger_id"`
+	Category    string             `json:"category"`
+	Description string             `json:"description"`
+	PhotoURLs   []string           `json:"photo_urls"`
+}
+
+type FaultReportsInput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+	Statuses  []string           `json:"statuses"` // all when empty
+}
+
+type UpdateFaultReportInput struct {
+	ReportID  primitive.ObjectID `json:"report_id"`
+	Status    string             `json:"status"`
+	OwnerNote string             `json:"owner_note"`
+}
+
+// OCPP 1.6J payloads. field names follow the spec.
+type OCPPIdTagInfo struct {
+	Status string `json:"status"` // Accepted, Blocked, Expired, Invalid or ConcurrentTx
+}
+
+type OCPPBootNotificationReq struct {
+	ChargePointVendor       string `json:"chargePointVendor"`
+	ChargePointModel        string `json:"chargePointModel"`
+	ChargePointSerialNumber string `json:"chargePointSerialNumber,omitempty"`
+	FirmwareVersion         string `json:"firmwareVersion,omitempty"`
+}
+
+type OCPPBootNotificationConf struct {
+	Status      string `json:"status"`
+	CurrentTime string `json:"currentTime"`
+	Interval    int64  `json:"interval"` // heartbeat interval in seconds
+}
+
+type OCPPHeartbeatConf struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+type OCPPStatusNotificationReq struct {
+	ConnectorID int    `json:"connectorId"`
+	ErrorCode   string `json:"errorCode"`
+	Status      string `json:"status"`
+	Timestamp   string `json:"timestamp,omitempty"`
+}
+
+type OCPPAuthorizeReq struct {
+	IdTag string `json:"idTag"`
+}
+
+type OCPPAuthorizeConf struct {
+	IdTagInfo OCPPIdTagInfo `json:"idTagInfo"`
+}
+
+type OCPPStartTransactionReq struct {
+	ConnectorID   int    `json:"connectorId"`
+	IdTag         string `json:"idTag"`
+	MeterStart    int64  `json:"meterStart"` // Wh
+	Timestamp     string `json:"timestamp"`
+	ReservationID *int   `json:"reservationId,omitempty"`
+}
+
+type OCPPStartTransactionConf struct {
+	TransactionID int64         `json:"transactionId"`
+	IdTagInfo     OCPPIdTagInfo `json:"idTagInfo"`
+}
+
+type OCPPStopTransactionReq struct {
+	TransactionID int64  `json:"transactionId"`
+	IdTag         string `json:"idTag,omitempty"`
+	MeterStop     int64  `json:"meterStop"` // Wh
+	Timestamp     string `json:"timestamp"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+type OCPPStopTransactionConf struct {
+	IdTagInfo *OCPPIdTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type OCPPSampledValue struct {
+	Value     string `json:"value"`
+	Measurand string `json:"measurand,omitempty"` // Energy.Active.Import.Register when empty
+	Unit      string `json:"unit,omitempty"`      // Wh when empty
+}
+
+type OCPPMeterValue struct {
+	Timestamp    string             `json:"timestamp"`
+	SampledValue []OCPPSampledValue `json:"sampledValue"`
+}
+
+type OCPPMeterValuesReq struct {
+	ConnectorID   int              `json:"connectorId"`
+	TransactionID *int64           `json:"transactionId,omitempty"`
+	MeterValue    []OCPPMeterValue `json:"meterValue"`
+}
+
+type OCPPRemoteStartTransactionReq struct {
+	ConnectorID int    `json:"connectorId,omitempty"`
+	IdTag       string `json:"idTag"`
+}
+
+type OCPPRemoteStopTransactionReq struct {
+	TransactionID int64 `json:"transactionId"`
+}
+
+// answer to RemoteStartTransaction and RemoteStopTransaction.
+type OCPPRemoteConf struct {
+	Status string `json:"status"` // Accepted or Rejected
+}
+
+// An OCPP id tag stands in for a user towards charge points, e.g. on an
+// RFID card.
+type OCPPIdTag struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	Tag       string             `json:"tag" bson:"tag"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	IsRevoked bool               `json:"is_revoked" bson:"is_revoked"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	RevokedAt *time.Time         `json:"revoked_at" bson:"revoked_at"`
+}
+
+type OCPPKeyOutput struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+	Path      string             `json:"path"` // websocket path the charge point connects to
+	Key       string             `json:"key"`  // basic auth password, the charger id is the username
+}
+
+type SessionIDInput struct {
+	SessionID primitive.ObjectID `json:"session_id"`
+}
+
+type ChargerIDInput struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+}
+
+type SetChargerStatusInput struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+	Status    string             `json:"status"`
 }
 
 type NewSessionInput struct {
 	ChargerID primitive.ObjectID `json:"charger_id"`
+	ShortCode string             `json:"short_code"` // used when charger_id is left out
+}
+
+type ChargerCodeInput struct {
+	ShortCode string `json:"short_code"`
+}
+
+type ChargerCodeOutput struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+	ShortCode string             `json:"short_code"`
+	Link      string             `json:"link"`
+}
+
+type ChargerByCodeOutput struct {
+	Station Station `json:"station"`
+	Charger Charger `json:"charger"`
 }
 
 type EndSessionInput struct {
@@ -188,6 +651,82 @@ type Session struct {
 	EndTimestamp   int64              `json:"end_timestamp" bson:"end_timestamp"`     // end unix timestamp
 	PaymentAmount  float64            `json:"payment_amount" bson:"payment_amount"`
 	PowerUsed      float64            `json:"power_used" bson:"power_used"`
+	TransactionID  int64              `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"` // OCPP transaction, for sessions run by the charge point
+	MeterStart     float64            `json:"meter_start,omitempty" bson:"meter_start,omitempty"`       // Wh reading when an OCPP session started
+	// running totals from meter readings.
+	MeterLastAt       *time.Time `json:"meter_last_at,omitempty" bson:"meter_last_at"`
+	MeterLastWh       float64    `json:"meter_last_wh,omitempty" bson:"meter_last_wh,omitempty"`
+	PowerKW           *float64   `json:"power_kw,omitempty" bson:"power_kw,omitempty"` // as of the last reading
+	PeakPowerKW       float64    `json:"peak_power_kw,omitempty" bson:"peak_power_kw,omitempty"`
+	StateOfCharge     *float64   `json:"state_of_charge,omitempty" bson:"state_of_charge,omitempty"`
+	MeterReadingCount int64      `json:"meter_reading_count,omitempty" bson:"meter_reading_count,omitempty"`
+}
+
+type MeterReadingInput struct {
+	RecordedAt    time.Time `json:"recorded_at"`
+	EnergyWh      float64   `json:"energy_wh"` // delivered since the session started, or the register for OCPP
+	PowerKW       *float64  `json:"power_kw"`
+	Voltage       *float64  `json:"voltage"`
+	Current       *float64  `json:"current"`
+	StateOfCharge *float64  `json:"state_of_charge"` // percent
+}
+
+type SessionMeterValuesInput struct {
+	SessionID primitive.ObjectID  `json:"session_id"`
+	Readings  []MeterReadingInput `json:"readings"`
+}
+
+type MeterReadingMeta struct {
+	SessionID primitive.ObjectID `json:"session_id" bson:"session_id"`
+	ChargerID primitive.ObjectID `json:"charger_id" bson:"charger_id"`
+}
+
+// one reading in the time-series collection.
+type MeterReading struct {
+	ID            primitive.ObjectID `json:"_id" bson:"_id"`
+	Meta          MeterReadingMeta   `json:"meta" bson:"meta"`
+	RecordedAt    time.Time          `json:"recorded_at" bson:"recorded_at"`
+	EnergyWh      float64            `json:"energy_wh" bson:"energy_wh"`
+	PowerKW       *float64           `json:"power_kw" bson:"power_kw,omitempty"`
+	Voltage       *float64           `json:"voltage" bson:"voltage,omitempty"`
+	Current       *float64           `json:"current" bson:"current,omitempty"`
+	StateOfCharge *float64           `json:"state_of_charge" bson:"state_of_charge,omitempty"`
+	Source        string             `json:"source" bson:"source"` // app or ocpp
+	ReceivedAt    time.Time          `json:"received_at" bson:"received_at"`
+}
+
+type RejectedReading struct {
+	Index  int    `json:"index"` // position in the request
+	Reason string `json:"reason"`
+}
+
+type MeterValuesOutput struct {
+	Accepted int               `json:"accepted"`
+	Rejected []RejectedReading `json:"rejected"`
+	Session  Session           `json:"session"`
+}
+
+type SessionTelemetryInput struct {
+	SessionID     primitive.ObjectID `json:"session_id"`
+	BucketSeconds int64              `json:"bucket_seconds"` // 0 picks one to fit the session
+}
+
+// readings of one bucket. averages skip readings without the value.
+type TelemetryPoint struct {
+	Time          time.Time `json:"time" bson:"_id"`
+	EnergyWh      float64   `json:"energy_wh" bson:"energy_wh"`
+	PowerKW       *float64  `json:"power_kw" bson:"power_kw"`
+	MaxPowerKW    *float64  `json:"max_power_kw" bson:"max_power_kw"`
+	Voltage       *float64  `json:"voltage" bson:"voltage"`
+	Current       *float64  `json:"current" bson:"current"`
+	StateOfCharge *float64  `json:"state_of_charge" bson:"state_of_charge"`
+	Readings      int64     `json:"readings" bson:"readings"`
+}
+
+type SessionTelemetryOutput struct {
+	Session       Session          `json:"session"`
+	BucketSeconds int64            `json:"bucket_seconds"`
+	Points        []TelemetryPoint `json:"points"`
 }
 
 type NewReviewInput struct {
@@ -240,18 +779,168 @@ type EditChargerInput struct {
 	KWhTypesId     string             `json:"kWh_types_id"`
 	ChargerTypesId string             `json:"charger_types_id"`
 	Price          float64            `json:"price"`
-	Status         string             `json:"status"`
+	Status         string             `json:"status"` // optional, changes go through the status state machine
 }
 
 type EditStationInput struct {
-	ID               primitive.ObjectID `json:"_id"`
-	PictureURLs      []string           `json:"picture_urls"`
-	Name             string             `json:"name"`
-	Description      string             `json:"description"`
-	Coordinates      [2]float64         `json:"coordinates"`
-	Address          string             `json:"address"`
-	OperationalHours [7][2]int64        `json:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
-	IsDisabled       bool               `json:"is_disabled"`
+	ID               primitive.ObjectID   `json:"_id"`
+	PictureURLs      []string             `json:"picture_urls"`
+	Name             string               `json:"name"`
+	Description      string               `json:"description"`
+	Coordinates      [2]float64           `json:"coordinates"`
+	Address          string               `json:"address"`
+	OperationalHours [7][2]int64          `json:"operational_hours"` // format: [days of week][start, end]sec_since_start_of_UNIX_day
+	IsDisabled       bool                 `json:"is_disabled"`
+	CoLocatedIDs     []primitive.ObjectID `json:"co_located_station_ids"`
+	Amenities        []string             `json:"amenities"`
+	Visibility       string               `json:"visibility"`
+}
+
+type Amenity struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	Key       string             `json:"key" bson:"key"`
+	Name      string             `json:"name" bson:"name"`
+	Category  string             `json:"category" bson:"category"`
+	IsActive  bool               `json:"is_active" bson:"is_active"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// a connector standard or power level chargers can be listed with.
+type ChargerCatalogEntry struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	Kind        string             `json:"kind" bson:"kind"` // connector or power
+	Key         string             `json:"key" bson:"key"`   // stored on chargers
+	Name        string             `json:"name" bson:"name"`
+	CurrentType string             `json:"current_type" bson:"current_type"` // AC, DC or AC/DC
+	MaxKW       float64            `json:"max_kw" bson:"max_kw"`
+	Aliases     []string           `json:"aliases" bson:"aliases"` // other spellings that normalize to the key
+	IsActive    bool               `json:"is_active" bson:"is_active"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type ChargerCatalogInput struct {
+	Kind        string   `json:"kind"`
+	Key         string   `json:"key"`
+	Name        string   `json:"name"`
+	CurrentType string   `json:"current_type"`
+	MaxKW       float64  `json:"max_kw"`
+	Aliases     []string `json:"aliases"`
+	IsActive    *bool    `json:"is_active"` // unchanged when left out on edit
+}
+
+type ChargerCatalogOutput struct {
+	Connectors  []ChargerCatalogEntry `json:"connectors"`
+	PowerLevels []ChargerCatalogEntry `json:"power_levels"`
+}
+
+type AmenityInput struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	IsActive *bool  `json:"is_active"` // unchanged when left out on edit
+}
+
+// per charger and UTC day. _id is left to mongo so rollups can be upserted
+// whole.
+type ChargerDailyStats struct {
+	ChargerID         primitive.ObjectID `json:"charger_id" bson:"charger_id"`
+	StationID         primitive.ObjectID `json:"station_id" bson:"station_id"`
+	Day               time.Time          `json:"day" bson:"day"`
+	SessionCount      int                `json:"session_count" bson:"session_count"`
+	PowerUsed         float64            `json:"power_used" bson:"power_used"`
+	Revenue           float64            `json:"revenue" bson:"revenue"`
+	DurationSeconds   int64              `json:"duration_seconds" bson:"duration_seconds"` // of sessions that ended this day
+	BusySeconds       int64              `json:"busy_seconds" bson:"busy_seconds"`
+	HourlyBusySeconds [24]int64          `json:"hourly_busy_seconds" bson:"hourly_busy_seconds"`
+}
+
+type StationAnalyticsInput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+	From      string             `json:"from"` // YYYY-MM-DD, inclusive
+	To        string             `json:"to"`
+}
+
+type AnalyticsSummary struct {
+	SessionCount       int            `json:"session_count"`
+	PowerUsed          float64        `json:"power_used"`
+	Revenue            float64        `json:"revenue"`
+	AvgDurationSeconds float64        `json:"avg_duration_seconds"`
+	UtilizationPercent float64        `json:"utilization_percent"`
+	Heatmap            [7][24]float64 `json:"heatmap"` // utilization percent by [weekday from sunday][hour], UTC
+}
+
+type ChargerAnalytics struct {
+	ChargerID primitive.ObjectID `json:"charger_id"`
+	Name      string             `json:"name"`
+	Summary   AnalyticsSummary   `json:"summary"`
+}
+
+type StationAnalyticsOutput struct {
+	StationID primitive.ObjectID `json:"station_id"`
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Summary   AnalyticsSummary   `json:"summary"`
+	Chargers  []ChargerAnalytics `json:"chargers"`
+}
+
+type PortfolioInput struct {
+	Cursor     string `json:"cursor"`
+	MaxResults int64  `json:"max_results"`
+}
+
+type ChargerSessionStats struct {
+	Earnings     float64   `bson:"earnings"`
+	SessionCount int       `bson:"session_count"`
+	OpenSessions []Session `bson:"open_sessions"`
+}
+
+type PortfolioChargerDoc struct {
+	Charger      `bson:",inline"`
+	SessionStats []ChargerSessionStats `bson:"session_stats"`
+}
+
+type PortfolioStationDoc struct {
+	Station  `bson:",inline"`
+	Chargers []PortfolioChargerDoc `bson:"chargers"`
+}
+
+type PortfolioChargerOutput struct {
+	Charger      Charger  `json:"charger"`
+	LiveStatus   string   `json:"live_status"`
+	OpenSession  *Session `json:"open_session"`
+	Earnings     float64  `json:"earnings"`
+	SessionCount int      `json:"session_count"` // finished sessions
+}
+
+type PortfolioStationOutput struct {
+	Station        Station                  `json:"station"`
+	ApprovalStatus string                   `json:"approval_status"`
+	ApprovalNote   string                   `json:"approval_note"`
+	Chargers       []PortfolioChargerOutput `json:"chargers"`
+	OpenSessions   []Session                `json:"open_sessions"`
+	Earnings       float64                  `json:"earnings"`
+	SessionCount   int                      `json:"session_count"`
+}
+
+type PortfolioPage struct {
+	Stations   []PortfolioStationOutput `json:"stations"`
+	NextCursor string                   `json:"next_cursor"` // empty on the last page
+}
+
+type RowError struct {
+	Row     int    `json:"row"` // spreadsheet row, counting the header as 1
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+type StationImportReport struct {
+	DryRun          bool       `json:"dry_run"`
+	Applied         bool       `json:"applied"`
+	StationsCreated int        `json:"stations_created"`
+	StationsUpdated int        `json:"stations_updated"`
+	ChargersCreated int        `json:"chargers_created"`
+	ChargersUpdated int        `json:"chargers_updated"`
+	Errors          []RowError `json:"errors"`
 }
 
 type OTPResponse struct {
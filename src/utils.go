@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"os"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -75,3 +78,32 @@ func Unpack(s []string, vars ...*string) {
 func ID2Str(id any) string {
 	return id.(primitive.ObjectID).Hex()
 }
+
+// reads an integer environment variable, falling back to the default when it
+// is unset or malformed.
+func ReadEnvInt64(key string, default_value int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return default_value
+	}
+	return value
+}
+
+// like ReadEnvInt64, but zero or negative values also fall back to the
+// default, with a warning.
+func ReadEnvPositiveInt64(key string, default_value int64) int64 {
+	value := ReadEnvInt64(key, default_value)
+	if value <= 0 {
+		log.Printf("%s must be positive, using %d", key, default_value)
+		return default_value
+	}
+	return value
+}
+
+// nil slices are stored as null in mongo, which breaks $in and $lookup.
+func NonNilIDs(ids []primitive.ObjectID) []primitive.ObjectID {
+	if ids == nil {
+		return []primitive.ObjectID{}
+	}
+	return ids
+}